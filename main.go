@@ -1,12 +1,24 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
 
 	"github.com/spf13/cobra"
 )
@@ -28,6 +40,77 @@ var errConflicts = errors.New("conflicts")
 // State directory inside .git
 const anticipateDir = "anticipate"
 
+// out receives all human-readable output; --json swaps it for io.Discard
+var out io.Writer = os.Stdout
+
+func printf(format string, a ...any) {
+	fprintf(out, format, a...)
+}
+
+// promptf prints a confirmation prompt, or the warning leading up to it.
+// Under --json stdout carries only the result, but a question that waits for
+// an answer must still be seen, so it goes to stderr instead.
+func promptf(format string, a ...any) {
+	w := out
+	if w == io.Discard {
+		w = os.Stderr
+	}
+	fprintf(w, format, a...)
+}
+
+func fprintf(w io.Writer, format string, a ...any) {
+	if asciiSymbols != nil {
+		fmt.Fprint(w, asciiSymbols.Replace(fmt.Sprintf(format, a...)))
+		return
+	}
+	fmt.Fprintf(w, format, a...)
+}
+
+// asciiSymbols stands in for the emoji and arrows in output where they
+// would come out as mojibake; nil leaves output as it is
+var asciiSymbols *strings.Replacer
+
+// symbolFallbacks pairs each symbol used in output with its ASCII form.
+// The emoji variants (with U+FE0F) come before their bare forms.
+var symbolFallbacks = []string{
+	"🚀", "==>",
+	"✔", "[ok]",
+	"⚠️", "[!]",
+	"⚠", "[!]",
+	"❌", "[x]",
+	"✨", "*",
+	"ℹ️", "[i]",
+	"ℹ", "[i]",
+	"→", "->",
+}
+
+// useASCII reports whether output should avoid emoji. GIT_ANTICIPATE_ASCII
+// decides if set (0 keeps the emoji); otherwise Windows consoles other than
+// Windows Terminal and non-UTF-8 locales get ASCII.
+func useASCII() bool {
+	if v := os.Getenv("GIT_ANTICIPATE_ASCII"); v != "" {
+		return v != "0"
+	}
+	if runtime.GOOS == "windows" && os.Getenv("WT_SESSION") == "" {
+		return true
+	}
+	for _, name := range []string{"LC_ALL", "LC_CTYPE", "LANG"} {
+		if v := strings.ToLower(os.Getenv(name)); v != "" {
+			return !strings.Contains(v, "utf-8") && !strings.Contains(v, "utf8")
+		}
+	}
+	return false
+}
+
+// Where the command was run: the directory itself, and its path below the
+// repository root ("" at the root, "src/" in src)
+var invocationDir string
+var invocationPrefix string
+
+// relativeToCwd shows paths relative to invocationDir; --relative=root
+// turns it off
+var relativeToCwd = true
+
 func main() {
 	var rootCmd = &cobra.Command{
 		Use:   "git-anticipate [target-branch]",
@@ -39,9 +122,17 @@ conflicts, and then applies your resolution as a regular commit.
 
 Usage:
   git anticipate <target-branch>    Start anticipating conflicts with target branch
+  git anticipate --into <target>    Preview merging the current branch into target
   git anticipate --continue         Apply resolved conflicts as a commit
   git anticipate --abort            Abort and restore original state
-  git anticipate --status           Show current anticipate status`,
+  git anticipate --status           Show current anticipate status
+  git anticipate --export <path>    Write the unresolved conflicts to a patch file
+  git anticipate --remerge <file>   Recreate the conflict markers in a file
+  git anticipate history            Show finished sessions
+  git anticipate clean              Remove leftover session state
+  git anticipate strip-markers      Resolve conflict hunks in files to one side
+  git anticipate install            Check or set up the 'git anticipate' command
+  git anticipate finalize <target>  Merge target, reusing a preparation commit's resolution`,
 		Args:          cobra.MaximumNArgs(1),
 		RunE:          runAnticipate,
 		SilenceUsage:  true,
@@ -51,14 +142,203 @@ Usage:
 	var continueFlag bool
 	var abortFlag bool
 	var statusFlag bool
+	var shortFlag bool
 	var noVerifyFlag bool
+	var fromIndexFlag bool
+	var metricsFileFlag string
+	var includeUntrackedFlag bool
+	var baseFlag string
+	var deepenFlag int
+	var yesFlag bool
+	var messageFlag string
+	var allowEmptyMessageFlag bool
+	var exitZeroOnConflictFlag bool
+	var keepMergeFlag bool
+	var softFlag bool
+	var gitFlag string
+	var patchFlag bool
+	var exportFlag string
+	var resetModeFlag string
+	var remergeFlag string
+	var allFlag bool
+	var cleanupFlag string
+	var prefixFlag string
+	var jsonFlag bool
+	var noStageFlag bool
+	var gpgSignFlag string
+	var gpgProgramFlag string
+	var sshSignFlag string
+	var fixupFlag string
+	var coAuthorFlag []string
+	var trailerFlag []string
+	var maxAheadFlag int
+	var messageFileFlag string
+	var noAbortOnErrorFlag bool
+	var allowUnrelatedFlag bool
+	var diffAlgorithmFlag string
+	var inputFlag string
+	var noteFlag bool
+	var timingsFlag bool
+	var newBranchFlag string
+	var scratchFlag bool
+	var emptyFlag string
+	var protectFlag []string
+	var dryRunFlag bool
+	var editFlag bool
+	var recommitFlag bool
+	var intoFlag bool
+	var conflictsOnlyFlag bool
+	var defaultFlag bool
+	var perFileFlag bool
+	var keepIndexFlag bool
+	var messagePrefixFlag string
+	var preserveMtimeFlag bool
+	var targetPatternFlag string
+	var recordMergeParentFlag bool
+	var resetAuthorFlag bool
+	var committerFlag string
+	var skipSubmodulesFlag bool
+	var intoStashFlag bool
+	var retryHookFlag bool
+	var checkMergeFlag bool
+	var noResetFlag bool
+	var mergeMsgFlag bool
+	var noOpOKFlag bool
+	var strictFlag bool
+	var formatCmdFlag string
+	var forceFlag bool
+	var discardMovedFlag bool
+	var relativeFlag string
+	var notesRefFlag string
 
 	rootCmd.Flags().BoolVar(&continueFlag, "continue", false, "Continue after resolving conflicts")
 	rootCmd.Flags().BoolVar(&abortFlag, "abort", false, "Abort and restore original state")
+	rootCmd.Flags().BoolVar(&softFlag, "soft", false, "With --abort, keep the resolution as uncommitted working-tree changes")
 	rootCmd.Flags().BoolVar(&statusFlag, "status", false, "Show current anticipate status")
+	rootCmd.Flags().BoolVar(&shortFlag, "short", false, "With --status, print a one-line summary (for shell prompts)")
+	rootCmd.Flags().StringVar(&exportFlag, "export", "", "Write a combined diff of the unresolved conflicts to this file")
+	rootCmd.Flags().StringVar(&remergeFlag, "remerge", "", "Recreate the conflict markers in this file, discarding its resolution")
 	rootCmd.Flags().BoolVar(&noVerifyFlag, "no-verify", false, "Skip pre-commit hooks when committing")
+	rootCmd.Flags().StringVarP(&messageFlag, "message", "m", "", "Use the given commit message instead of the default")
+	rootCmd.Flags().StringVar(&fixupFlag, "fixup", "", "Create a fixup! commit for the given commit, for a later rebase --autosquash")
+	rootCmd.Flags().StringArrayVar(&coAuthorFlag, "co-author", nil, "Add a Co-authored-by trailer (\"Name <email>\"); repeatable")
+	rootCmd.Flags().BoolVar(&recordMergeParentFlag, "record-merge-parent", false, "Name the target commit in an Anticipated-merge-parent trailer")
+	rootCmd.Flags().BoolVar(&resetAuthorFlag, "reset-author", false, "Author the commit as the configured user, ignoring GIT_AUTHOR_* in the environment")
+	rootCmd.Flags().StringVar(&committerFlag, "committer", "", "Commit as this committer (\"Name <email>\"), e.g. for bots; the author is unchanged")
+	rootCmd.Flags().StringArrayVar(&trailerFlag, "trailer", nil, "Add a trailer to the commit message (key=value); repeatable")
+	rootCmd.Flags().BoolVar(&mergeMsgFlag, "merge-msg", false, "Append the conflict summary git wrote to MERGE_MSG to the commit message")
+	rootCmd.Flags().StringVar(&messagePrefixFlag, "message-prefix", "", "Prepend this to the default commit message, e.g. a ticket ID")
+	rootCmd.Flags().BoolVarP(&editFlag, "edit", "e", false, "Edit the commit message, with a summary of the resolution for reference")
+	rootCmd.Flags().StringVarP(&messageFileFlag, "message-file", "F", "", "Read the commit message from this file (- for stdin)")
+	rootCmd.Flags().BoolVar(&allowEmptyMessageFlag, "allow-empty-message", false, "Allow --message to be empty")
+	rootCmd.Flags().StringVar(&cleanupFlag, "cleanup", "", "How to clean up the commit message: strip, whitespace, verbatim, scissors or default")
+	rootCmd.Flags().StringVarP(&gpgSignFlag, "gpg-sign", "S", "", "GPG-sign the commit, optionally with the given key ID")
+	rootCmd.Flags().Lookup("gpg-sign").NoOptDefVal = "default"
+	rootCmd.Flags().StringVar(&gpgProgramFlag, "gpg-program", "", "Use this program instead of gpg.program when signing")
+	rootCmd.Flags().StringVar(&sshSignFlag, "ssh-sign", "", "Sign the commit with this SSH key (a key file, or key::<public key>)")
+	rootCmd.Flags().BoolVar(&retryHookFlag, "retry-hook", false, "If pre-commit hooks fail after modifying the resolved files, stage their changes and commit again once")
+	rootCmd.Flags().BoolVar(&checkMergeFlag, "check-merge", false, "After committing, trial-merge the target again and report the conflicts that remain")
+	rootCmd.Flags().BoolVar(&intoStashFlag, "into-stash", false, "Stash the resolution on the original HEAD instead of committing it")
+	rootCmd.Flags().BoolVar(&skipSubmodulesFlag, "skip-submodules", false, "Leave submodule pointers the merge moved out of the commit, unless staged by hand")
+	rootCmd.Flags().BoolVar(&noteFlag, "note", false, "Attach a git note with the target and resolved files to the commit")
+	rootCmd.Flags().StringVar(&notesRefFlag, "notes-ref", "refs/notes/anticipate", "Notes ref used by --note")
+	rootCmd.Flags().BoolVar(&scratchFlag, "scratch", false, "Commit the resolution on an automatically named scratch branch and return to the current branch unchanged")
+	rootCmd.Flags().StringVar(&newBranchFlag, "new-branch", "", "Commit the resolution on a new branch from the original HEAD, leaving the current branch alone")
+	rootCmd.Flags().StringVar(&emptyFlag, "empty", "drop", "When the resolution changes nothing: drop (no commit) or keep (commit it empty)")
+	rootCmd.Flags().StringArrayVar(&protectFlag, "protect", nil, "Refuse to commit onto this branch (glob allowed); repeatable, adds to anticipate.protectedBranches")
+	rootCmd.Flags().BoolVar(&forceFlag, "force", false, "Commit even onto a protected branch")
+	rootCmd.Flags().BoolVar(&discardMovedFlag, "discard-moved-head", false, "Reset to the original HEAD even though the branch moved during the session, dropping the new commits")
+	rootCmd.Flags().BoolVar(&dryRunFlag, "dry-run", false, "With --continue, show what would be committed without changing anything")
+	rootCmd.Flags().BoolVar(&recommitFlag, "recommit", false, "Commit the resolution left in the working tree by an interrupted --continue")
+	rootCmd.Flags().BoolVar(&noResetFlag, "no-reset", false, "Experimental: commit the trial merge as a real two-parent merge instead of a preparation commit")
+	rootCmd.Flags().BoolVar(&keepMergeFlag, "keep-merge", false, "If the trial merge was already committed, keep that merge commit")
+	rootCmd.Flags().StringVar(&inputFlag, "input", "", "Resolve conflicts from a JSON file mapping paths to ours, theirs or a content file")
+	rootCmd.Flags().BoolVar(&patchFlag, "patch", false, "Choose the hunks to commit interactively (git add -p)")
+	rootCmd.Flags().StringVar(&formatCmdFlag, "format-cmd", "", "Run this command on the resolved files before committing (default: anticipate.formatCmd)")
+	rootCmd.Flags().BoolVar(&preserveMtimeFlag, "preserve-mtime", false, "Keep the modification times of the files written back by --continue, unless their content changed (e.g. by --format-cmd)")
+	rootCmd.Flags().StringVar(&resetModeFlag, "reset-mode", "hard", "Reset mode used before reapplying the resolution: hard, keep or merge")
+	rootCmd.Flags().BoolVar(&noStageFlag, "no-stage", false, "Commit only the files you staged; do not stage anything automatically")
+	rootCmd.Flags().BoolVar(&perFileFlag, "per-file", false, "Commit the resolution of each file separately")
+	rootCmd.Flags().BoolVar(&conflictsOnlyFlag, "conflicts-only", false, "Commit only the conflicted files; auto-merged changes are left to the real merge")
+	rootCmd.Flags().BoolVar(&allFlag, "all", false, "Commit every tracked change, not just files touched by the merge")
+	rootCmd.Flags().BoolVar(&fromIndexFlag, "from-index", false, "Commit the staged (index) content instead of the working tree")
+	rootCmd.Flags().BoolVar(&keepIndexFlag, "keep-index", false, "Like --from-index, but restage the exact staged entries instead of re-adding files")
+	rootCmd.Flags().StringVar(&baseFlag, "base", "", "Use this ref as the merge base instead of computing it")
+	rootCmd.Flags().BoolVar(&defaultFlag, "default", false, "Anticipate conflicts with the default branch (anticipate.defaultTarget or origin/HEAD)")
+	rootCmd.Flags().StringVar(&targetPatternFlag, "target-pattern", "", "Check for conflicts with every local and remote branch matching this glob, e.g. 'release/*'")
+	rootCmd.Flags().BoolVar(&intoFlag, "into", false, "Preview merging the current branch into the target instead, without a session")
+	rootCmd.Flags().StringVar(&prefixFlag, "prefix", "", "Merge the target into this subdirectory (subtree merge)")
+	rootCmd.Flags().IntVar(&maxAheadFlag, "max-ahead", 500, "Ask before merging a target more than this many commits ahead (0 to disable)")
+	rootCmd.Flags().StringVar(&diffAlgorithmFlag, "diff-algorithm", "", "Diff algorithm for the trial merge: myers, minimal, patience or histogram")
+	rootCmd.Flags().BoolVar(&allowUnrelatedFlag, "allow-unrelated-histories", false, "Allow a target that shares no history with the current branch")
+	rootCmd.Flags().BoolVar(&noAbortOnErrorFlag, "no-abort-on-error", false, "If the trial merge fails unexpectedly, keep its state for debugging")
+	rootCmd.Flags().IntVar(&deepenFlag, "deepen", 50, "In shallow clones, fetch this many more commits when the merge base is missing (0 to disable)")
+	rootCmd.Flags().BoolVar(&timingsFlag, "timings", false, "Report how long each phase took")
+	rootCmd.Flags().BoolVar(&jsonFlag, "json", false, "Print the result of starting or continuing a session as JSON")
+	rootCmd.Flags().BoolVar(&strictFlag, "strict", false, "With --continue, fail instead of warning when the target moved since the session started")
+	rootCmd.Flags().BoolVar(&noOpOKFlag, "no-op-ok", false, "With --continue, exit 0 when unresolved conflicts leave nothing to commit")
+	rootCmd.Flags().BoolVar(&exitZeroOnConflictFlag, "exit-zero-on-conflict", false, "Exit with code 0 even when conflicts are found")
+	rootCmd.Flags().BoolVarP(&yesFlag, "yes", "y", false, "Do not ask for confirmation")
+	rootCmd.Flags().BoolVar(&includeUntrackedFlag, "include-untracked", false, "Also commit untracked files created while resolving")
+	rootCmd.Flags().StringVar(&relativeFlag, "relative", "cwd", "Show paths relative to the current directory (cwd) or the repository root (root)")
+	rootCmd.PersistentFlags().StringVar(&gitFlag, "git", "git", "Path to the git executable (or set GIT_ANTICIPATE_GIT)")
+	rootCmd.Flags().StringVar(&metricsFileFlag, "metrics-file", "", "Append a JSON line with session metrics to this file")
+	rootCmd.PersistentPreRun = selectGit
 	rootCmd.Version = version
 
+	rootCmd.AddCommand(&cobra.Command{
+		Use:           "clean",
+		Short:         "Remove leftover session state without touching the working tree",
+		Args:          cobra.NoArgs,
+		RunE:          runClean,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	})
+	rootCmd.AddCommand(&cobra.Command{
+		Use:           "history",
+		Short:         "Show finished anticipate sessions",
+		Args:          cobra.NoArgs,
+		RunE:          runHistory,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	})
+	stripCmd := &cobra.Command{
+		Use:           "strip-markers <file>...",
+		Short:         "Resolve conflict hunks in files by keeping one side",
+		Args:          cobra.MinimumNArgs(1),
+		RunE:          runStripMarkers,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+	stripCmd.Flags().Bool("ours", false, "Keep our side of each conflict")
+	stripCmd.Flags().Bool("theirs", false, "Keep their side of each conflict")
+	stripCmd.Flags().Bool("union", false, "Keep both sides, ours first")
+	rootCmd.AddCommand(stripCmd)
+	installCmd := &cobra.Command{
+		Use:           "install",
+		Short:         "Check that 'git anticipate' works, adding a git alias if needed",
+		Args:          cobra.NoArgs,
+		RunE:          runInstall,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+	installCmd.Flags().Bool("alias", false, "Add the global alias even if git-anticipate is on PATH")
+	rootCmd.AddCommand(installCmd)
+	finalizeCmd := &cobra.Command{
+		Use:           "finalize <target-branch>",
+		Short:         "Merge the target, reusing the resolution of a preparation commit",
+		Args:          cobra.ExactArgs(1),
+		RunE:          runFinalize,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+	finalizeCmd.Flags().String("notes-ref", "refs/notes/anticipate", "Notes ref the preparation commit's --note went to")
+	rootCmd.AddCommand(finalizeCmd)
+
+	if useASCII() {
+		asciiSymbols = strings.NewReplacer(symbolFallbacks...)
+	}
+
 	if err := rootCmd.Execute(); err != nil {
 		if err == errConflicts {
 			os.Exit(ExitConflictsFound)
@@ -72,55 +352,597 @@ func runAnticipate(cmd *cobra.Command, args []string) error {
 	continueFlag, _ := cmd.Flags().GetBool("continue")
 	abortFlag, _ := cmd.Flags().GetBool("abort")
 	statusFlag, _ := cmd.Flags().GetBool("status")
+	metricsFile, _ := cmd.Flags().GetString("metrics-file")
+	exitZeroOnConflict, _ := cmd.Flags().GetBool("exit-zero-on-conflict")
 
-	// Validate we're in a git repo
-	if err := validateRepo(); err != nil {
-		return err
+	switch relative, _ := cmd.Flags().GetString("relative"); relative {
+	case "cwd":
+	case "root":
+		relativeToCwd = false
+	default:
+		return fmt.Errorf("invalid --relative '%s' (expected root or cwd)", relative)
 	}
 
-	// Get git dir path
-	gitDir, err := getGitDir()
+	if timings, _ := cmd.Flags().GetBool("timings"); timings {
+		timer.begin()
+		defer timer.report()
+	}
+
+	stateDir, err := openRepo()
 	if err != nil {
-		return fmt.Errorf("failed to get git directory: %w", err)
+		return err
 	}
-	stateDir := filepath.Join(gitDir, anticipateDir)
+	metricsFile = userPath(metricsFile)
 
 	// Handle flags
 	if statusFlag {
-		return showStatus(stateDir)
+		short, _ := cmd.Flags().GetBool("short")
+		return showStatus(stateDir, short)
+	}
+
+	if exportPath, _ := cmd.Flags().GetString("export"); exportPath != "" {
+		return exportConflicts(stateDir, userPath(exportPath))
+	}
+
+	if remergePath, _ := cmd.Flags().GetString("remerge"); remergePath != "" {
+		return remergeFile(stateDir, repoPath(remergePath))
 	}
 
 	if abortFlag {
-		return abortAnticipate(stateDir)
+		soft, _ := cmd.Flags().GetBool("soft")
+		yes, _ := cmd.Flags().GetBool("yes")
+		return abortAnticipate(stateDir, metricsFile, soft, yes)
 	}
 
 	if continueFlag {
-		noVerify, _ := cmd.Flags().GetBool("no-verify")
-		return continueAnticipate(stateDir, noVerify)
+		opts := continueOptions{}
+		opts.noVerify, _ = cmd.Flags().GetBool("no-verify")
+		opts.fromIndex, _ = cmd.Flags().GetBool("from-index")
+		opts.includeUntracked, _ = cmd.Flags().GetBool("include-untracked")
+		opts.yes, _ = cmd.Flags().GetBool("yes")
+		opts.message, _ = cmd.Flags().GetString("message")
+		opts.messageSet = cmd.Flags().Changed("message")
+		opts.allowEmptyMessage, _ = cmd.Flags().GetBool("allow-empty-message")
+		opts.keepMerge, _ = cmd.Flags().GetBool("keep-merge")
+		opts.noReset, _ = cmd.Flags().GetBool("no-reset")
+		opts.patch, _ = cmd.Flags().GetBool("patch")
+		opts.resetMode, _ = cmd.Flags().GetString("reset-mode")
+		opts.all, _ = cmd.Flags().GetBool("all")
+		opts.cleanup, _ = cmd.Flags().GetString("cleanup")
+		opts.noStage, _ = cmd.Flags().GetBool("no-stage")
+		opts.gpgSign, _ = cmd.Flags().GetString("gpg-sign")
+		opts.gpgProgram, _ = cmd.Flags().GetString("gpg-program")
+		if sshKey, _ := cmd.Flags().GetString("ssh-sign"); sshKey != "" && !strings.HasPrefix(sshKey, "key::") {
+			opts.sshSign = userPath(sshKey)
+		} else {
+			opts.sshSign = sshKey
+		}
+		opts.fixup, _ = cmd.Flags().GetString("fixup")
+		opts.coAuthors, _ = cmd.Flags().GetStringArray("co-author")
+		opts.trailers, _ = cmd.Flags().GetStringArray("trailer")
+		opts.newBranch, _ = cmd.Flags().GetString("new-branch")
+		opts.scratch, _ = cmd.Flags().GetBool("scratch")
+		opts.empty, _ = cmd.Flags().GetString("empty")
+		opts.protect, _ = cmd.Flags().GetStringArray("protect")
+		opts.force, _ = cmd.Flags().GetBool("force")
+		opts.discardMovedHead, _ = cmd.Flags().GetBool("discard-moved-head")
+		opts.dryRun, _ = cmd.Flags().GetBool("dry-run")
+		opts.edit, _ = cmd.Flags().GetBool("edit")
+		opts.recommit, _ = cmd.Flags().GetBool("recommit")
+		opts.conflictsOnly, _ = cmd.Flags().GetBool("conflicts-only")
+		opts.perFile, _ = cmd.Flags().GetBool("per-file")
+		opts.keepIndex, _ = cmd.Flags().GetBool("keep-index")
+		opts.messagePrefix, _ = cmd.Flags().GetString("message-prefix")
+		opts.preserveMtime, _ = cmd.Flags().GetBool("preserve-mtime")
+		opts.recordMergeParent, _ = cmd.Flags().GetBool("record-merge-parent")
+		opts.resetAuthor, _ = cmd.Flags().GetBool("reset-author")
+		opts.committer, _ = cmd.Flags().GetString("committer")
+		opts.skipSubmodules, _ = cmd.Flags().GetBool("skip-submodules")
+		opts.intoStash, _ = cmd.Flags().GetBool("into-stash")
+		opts.retryHook, _ = cmd.Flags().GetBool("retry-hook")
+		opts.checkMerge, _ = cmd.Flags().GetBool("check-merge")
+		opts.mergeMsg, _ = cmd.Flags().GetBool("merge-msg")
+		opts.noOpOK, _ = cmd.Flags().GetBool("no-op-ok")
+		opts.strict, _ = cmd.Flags().GetBool("strict")
+		opts.formatCmd, _ = cmd.Flags().GetString("format-cmd")
+		messageFile, _ := cmd.Flags().GetString("message-file")
+		opts.messageFile = userPath(messageFile)
+		input, _ := cmd.Flags().GetString("input")
+		opts.input = userPath(input)
+		if note, _ := cmd.Flags().GetBool("note"); note {
+			opts.noteRef, _ = cmd.Flags().GetString("notes-ref")
+		}
+		opts.metricsFile = metricsFile
+		opts.json, _ = cmd.Flags().GetBool("json")
+		if opts.json {
+			out = io.Discard
+		}
+		return conflictExit(continueAnticipate(stateDir, opts), exitZeroOnConflict)
+	}
+
+	if pattern, _ := cmd.Flags().GetString("target-pattern"); pattern != "" {
+		if len(args) > 0 {
+			return fmt.Errorf("--target-pattern cannot be combined with a target branch")
+		}
+		opts := startOptions{}
+		opts.json, _ = cmd.Flags().GetBool("json")
+		opts.allowUnrelated, _ = cmd.Flags().GetBool("allow-unrelated-histories")
+		if opts.json {
+			out = io.Discard
+		}
+		return conflictExit(checkTargetPattern(pattern, opts), exitZeroOnConflict)
 	}
 
 	// Start new anticipate
+	useDefault, _ := cmd.Flags().GetBool("default")
 	if len(args) == 0 {
 		// Check if anticipate is in progress
-		if isAnticipateInProgress(stateDir) {
-			return showStatus(stateDir)
+		if isAnticipateInProgress(stateDir) && !useDefault {
+			return showStatus(stateDir, false)
+		}
+		target := defaultTarget()
+		switch {
+		case useDefault && target == "":
+			return fmt.Errorf("no default target found\nSet one with 'git config anticipate.defaultTarget <branch>'")
+		case useDefault:
+		case target == "":
+			return fmt.Errorf("usage: git anticipate <target-branch>\n       git anticipate --continue | --abort | --status")
+		case !isInteractive() || !confirm(fmt.Sprintf("Anticipate conflicts with %s?", target)):
+			return fmt.Errorf("usage: git anticipate <target-branch>\n       git anticipate --continue | --abort | --status\n\nThe default target is %s; run 'git anticipate --default' to use it", target)
+		}
+		args = []string{target}
+	} else if useDefault {
+		return fmt.Errorf("--default cannot be combined with a target branch")
+	}
+
+	startOpts := startOptions{metricsFile: metricsFile}
+	startOpts.base, _ = cmd.Flags().GetString("base")
+	startOpts.deepen, _ = cmd.Flags().GetInt("deepen")
+	if prefix, _ := cmd.Flags().GetString("prefix"); prefix != "" {
+		startOpts.prefix = strings.Trim(filepath.ToSlash(filepath.Clean(prefix)), "/")
+	}
+	startOpts.json, _ = cmd.Flags().GetBool("json")
+	startOpts.maxAhead, _ = cmd.Flags().GetInt("max-ahead")
+	startOpts.yes, _ = cmd.Flags().GetBool("yes")
+	startOpts.noAbortOnError, _ = cmd.Flags().GetBool("no-abort-on-error")
+	startOpts.allowUnrelated, _ = cmd.Flags().GetBool("allow-unrelated-histories")
+	startOpts.diffAlgorithm, _ = cmd.Flags().GetString("diff-algorithm")
+	switch startOpts.diffAlgorithm {
+	case "", "myers", "minimal", "patience", "histogram":
+	default:
+		return fmt.Errorf("invalid --diff-algorithm '%s' (expected myers, minimal, patience or histogram)", startOpts.diffAlgorithm)
+	}
+	if startOpts.json {
+		out = io.Discard
+	}
+	targetBranch, err := expandTarget(args[0])
+	if err != nil {
+		return err
+	}
+	if into, _ := cmd.Flags().GetBool("into"); into {
+		if startOpts.prefix != "" || startOpts.base != "" {
+			return fmt.Errorf("--into cannot be combined with --prefix or --base")
+		}
+		if startOpts.diffAlgorithm != "" {
+			// git merge-tree only takes -X from Git 2.40
+			return fmt.Errorf("--into cannot be combined with --diff-algorithm")
+		}
+		return conflictExit(previewInto(targetBranch, startOpts), exitZeroOnConflict)
+	}
+	return conflictExit(startAnticipate(stateDir, targetBranch, startOpts), exitZeroOnConflict)
+}
+
+// expandTarget expands $VAR and ${VAR} in the target argument, so a quoted
+// '$BASE_BRANCH' works even when no shell is involved
+func expandTarget(target string) (string, error) {
+	if !strings.Contains(target, "$") {
+		return target, nil
+	}
+	expanded := strings.TrimSpace(os.ExpandEnv(target))
+	if expanded == "" {
+		return "", fmt.Errorf("target '%s' expands to an empty branch name\nIs the variable set?", target)
+	}
+	return expanded, nil
+}
+
+// selectGit applies --git / GIT_ANTICIPATE_GIT before any command runs
+func selectGit(cmd *cobra.Command, args []string) {
+	if env := os.Getenv("GIT_ANTICIPATE_GIT"); env != "" {
+		gitProgram = env
+	}
+	if cmd.Flags().Changed("git") {
+		gitProgram, _ = cmd.Flags().GetString("git")
+	}
+	// A relative path would break once openRepo moves to the root
+	if strings.ContainsRune(gitProgram, filepath.Separator) {
+		if abs, err := filepath.Abs(gitProgram); err == nil {
+			gitProgram = abs
+		}
+	}
+}
+
+// openRepo checks that we are inside a git repository, moves to the top of
+// its working tree and returns the session state directory. Paths in git
+// output are then relative to the root; displayPath and repoPath translate
+// between those and the directory the command was run from.
+func openRepo() (string, error) {
+	if err := validateRepo(); err != nil {
+		return "", err
+	}
+	invocationDir, _ = os.Getwd()
+	if output, err := gitCommand("rev-parse", "--show-prefix").Output(); err == nil {
+		invocationPrefix = strings.TrimSpace(string(output))
+	}
+	// Relative GIT_DIR and friends are relative to where we were started;
+	// pin them down so git still finds the repository, and the config that
+	// applies to it (includeIf "gitdir:"), once we have moved
+	for _, name := range []string{"GIT_DIR", "GIT_WORK_TREE", "GIT_COMMON_DIR", "GIT_INDEX_FILE", "GIT_OBJECT_DIRECTORY"} {
+		if value := os.Getenv(name); value != "" && !filepath.IsAbs(value) {
+			if abs, err := filepath.Abs(value); err == nil {
+				os.Setenv(name, abs)
+			}
+		}
+	}
+	if output, err := gitCommand("rev-parse", "--show-toplevel").Output(); err == nil {
+		if err := os.Chdir(strings.TrimSpace(string(output))); err != nil {
+			return "", fmt.Errorf("failed to change to the repository root: %w", err)
+		}
+	}
+	gitDir, err := getGitDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get git directory: %w", err)
+	}
+	return filepath.Join(gitDir, anticipateDir), nil
+}
+
+// displayPath turns a path relative to the repository root into the form
+// shown to the user: relative to the invocation directory, like git, unless
+// --relative=root was given
+func displayPath(file string) string {
+	if !relativeToCwd || invocationPrefix == "" {
+		return file
+	}
+	rel, err := filepath.Rel(invocationPrefix, file)
+	if err != nil {
+		return file
+	}
+	return filepath.ToSlash(rel)
+}
+
+// repoPath is the inverse of displayPath, for paths in the working tree
+// given by the user
+func repoPath(file string) string {
+	if !relativeToCwd || invocationPrefix == "" {
+		return file
+	}
+	return filepath.ToSlash(filepath.Join(invocationPrefix, file))
+}
+
+// userPath resolves a file argument that is not a working-tree path, such
+// as --export or --metrics-file, against the invocation directory
+func userPath(path string) string {
+	if path == "" || path == "-" || filepath.IsAbs(path) || invocationDir == "" {
+		return path
+	}
+	return filepath.Join(invocationDir, path)
+}
+
+// runHistory prints the log of finished sessions
+func runHistory(cmd *cobra.Command, args []string) error {
+	stateDir, err := openRepo()
+	if err != nil {
+		return err
+	}
+	return showHistory(stateDir)
+}
+
+// runClean removes leftover session state
+func runClean(cmd *cobra.Command, args []string) error {
+	stateDir, err := openRepo()
+	if err != nil {
+		return err
+	}
+	return cleanState(stateDir)
+}
+
+// runInstall checks that git can find git-anticipate and, if it cannot or
+// --alias is given, adds alias.anticipate to the global git config. An
+// existing alias is never overwritten.
+func runInstall(cmd *cobra.Command, args []string) error {
+	forceAlias, _ := cmd.Flags().GetBool("alias")
+
+	program := "git-anticipate"
+	onPath := false
+	if found, err := exec.LookPath("git-anticipate"); err == nil {
+		printf("✔ git-anticipate is on PATH (%s), so 'git anticipate' works\n", found)
+		onPath = true
+	} else if exe, err := os.Executable(); err == nil {
+		program = exe
+	}
+	if onPath && !forceAlias {
+		return nil
+	}
+
+	alias := "!" + program
+	output, _ := gitCommand("config", "--global", "--get", "alias.anticipate").Output()
+	current := strings.TrimSpace(string(output))
+	switch {
+	case current == alias:
+		printf("✔ alias.anticipate is already set to '%s'; nothing to do\n", alias)
+		return nil
+	case current != "":
+		printf("⚠️  alias.anticipate is already set to '%s'; leaving it alone\n", current)
+		printf("To replace it, run:\n  git config --global alias.anticipate %s\n", shellQuote(alias))
+		return nil
+	}
+
+	if !onPath {
+		printf("⚠️  git-anticipate is not on PATH, so git cannot find it as 'git anticipate'\n")
+		if !confirm(fmt.Sprintf("Add a global git alias 'anticipate' for %s?", program)) {
+			printf("Add the directory of %s to PATH, or run:\n  git config --global alias.anticipate %s\n", program, shellQuote(alias))
+			return nil
+		}
+	}
+	if output, err := gitCommand("config", "--global", "alias.anticipate", alias).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to set alias.anticipate: %s", strings.TrimSpace(string(output)))
+	}
+	printf("✔ Added alias.anticipate = %s to the global git config\n", alias)
+	return nil
+}
+
+// runFinalize is the finalize subcommand: it refuses to run during a session
+// and merges the target for real
+func runFinalize(cmd *cobra.Command, args []string) error {
+	stateDir, err := openRepo()
+	if err != nil {
+		return err
+	}
+	if isAnticipateInProgress(stateDir) {
+		return fmt.Errorf("anticipate already in progress\nUse 'git anticipate --continue' or 'git anticipate --abort' first")
+	}
+	targetBranch, err := expandTarget(args[0])
+	if err != nil {
+		return err
+	}
+	notesRef, _ := cmd.Flags().GetString("notes-ref")
+	return finalizeMerge(targetBranch, notesRef)
+}
+
+// finalizeMerge does the real merge with the target and resolves the
+// conflicts a preparation commit already settled. A conflicting file takes
+// the preparation commit's content only when neither side has changed it
+// since: the target's copy is still the one it was prepared against, and the
+// branch's copy is still the resolution. Anything else is left to the user.
+// Resolution notes are looked up in notesRef.
+func finalizeMerge(targetBranch, notesRef string) error {
+	if err := validateBranchExists(targetBranch); err != nil {
+		return fmt.Errorf("target branch '%s' does not exist", targetBranch)
+	}
+	if hasUncommittedChanges() {
+		return fmt.Errorf("you have uncommitted changes\nPlease commit or stash them before finalizing")
+	}
+	prep, recorded, err := findPreparation(targetBranch, notesRef)
+	if err != nil {
+		return err
+	}
+
+	printf("🚀 git-anticipate: Finalizing the merge with %s\n", targetBranch)
+	printf("Preparation commit: %s (prepared against %s)\n\n", truncateSHA(prep), truncateSHA(recorded))
+
+	printf("✔ Merging %s...\n", targetBranch)
+	stopSpinner := startSpinner("merging")
+	mergeResult, err := performMerge(targetBranch, "", false, "")
+	stopSpinner()
+	if mergeResult == MergeError {
+		return err
+	}
+
+	if mergeResult == MergeConflict {
+		remaining := []string{}
+		for _, file := range getConflictingFiles() {
+			stored := blobAt(prep, file)
+			if blobAt(targetBranch, file) != blobAt(recorded, file) || blobAt("HEAD", file) != stored {
+				remaining = append(remaining, file)
+				continue
+			}
+			resolveCmd := gitCommand("checkout", prep, "--", literalPath(file))
+			if stored == "" {
+				resolveCmd = gitCommand("rm", "-q", "--", literalPath(file))
+			}
+			if output, err := resolveCmd.CombinedOutput(); err != nil {
+				return fmt.Errorf("failed to apply the stored resolution to %s: %s", file, strings.TrimSpace(string(output)))
+			}
+			printf("✔ %s: applied the stored resolution\n", displayPath(file))
+		}
+		if len(remaining) > 0 {
+			printf("\n⚠️  These files changed since the preparation commit and still conflict:\n")
+			for _, file := range remaining {
+				printf("    ❌ %s\n", displayPath(file))
+			}
+			printf("\nResolve them, then run 'git commit' to finish the merge (or 'git merge --abort')\n")
+			return errConflicts
+		}
+	}
+
+	commitCmd := gitCommand("commit", "--no-edit")
+	commitCmd.Stdout = out
+	commitCmd.Stderr = os.Stderr
+	if err := commitCmd.Run(); err != nil {
+		return fmt.Errorf("failed to commit the merge: %w\nThe merge is staged; finish it with 'git commit' or run 'git merge --abort'", err)
+	}
+	headSHA, _ := getRevisionSHA("HEAD")
+	printf("\n✨ Success! Merged %s\n", targetBranch)
+	printf("Created merge commit %s\n", truncateSHA(headSHA))
+	return nil
+}
+
+// noteTargetPattern finds the target commit in a resolution note (--note)
+var noteTargetPattern = regexp.MustCompile(`(?m)^Target SHA: (\S+)$`)
+
+// findPreparation returns the newest commit on the current branch, not yet
+// in target, that records the target commit it was prepared against, either
+// in an Anticipated-merge-parent trailer or in a resolution note under notesRef
+func findPreparation(target, notesRef string) (string, string, error) {
+	format := "--format=%H%x00%(trailers:key=" + mergeParentTrailer + ",valueonly)%x00%N%x1e"
+	output, err := gitCommand("log", "--notes="+notesRef, format, target+"..HEAD").Output()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read the branch history: %w", err)
+	}
+	for _, record := range strings.Split(string(output), "\x1e") {
+		fields := strings.SplitN(strings.TrimLeft(record, "\n"), "\x00", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		recorded, _, _ := strings.Cut(strings.TrimSpace(fields[1]), "\n")
+		if recorded == "" {
+			if match := noteTargetPattern.FindStringSubmatch(fields[2]); match != nil {
+				recorded = match[1]
+			}
+		}
+		// Only a preparation against this target (or an ancestor of it)
+		if recorded != "" && gitCommand("merge-base", "--is-ancestor", recorded, target).Run() == nil {
+			return fields[0], recorded, nil
+		}
+	}
+	return "", "", fmt.Errorf("no preparation commit for %s found on this branch\nCreate one with 'git anticipate --continue --record-merge-parent' (or --note)", target)
+}
+
+// blobAt returns the blob ID of file in rev, or "" if rev does not have it
+func blobAt(rev, file string) string {
+	output, err := gitCommand("rev-parse", "-q", "--verify", rev+":"+file).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// runStripMarkers resolves every conflict hunk in the named files by
+// keeping the chosen side. It only edits the text; nothing is staged.
+func runStripMarkers(cmd *cobra.Command, args []string) error {
+	side := ""
+	for _, name := range []string{"ours", "theirs", "union"} {
+		if set, _ := cmd.Flags().GetBool(name); set {
+			if side != "" {
+				return fmt.Errorf("--%s and --%s cannot be combined", side, name)
+			}
+			side = name
+		}
+	}
+	if side == "" {
+		return fmt.Errorf("choose the side to keep with --ours, --theirs or --union")
+	}
+
+	for _, file := range args {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		stripped, hunks, err := stripMarkers(string(content), side)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		if hunks == 0 {
+			printf("ℹ️  No conflict markers in %s\n", file)
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", file, err)
 		}
-		return fmt.Errorf("usage: git anticipate <target-branch>\n       git anticipate --continue | --abort | --status")
+		if err := os.WriteFile(file, []byte(stripped), info.Mode().Perm()); err != nil {
+			return fmt.Errorf("failed to write %s: %w", file, err)
+		}
+		noun := "conflicts"
+		if hunks == 1 {
+			noun = "conflict"
+		}
+		printf("✔ Resolved %d %s in %s (%s)\n", hunks, noun, file, side)
+	}
+	return nil
+}
+
+// stripMarkers rewrites each conflict hunk in content to the given side:
+// ours, theirs, or union (ours followed by theirs). The diff3 base section
+// is always dropped. Line endings are kept as they are.
+func stripMarkers(content, side string) (string, int, error) {
+	const (
+		outside = iota
+		inOurs
+		inBase
+		inTheirs
+	)
+	var result strings.Builder
+	state, hunks := outside, 0
+	for _, line := range strings.SplitAfter(content, "\n") {
+		switch {
+		case state == outside && strings.HasPrefix(line, "<<<<<<<"):
+			state = inOurs
+			hunks++
+		case state == inOurs && strings.HasPrefix(line, "|||||||"):
+			state = inBase
+		case (state == inOurs || state == inBase) && strings.HasPrefix(line, "======="):
+			state = inTheirs
+		case state == inTheirs && strings.HasPrefix(line, ">>>>>>>"):
+			state = outside
+		case state == outside,
+			state == inOurs && side != "theirs",
+			state == inTheirs && side != "ours":
+			result.WriteString(line)
+		}
+	}
+	if state != outside {
+		return "", 0, fmt.Errorf("unterminated conflict hunk")
 	}
+	return result.String(), hunks, nil
+}
+
+// conflictExit turns the conflicts signal into success when the caller asked
+// for --exit-zero-on-conflict (for CI that treats any non-zero exit as failure)
+func conflictExit(err error, exitZero bool) error {
+	if err == errConflicts && exitZero {
+		return nil
+	}
+	return err
+}
 
-	return startAnticipate(stateDir, args[0])
+// startOptions controls how a new anticipate session is started
+type startOptions struct {
+	base           string // Merge base override; computed with merge-base when empty
+	prefix         string // Merge the target into this subdirectory (subtree strategy)
+	json           bool   // Print the outcome as JSON instead of the usual output
+	maxAhead       int    // Warn when the target is more commits ahead than this (0 disables)
+	yes            bool   // Skip confirmation prompts
+	deepen         int    // Commits to fetch in a shallow clone when the merge base is missing
+	metricsFile    string // Append session metrics here when the merge is clean
+	noAbortOnError bool   // Keep the state and working tree when the merge fails unexpectedly
+	allowUnrelated bool   // Merge a target with no common history; no merge base
+	diffAlgorithm  string // Passed to the merge as -X diff-algorithm; git's default when empty
 }
 
 // startAnticipate begins a new anticipate session
-func startAnticipate(stateDir, targetBranch string) error {
-	fmt.Printf("🚀 git-anticipate: Preemptive conflict resolution\n")
-	fmt.Printf("Target branch: %s\n\n", targetBranch)
+func startAnticipate(stateDir, targetBranch string, opts startOptions) error {
+	// Shorthands like @{upstream} or @{-1} are stored and shown as the
+	// branch they name
+	if strings.Contains(targetBranch, "@{") {
+		name, err := resolveRefName(targetBranch)
+		if err != nil {
+			return fmt.Errorf("cannot resolve '%s': %w", targetBranch, err)
+		}
+		targetBranch = name
+	}
+
+	printf("🚀 git-anticipate: Preemptive conflict resolution\n")
+	printf("Target branch: %s\n\n", targetBranch)
 
 	// Check if anticipate already in progress
 	if isAnticipateInProgress(stateDir) {
 		return fmt.Errorf("anticipate already in progress\nUse 'git anticipate --continue' or 'git anticipate --abort'")
 	}
 
+	if err := checkHasCommits(); err != nil {
+		return err
+	}
+
 	// Check for uncommitted changes
 	if hasUncommittedChanges() {
 		return fmt.Errorf("you have uncommitted changes\nPlease commit or stash them before running git anticipate")
@@ -131,10 +953,13 @@ func startAnticipate(stateDir, targetBranch string) error {
 	if err != nil {
 		return fmt.Errorf("failed to get current branch: %w", err)
 	}
-	fmt.Printf("Current branch: %s\n", currentBranch)
+	printf("Current branch: %s\n", currentBranch)
 
 	// Validate target branch exists
 	if err := validateBranchExists(targetBranch); err != nil {
+		if suggestion := suggestBranch(targetBranch); suggestion != "" {
+			return fmt.Errorf("target branch '%s' does not exist\nDid you mean '%s'?", targetBranch, suggestion)
+		}
 		return fmt.Errorf("target branch '%s' does not exist", targetBranch)
 	}
 
@@ -150,390 +975,3601 @@ func startAnticipate(stateDir, targetBranch string) error {
 		return fmt.Errorf("failed to get target branch SHA: %w", err)
 	}
 
-	// Get merge base
-	baseSHA, err := getMergeBase(targetBranch, currentBranch)
-	if err != nil {
-		return fmt.Errorf("failed to get merge base: %w", err)
+	// A target the branch already contains has nothing left to merge;
+	// git would only say "Already up to date"
+	if gitCommand("merge-base", "--is-ancestor", targetSHA, origHead).Run() == nil {
+		printf("✨ %s is already merged into %s - nothing to anticipate.\n", targetBranch, currentBranch)
+		if opts.json {
+			emitJSON(startResult{Target: targetBranch, CurrentBranch: currentBranch, Outcome: "clean", Conflicts: []string{}, Timings: timer.phases})
+		}
+		return nil
+	}
+
+	// A target far ahead usually means the wrong branch, and the trial merge
+	// would be huge; check before touching the working tree
+	if opts.maxAhead > 0 {
+		if ahead := countCommits(origHead + ".." + targetSHA); ahead > opts.maxAhead {
+			promptf("⚠️  %s is %d commits ahead of %s (limit %d, see --max-ahead)\n", targetBranch, ahead, currentBranch, opts.maxAhead)
+			if !opts.yes && !confirm("Run the trial merge anyway?") {
+				return fmt.Errorf("cancelled; nothing was changed")
+			}
+		}
+	}
+
+	// Get merge base (or validate the one given with --base)
+	var baseSHA string
+	if opts.allowUnrelated {
+		// No common ancestor to look for; the base stays empty
+		printf("Merge base: none (unrelated histories)\n\n")
+	} else if opts.base != "" {
+		baseSHA, err = getRevisionSHA(opts.base + "^{commit}")
+		if err != nil {
+			return fmt.Errorf("base '%s' is not a valid commit", opts.base)
+		}
+		printf("Merge base: %s (from --base %s)\n\n", truncateSHA(baseSHA), opts.base)
+	} else {
+		baseSHA, err = resolveMergeBase(targetBranch, currentBranch, opts.deepen)
+		if err != nil {
+			return err
+		}
+		printf("Merge base: %s\n\n", truncateSHA(baseSHA))
 	}
-	fmt.Printf("Merge base: %s\n\n", truncateSHA(baseSHA))
 
 	// Save state
-	if err := saveState(stateDir, targetBranch, origHead, targetSHA, currentBranch); err != nil {
+	if err := saveState(stateDir, targetBranch, origHead, targetSHA, currentBranch, baseSHA); err != nil {
 		return fmt.Errorf("failed to save state: %w", err)
 	}
+	if opts.base != "" {
+		writeStateFile(stateDir, "base_ref", opts.base)
+	}
+	if opts.prefix != "" {
+		writeStateFile(stateDir, "prefix", opts.prefix)
+	}
+	if opts.allowUnrelated {
+		writeStateFile(stateDir, "unrelated", "true")
+	}
+	if opts.diffAlgorithm != "" {
+		writeStateFile(stateDir, "diff_algorithm", opts.diffAlgorithm)
+	}
 
 	// Attempt merge
-	fmt.Printf("✔ Attempting merge with %s...\n", targetBranch)
-	mergeResult, mergeErr := performMerge(targetBranch)
+	if opts.prefix != "" {
+		printf("✔ Attempting merge with %s into %s/...\n", targetBranch, opts.prefix)
+	} else {
+		printf("✔ Attempting merge with %s...\n", targetBranch)
+	}
+	timer.mark("setup")
+	stopSpinner := startSpinner("merging")
+	mergeResult, mergeErr := performMerge(targetBranch, opts.prefix, opts.allowUnrelated, opts.diffAlgorithm)
+	stopSpinner()
+	timer.mark("merge")
 
 	switch mergeResult {
 	case MergeConflict:
 		conflictFiles := getConflictingFiles()
-		fmt.Printf("\n⚠️  Conflicts detected!\n\n")
+		writeStateList(stateDir, "conflicts", conflictFiles)
+		// Remember what the merge did to the other files, to tell them
+		// apart from edits made while resolving
+		if autoMerged, err := getAutoMergedFiles(); err == nil {
+			lines := []string{}
+			for file, sha := range autoMerged {
+				if sha == "" {
+					sha = "-"
+				}
+				lines = append(lines, sha+"\t"+file)
+			}
+			sort.Strings(lines)
+			writeStateFile(stateDir, "automerged", strings.Join(lines, "\n"))
+		}
+		printf("\n⚠️  Conflicts detected!\n\n")
 
+		effort := measureEffort(conflictFiles)
+		timer.mark("conflict detection")
 		if len(conflictFiles) > 0 {
-			fmt.Printf("Conflicting files (%d):\n", len(conflictFiles))
+			printf("Conflicting files (%d):\n", len(conflictFiles))
 			for _, file := range conflictFiles {
-				fmt.Printf("    ❌ %s\n", file)
+				printf("    ❌ %s\n", displayPath(file))
+			}
+			printf("\n")
+			printf("Effort: %s (%d files, %d hunks, %d conflicting lines)\n\n", effort.Rating, effort.Files, effort.Hunks, effort.Lines)
+			for _, file := range conflictFiles {
+				if file == ".gitmodules" {
+					// The text merges like any other, but the submodules it
+					// describes have their own pointers to reconcile
+					printf("ℹ️  .gitmodules conflicts: submodule paths or URLs changed on both sides.\n")
+					printf("   Check that each submodule's pointer (git ls-files -s <path>) still matches\n")
+					printf("   its entry, and run 'git submodule sync' after the merge.\n\n")
+					break
+				}
 			}
-			fmt.Printf("\n")
 		}
 
-		fmt.Printf("Resolve conflicts in your working directory, then:\n")
-		fmt.Printf("  git add <resolved-files>\n")
-		fmt.Printf("  git anticipate --continue\n\n")
-		fmt.Printf("Or to abort:\n")
-		fmt.Printf("  git anticipate --abort\n")
+		printNextSteps(conflictFiles)
 
+		if opts.json {
+			emitJSON(startResult{Target: targetBranch, CurrentBranch: currentBranch, Outcome: "conflicts", Conflicts: conflictFiles, Effort: &effort, Timings: timer.phases})
+		}
 		return errConflicts
 
 	case MergeError:
-		// Clean up state on error
+		// Clean up state on error, unless the user wants to see what git did
+		if opts.noAbortOnError {
+			printf("⚠️  Leaving the working tree and session state as they are (--no-abort-on-error)\n")
+			printf("Inspect them, then run 'git anticipate --abort'\n")
+			return mergeErr
+		}
 		removeState(stateDir)
 		return mergeErr
 
 	case MergeClean:
 		// No conflicts - abort the trial merge and exit cleanly
 		abortMerge()
+		recordMetrics(opts.metricsFile, stateDir, "clean", 0)
 		removeState(stateDir)
-		fmt.Printf("✨ No conflicts detected! Your branch is ready to merge with %s.\n", targetBranch)
+		printf("✨ No conflicts detected! Your branch is ready to merge with %s.\n", targetBranch)
+		if opts.json {
+			emitJSON(startResult{Target: targetBranch, CurrentBranch: currentBranch, Outcome: "clean", Conflicts: []string{}, Timings: timer.phases})
+		}
 		return nil
 	}
 
 	return nil
 }
 
-// continueAnticipate applies the resolution and creates a commit
-func continueAnticipate(stateDir string, noVerify bool) error {
-	if !isAnticipateInProgress(stateDir) {
-		return fmt.Errorf("no anticipate in progress")
+// previewInto reports the conflicts of merging the current branch into the
+// target, as whoever merges it there would see them. The merge is done with
+// merge-tree, so nothing is checked out and no session is started.
+func previewInto(targetBranch string, opts startOptions) error {
+	if strings.Contains(targetBranch, "@{") {
+		name, err := resolveRefName(targetBranch)
+		if err != nil {
+			return fmt.Errorf("cannot resolve '%s': %w", targetBranch, err)
+		}
+		targetBranch = name
 	}
 
-	// Check for unresolved conflicts
-	if hasUnmergedFiles() {
-		conflictFiles := getConflictingFiles()
-		fmt.Printf("⚠️  Unresolved conflicts remain:\n")
-		for _, file := range conflictFiles {
-			fmt.Printf("    ❌ %s\n", file)
-		}
-		fmt.Printf("\nResolve conflicts and run 'git add', then 'git anticipate --continue'\n")
-		return errConflicts
+	printf("🚀 git-anticipate: Previewing the merge into %s\n", targetBranch)
+	printf("Target branch: %s\n\n", targetBranch)
+
+	if err := checkHasCommits(); err != nil {
+		return err
+	}
+	currentBranch, err := getCurrentBranch()
+	if err != nil {
+		return fmt.Errorf("failed to get current branch: %w", err)
+	}
+	printf("Current branch: %s\n", currentBranch)
+
+	if err := validateBranchExists(targetBranch); err != nil {
+		if suggestion := suggestBranch(targetBranch); suggestion != "" {
+			return fmt.Errorf("target branch '%s' does not exist\nDid you mean '%s'?", targetBranch, suggestion)
+		}
+		return fmt.Errorf("target branch '%s' does not exist", targetBranch)
+	}
+	targetSHA, err := getRevisionSHA(targetBranch + "^{commit}")
+	if err != nil {
+		return fmt.Errorf("failed to get target branch SHA: %w", err)
+	}
+	origHead, err := getRevisionSHA("HEAD")
+	if err != nil {
+		return fmt.Errorf("failed to get current HEAD: %w", err)
+	}
+
+	// The target is "ours" here and the current branch "theirs", the
+	// reverse of a normal session
+	printf("✔ Attempting merge of %s into %s (nothing is checked out)...\n", currentBranch, targetBranch)
+	timer.mark("setup")
+	conflictFiles, clean, err := mergeTreeConflicts(targetSHA, origHead, opts.allowUnrelated)
+	timer.mark("merge")
+	if err != nil {
+		return fmt.Errorf("merge failed: %v\n--into needs Git 2.38 or later (git merge-tree --write-tree)", err)
+	}
+
+	if clean {
+		printf("✨ No conflicts detected! %s merges cleanly into %s.\n", currentBranch, targetBranch)
+		if opts.json {
+			emitJSON(startResult{Target: targetBranch, CurrentBranch: currentBranch, Outcome: "clean", Conflicts: []string{}, Timings: timer.phases})
+		}
+		return nil
+	}
+
+	printf("\n⚠️  Conflicts detected!\n\n")
+	printf("Conflicting files when merging into %s (%d):\n", targetBranch, len(conflictFiles))
+	for _, file := range conflictFiles {
+		printf("    ❌ %s\n", displayPath(file))
+	}
+	printf("\nNothing was changed. Run 'git anticipate %s' to resolve them on %s.\n", shellQuote(targetBranch), currentBranch)
+	if opts.json {
+		emitJSON(startResult{Target: targetBranch, CurrentBranch: currentBranch, Outcome: "conflicts", Conflicts: conflictFiles, Timings: timer.phases})
+	}
+	return errConflicts
+}
+
+// mergeTreeConflicts merges theirs into ours with merge-tree, which touches
+// neither the index nor the working tree, and returns the conflicted paths
+func mergeTreeConflicts(ours, theirs string, allowUnrelated bool) ([]string, bool, error) {
+	args := []string{"merge-tree", "--write-tree", "--name-only", "--no-messages"}
+	if allowUnrelated {
+		args = append(args, "--allow-unrelated-histories")
+	}
+	args = append(args, ours, theirs)
+	output, err := gitCommand(args...).Output()
+
+	// Exit code 1 means conflicts; anything else is a failure
+	var exitErr *exec.ExitError
+	if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 1) {
+		return nil, false, err
+	}
+
+	// The first line is the merged tree; conflicted paths follow
+	conflictFiles := []string{}
+	seen := make(map[string]bool)
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	for _, file := range lines[1:] {
+		if file != "" && !seen[file] {
+			seen[file] = true
+			conflictFiles = append(conflictFiles, file)
+		}
+	}
+	return conflictFiles, err == nil, nil
+}
+
+// checkTargetPattern reports which local and remote branches matching
+// pattern the current branch conflicts with. Like --into it only runs
+// merge-tree, so nothing is checked out and no session is started.
+func checkTargetPattern(pattern string, opts startOptions) error {
+	if err := checkHasCommits(); err != nil {
+		return err
+	}
+	currentBranch, err := getCurrentBranch()
+	if err != nil {
+		return fmt.Errorf("failed to get current branch: %w", err)
+	}
+	origHead, err := getRevisionSHA("HEAD")
+	if err != nil {
+		return fmt.Errorf("failed to get current HEAD: %w", err)
+	}
+
+	output, err := gitCommand("for-each-ref", "--format=%(refname:short)", "refs/heads/"+pattern, "refs/remotes/*/"+pattern).Output()
+	if err != nil {
+		return fmt.Errorf("failed to list branches: %w", err)
+	}
+	targets := []string{}
+	for _, ref := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if ref != "" && ref != currentBranch {
+			targets = append(targets, ref)
+		}
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("no local or remote branches match '%s'", pattern)
+	}
+
+	printf("🚀 git-anticipate: Checking %s against %d branches matching %s\n\n", currentBranch, len(targets), pattern)
+	results := []startResult{}
+	conflicting := 0
+	for _, target := range targets {
+		conflictFiles, clean, err := mergeTreeConflicts(origHead, target, opts.allowUnrelated)
+		if err != nil {
+			return fmt.Errorf("merge with %s failed: %v\n--target-pattern needs Git 2.38 or later (git merge-tree --write-tree)", target, err)
+		}
+		result := startResult{Target: target, CurrentBranch: currentBranch, Outcome: "clean", Conflicts: conflictFiles}
+		if clean {
+			printf("    ✔ %s: clean\n", target)
+		} else {
+			conflicting++
+			result.Outcome = "conflicts"
+			noun := "conflicts"
+			if len(conflictFiles) == 1 {
+				noun = "conflict"
+			}
+			printf("    ❌ %s: %d %s\n", target, len(conflictFiles), noun)
+			for _, file := range conflictFiles {
+				printf("        %s\n", displayPath(file))
+			}
+		}
+		results = append(results, result)
+	}
+
+	printf("\n%d of %d branches conflict with %s.\n", conflicting, len(targets), currentBranch)
+	if conflicting > 0 {
+		printf("Run 'git anticipate <branch>' to resolve the conflicts with one of them.\n")
+	}
+	if opts.json {
+		emitJSON(results)
+	}
+	if conflicting > 0 {
+		return errConflicts
+	}
+	return nil
+}
+
+// continueOptions controls how --continue captures and commits the resolution
+type continueOptions struct {
+	noVerify          bool     // Skip pre-commit hooks
+	fromIndex         bool     // Read resolved content from the index instead of the working tree
+	keepIndex         bool     // Like fromIndex, and restage the recorded index entries as they were
+	includeUntracked  bool     // Also commit untracked files created while resolving
+	yes               bool     // Skip confirmation prompts
+	message           string   // Commit message override (when messageSet)
+	messageSet        bool     // --message was given, even if empty
+	messagePrefix     string   // Prepended, with a space, to the default message
+	mergeMsg          bool     // Append the trial merge's MERGE_MSG, uncommented, to the message
+	noOpOK            bool     // Unresolved conflicts are not a failure; nothing is committed and the exit code is 0
+	strict            bool     // Fail instead of warning when the target moved since the start
+	formatCmd         string   // Shell command run with the resolved files as arguments before staging
+	allowEmptyMessage bool     // Accept an empty --message
+	keepMerge         bool     // Keep a trial merge the user already committed
+	noReset           bool     // Commit the trial merge itself instead of a preparation commit
+	patch             bool     // Pick hunks with git add -p before committing
+	resetMode         string   // Mode for the reset to the original HEAD: hard, keep or merge
+	preserveMtime     bool     // Give the files written back their modification times from before the reset
+	all               bool     // Stage every tracked change, not just files touched by the merge
+	cleanup           string   // git commit --cleanup mode; git's default when empty
+	noStage           bool     // Commit only what the user staged; no automatic git add
+	gpgSign           string   // Sign the commit: "default" for the configured key, or a key ID
+	gpgProgram        string   // Override gpg.program for the commit
+	sshSign           string   // Sign with this SSH key (gpg.format=ssh); implies signing
+	json              bool     // Print the new commit as JSON instead of the usual output
+	fixup             string   // Commit as a fixup! of this commit instead of with a message
+	coAuthors         []string // Added as Co-authored-by trailers
+	trailers          []string // Extra trailers, as key=value
+	recordMergeParent bool     // Add a trailer naming the target commit as a logical second parent
+	resetAuthor       bool     // Author the commit as the configured user, not GIT_AUTHOR_*
+	committer         string   // Commit as this "Name <email>" instead of the configured user
+	skipSubmodules    bool     // Leave merge-moved submodule pointers out unless staged by hand
+	intoStash         bool     // Stash the resolution instead of committing it
+	retryHook         bool     // Restage files changed by failing hooks and commit again once
+	checkMerge        bool     // After committing, merge-tree the target again and report what still conflicts
+	newBranch         string   // Commit on this new branch instead of the current one
+	scratch           bool     // Like newBranch with a generated name, then switch back to the original branch
+	empty             string   // A resolution with no changes: drop (no commit) or keep (empty commit)
+	protect           []string // Protected branch patterns, on top of anticipate.protectedBranches
+	force             bool     // Commit onto a protected branch
+	discardMovedHead  bool     // Reset to the original HEAD even though the branch moved since the start
+	dryRun            bool     // Print the plan and leave the session as it is
+	edit              bool     // Open the editor on the message, with a summary below a scissors line
+	recommit          bool     // Commit what an interrupted --continue left in the working tree
+	conflictsOnly     bool     // Commit only the conflicted files, not what the merge auto-resolved
+	perFile           bool     // One commit per resolved file instead of a single commit
+	messageFile       string   // Read the commit message from this file ("-" for stdin)
+	input             string   // JSON file mapping conflicting paths to ours, theirs or a content file
+	noteRef           string   // Attach a note describing the resolution under this ref; none when empty
+	metricsFile       string   // Append session metrics here when done
+}
+
+// mergeParentTrailer names the target commit a preparation commit was made
+// for, as a logical second parent (--record-merge-parent)
+const mergeParentTrailer = "Anticipated-merge-parent"
+
+// coAuthorPattern matches the "Name <email>" form of a Co-authored-by trailer,
+// also used for --committer
+var coAuthorPattern = regexp.MustCompile(`^[^<>]*[^<>\s] <[^<>\s@]+@[^<>\s]+>$`)
+
+// trailerPattern matches a --trailer key=value; keys are limited to what
+// git recognises as a trailer token
+var trailerPattern = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9-]*)=(.*\S.*)$`)
+
+// continueAnticipate applies the resolution and creates a commit
+func continueAnticipate(stateDir string, opts continueOptions) error {
+	if !isAnticipateInProgress(stateDir) {
+		return fmt.Errorf("no anticipate in progress")
+	}
+
+	// Only one --continue at a time; a second one started while the first
+	// is committing would otherwise make a duplicate commit
+	unlock, err := lockContinue(stateDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// A run that committed but died before cleaning up leaves the commit
+	// recorded; finish its cleanup instead of committing again
+	if committed, err := readStateFile(stateDir, "committed"); err == nil && committed != "" {
+		if head, _ := getRevisionSHA("HEAD"); head == committed {
+			printf("✨ The resolution was already committed as %s\n", truncateSHA(committed))
+			removeState(stateDir)
+			return nil
+		}
+	}
+
+	// An empty -m usually comes from an unset variable; catch it before
+	// touching anything rather than letting git fail after the reset
+	if opts.messageSet && strings.TrimSpace(opts.message) == "" && !opts.allowEmptyMessage {
+		return fmt.Errorf("empty commit message given with --message\nPass a message or use --allow-empty-message")
+	}
+
+	// Read the message file up front so a missing file or empty message is
+	// reported before anything is reset
+	var messageFromFile []byte
+	if opts.messageFile != "" {
+		if opts.messageSet || opts.fixup != "" {
+			return fmt.Errorf("--message-file cannot be combined with --message or --fixup")
+		}
+		var err error
+		if opts.messageFile == "-" {
+			messageFromFile, err = io.ReadAll(os.Stdin)
+		} else {
+			messageFromFile, err = os.ReadFile(opts.messageFile)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read message file: %w", err)
+		}
+		if strings.TrimSpace(string(messageFromFile)) == "" && !opts.allowEmptyMessage {
+			return fmt.Errorf("empty commit message in %s\nWrite a message or use --allow-empty-message", opts.messageFile)
+		}
+	}
+
+	if opts.committer != "" && !coAuthorPattern.MatchString(opts.committer) {
+		return fmt.Errorf("invalid --committer '%s' (expected \"Name <email>\")", opts.committer)
+	}
+
+	for _, coAuthor := range opts.coAuthors {
+		if !coAuthorPattern.MatchString(coAuthor) {
+			return fmt.Errorf("invalid --co-author '%s' (expected \"Name <email>\")", coAuthor)
+		}
+	}
+	for _, trailer := range opts.trailers {
+		if !trailerPattern.MatchString(trailer) {
+			return fmt.Errorf("invalid --trailer '%s' (expected key=value)", trailer)
+		}
+	}
+
+	if opts.messagePrefix != "" && (opts.messageSet || opts.messageFile != "" || opts.fixup != "") {
+		return fmt.Errorf("--message-prefix only applies to the default message; it cannot be combined with --message, --message-file or --fixup")
+	}
+
+	if opts.mergeMsg && (opts.messageFile != "" || opts.fixup != "") {
+		return fmt.Errorf("--merge-msg cannot be combined with --message-file or --fixup")
+	}
+
+	if opts.fixup != "" {
+		if opts.messageSet {
+			return fmt.Errorf("--fixup cannot be combined with --message")
+		}
+		if _, err := getRevisionSHA(opts.fixup + "^{commit}"); err != nil {
+			return fmt.Errorf("fixup target '%s' is not a valid commit", opts.fixup)
+		}
+	}
+
+	// Check the SSH key now; git would only fail after the reset
+	if opts.sshSign != "" {
+		if err := checkSSHSigningKey(opts.sshSign); err != nil {
+			return err
+		}
+	} else if opts.gpgSign != "" && getConfig("gpg.format") == "ssh" {
+		key := opts.gpgSign
+		if key == "default" {
+			key = getConfig("user.signingkey")
+		}
+		if key != "" {
+			if err := checkSSHSigningKey(key); err != nil {
+				return err
+			}
+		}
+	}
+
+	if opts.edit {
+		if opts.fixup != "" {
+			return fmt.Errorf("--edit cannot be combined with --fixup")
+		}
+		if opts.cleanup != "" && opts.cleanup != "scissors" {
+			return fmt.Errorf("--edit needs --cleanup=scissors to cut off the summary")
+		}
+	}
+
+	// The staged entries are put back as they are, so nothing is re-added
+	// through filters or picked by hunk
+	if opts.keepIndex {
+		if opts.patch || opts.all {
+			return fmt.Errorf("--keep-index cannot be combined with --patch or --all")
+		}
+		opts.fromIndex = true
+	}
+
+	if opts.perFile && (opts.fixup != "" || opts.edit || opts.messageFile != "" || opts.patch) {
+		return fmt.Errorf("--per-file cannot be combined with --fixup, --edit, --message-file or --patch")
+	}
+
+	if opts.noReset && (opts.perFile || opts.fixup != "" || opts.edit || opts.patch || opts.newBranch != "" || opts.intoStash || opts.keepIndex || opts.conflictsOnly || opts.recommit || opts.dryRun) {
+		return fmt.Errorf("--no-reset commits the merge as it is; it cannot be combined with --per-file, --fixup, --edit, --patch, --new-branch, --into-stash, --keep-index, --conflicts-only, --recommit or --dry-run")
+	}
+
+	if opts.intoStash && (opts.perFile || opts.fixup != "" || opts.edit || opts.patch || opts.newBranch != "" || opts.json) {
+		return fmt.Errorf("--into-stash cannot be combined with --per-file, --fixup, --edit, --patch, --new-branch or --json")
+	}
+
+	if opts.checkMerge && (opts.intoStash || opts.noReset || opts.dryRun) {
+		return fmt.Errorf("--check-merge checks the new commit; it cannot be combined with --into-stash, --no-reset or --dry-run")
+	}
+
+	switch opts.cleanup {
+	case "", "strip", "whitespace", "verbatim", "scissors", "default":
+	default:
+		return fmt.Errorf("invalid --cleanup mode '%s' (expected strip, whitespace, verbatim, scissors or default)", opts.cleanup)
+	}
+
+	if opts.scratch && (opts.newBranch != "" || opts.intoStash || opts.noReset) {
+		return fmt.Errorf("--scratch names its own branch; it cannot be combined with --new-branch, --into-stash or --no-reset")
+	}
+
+	if opts.newBranch != "" {
+		if err := gitCommand("check-ref-format", "--branch", opts.newBranch).Run(); err != nil {
+			return fmt.Errorf("'%s' is not a valid branch name", opts.newBranch)
+		}
+		if _, err := getRevisionSHA("refs/heads/" + opts.newBranch); err == nil {
+			return fmt.Errorf("branch '%s' already exists", opts.newBranch)
+		}
+	}
+
+	switch opts.empty {
+	case "drop", "keep":
+	default:
+		return fmt.Errorf("invalid --empty '%s' (expected drop or keep)", opts.empty)
+	}
+
+	switch opts.resetMode {
+	case "hard", "keep", "merge":
+	default:
+		return fmt.Errorf("invalid --reset-mode '%s' (expected hard, keep or merge)", opts.resetMode)
+	}
+
+	if opts.dryRun && opts.input != "" {
+		return fmt.Errorf("--dry-run cannot be combined with --input")
+	}
+
+	if opts.input != "" {
+		if err := applyResolutionInput(opts.input); err != nil {
+			return err
+		}
+	}
+
+	// A dry run stages into a copy of the index, so everything below sees
+	// the same files a real run would while the real index stays untouched
+	if opts.dryRun {
+		restore, err := useScratchIndex()
+		if err != nil {
+			return err
+		}
+		defer restore()
+	}
+
+	// A conflicting file removed from the working tree without 'git rm'
+	// is resolved as a deletion, including the modify/delete case where
+	// git left the modified side behind
+	if !opts.fromIndex {
+		for _, file := range getConflictingFiles() {
+			if _, err := os.Lstat(file); os.IsNotExist(err) {
+				if err := gitCommand("rm", "-q", "--cached", "--", literalPath(file)).Run(); err != nil {
+					return fmt.Errorf("failed to stage the deletion of %s: %w", file, err)
+				}
+				printf("✔ %s was deleted, resolving it as a deletion\n", displayPath(file))
+			}
+		}
+	}
+
+	// Check for unresolved conflicts
+	if hasUnmergedFiles() {
+		conflictFiles := getConflictingFiles()
+		printf("⚠️  Unresolved conflicts remain:\n")
+		for _, file := range conflictFiles {
+			printf("    ❌ %s\n", displayPath(file))
+		}
+		printf("\n")
+		printNextSteps(conflictFiles)
+		if opts.noOpOK {
+			printf("Nothing was committed (--no-op-ok)\n")
+			emitNoCommit(opts, "unresolved conflicts remain")
+			return nil
+		}
+		return errConflicts
+	}
+
+	// Read state
+	state, err := loadState(stateDir)
+	if err != nil {
+		return err
+	}
+	targetBranch, targetSHA, currentBranch, origHead := state.target, state.targetSHA, state.currentBranch, state.origHead
+	prefix := state.prefix
+	if opts.scratch {
+		opts.newBranch = scratchBranchName(currentBranch)
+	}
+
+	// Preparation commits belong on feature branches; one on main is
+	// almost always a mistake. --new-branch commits elsewhere.
+	if opts.newBranch == "" && !opts.force && isProtectedBranch(currentBranch, opts.protect) {
+		return fmt.Errorf("refusing to commit the resolution onto protected branch '%s'\nUse --new-branch <name> to commit it on a new branch, or --force to commit anyway", currentBranch)
+	}
+
+	// The resolution was made against the target as it was at the start
+	if current, err := getRevisionSHA(targetBranch + "^{commit}"); err == nil && current != targetSHA {
+		msg := fmt.Sprintf("%s moved since the session started (was %s, now %s); the resolution may be stale", targetBranch, truncateSHA(targetSHA), truncateSHA(current))
+		if opts.strict {
+			return fmt.Errorf("%s\nRun 'git anticipate --abort' and start again against the new %s, or drop --strict", msg, targetBranch)
+		}
+		printf("⚠️  %s\n\n", msg)
+	}
+
+	if opts.dryRun {
+		printf("🚀 git-anticipate: Planning resolution (dry run)\n\n")
+	} else {
+		printf("🚀 git-anticipate: Applying resolution\n\n")
+	}
+
+	if opts.noReset {
+		return commitTrialMerge(stateDir, state, opts, messageFromFile)
+	}
+
+	// The user may have finished the trial merge with 'git commit' before
+	// running --continue. HEAD is then a real merge of origHead and the target.
+	if !isMergeInProgress() && isMergeOf("HEAD", origHead, targetSHA) {
+		if opts.dryRun {
+			return fmt.Errorf("the trial merge was already committed; --dry-run cannot plan from a merge commit")
+		}
+		printf("⚠️  The trial merge was already committed as a real merge commit.\n")
+		if opts.keepMerge {
+			printf("✔ Keeping the merge commit and cleaning up\n")
+			recordMetrics(opts.metricsFile, stateDir, "resolved", 0)
+			headSHA, _ := getRevisionSHA("HEAD")
+			recordHistory(stateDir, "resolved", headSHA)
+			removeState(stateDir)
+			if opts.json {
+				emitJSON(continueResult{Committed: &headSHA, Reason: "the trial merge was already committed"})
+			}
+			return nil
+		}
+		printf("✔ Converting it into a preparation commit (use --keep-merge to keep the merge instead)...\n")
+		softResetCmd := gitCommand("reset", "--soft", origHead)
+		if err := softResetCmd.Run(); err != nil {
+			return fmt.Errorf("failed to undo the merge commit: %w", err)
+		}
+	}
+
+	// Switching to an orphan branch mid-session leaves HEAD unborn. There
+	// is nothing to reset to: the index already holds origHead's files plus
+	// the resolution, and becomes the branch's first commit.
+	unborn, isUnborn := unbornBranch()
+	if isUnborn {
+		printf("⚠️  %s has no commits yet; the resolution becomes its first commit\n", unborn)
+		currentBranch = unborn
+	}
+
+	// The reset below goes back to origHead; anything committed on the
+	// branch since the session started would silently disappear
+	if head, err := getRevisionSHA("HEAD"); err == nil && head != origHead && !opts.discardMovedHead {
+		msg := fmt.Sprintf("HEAD moved since the session started (was %s, now %s)", truncateSHA(origHead), truncateSHA(head))
+		if lost, _ := gitCommand("log", "--format=%h %s", origHead+".."+head).Output(); len(lost) > 0 {
+			msg += "\nResetting to the original HEAD would discard:"
+			for _, line := range strings.Split(strings.TrimSpace(string(lost)), "\n") {
+				msg += "\n    " + line
+			}
+		}
+		return fmt.Errorf("%s\nRun 'git anticipate --abort', or --continue --discard-moved-head to reset anyway", msg)
+	}
+
+	// A --continue killed after the reset but before the resolution was
+	// staged leaves it in the working tree with no merge to take it from.
+	// --recommit stages the recorded files and commits them from the index;
+	// the reset is then a no-op that leaves other working-tree edits alone.
+	reapplied, reapplyErr := readStateList(stateDir, "reapplying")
+	interrupted := reapplyErr == nil && !isMergeInProgress()
+	if opts.recommit && !interrupted {
+		return fmt.Errorf("no interrupted --continue to recover; run 'git anticipate --continue' without --recommit")
+	}
+	if interrupted {
+		if !opts.recommit {
+			return fmt.Errorf("a previous --continue was interrupted after resetting to %s\nThe resolution is in the working tree; run 'git anticipate --continue --recommit' to commit it, or --abort to drop it", truncateSHA(origHead))
+		}
+		// Nothing was reapplied for an empty resolution (--empty=keep)
+		files := reapplied
+		printf("✔ Recovering the interrupted resolution (%d files)...\n", len(files))
+		var present, missing []string
+		for _, file := range files {
+			if _, err := os.Lstat(file); os.IsNotExist(err) {
+				missing = append(missing, file)
+			} else {
+				present = append(present, file)
+			}
+		}
+		if len(present) > 0 {
+			if err := pathspecCommand(present, "add", "-f").Run(); err != nil {
+				return fmt.Errorf("failed to stage the recovered files: %w", err)
+			}
+		}
+		if len(missing) > 0 {
+			if err := pathspecCommand(missing, "rm", "-q", "--cached", "--ignore-unmatch").Run(); err != nil {
+				return fmt.Errorf("failed to stage the recovered deletions: %w", err)
+			}
+		}
+		opts.fromIndex = true
+		opts.resetMode = "keep"
+	}
+
+	// Stage changes to the files the merge touched (in case the user only
+	// did git add for some of them). Edits to other files are unrelated to
+	// the resolution; they are kept out of the commit and put back afterwards.
+	// --all stages everything instead. With --from-index the index is taken
+	// as-is, so later edits to the working tree are not swept in.
+	unrelatedFiles := []string{}
+	if !opts.fromIndex && !opts.noStage {
+		if opts.all {
+			stageCmd := gitCommand("add", "-u")
+			stageCmd.Run()
+		} else {
+			baseSHA := state.base
+			if state.unrelated {
+				// Everything in the target is new to this branch
+				baseSHA = emptyTreeSHA()
+			} else if baseSHA == "" {
+				// Session started by a version that did not record the base
+				baseSHA, _ = getMergeBase(origHead, targetSHA)
+			}
+			affected, err := getMergeAffectedFiles(baseSHA, targetSHA, prefix)
+			if err != nil {
+				return fmt.Errorf("failed to list files touched by the merge: %w", err)
+			}
+			toStage := []string{}
+			index := getIndexEntries()
+			for _, file := range getUnstagedFiles() {
+				if index[file].mode == "160000" {
+					// git add -u would record whatever the submodule has
+					// checked out, undoing the pointer the merge staged
+					continue
+				}
+				if affected[file] {
+					toStage = append(toStage, file)
+				} else {
+					unrelatedFiles = append(unrelatedFiles, file)
+				}
+			}
+			if len(toStage) > 0 {
+				pathspecCommand(toStage, "add", "-u").Run()
+			}
+		}
+	}
+
+	// Get list of files that have changes (staged)
+	changedFiles, deletedFiles, err := getStagedChanges()
+	if err != nil {
+		return fmt.Errorf("failed to get changed files: %w", err)
+	}
+
+	// With --no-stage only what the user staged is committed; everything
+	// else is left as it is in the working tree
+	if opts.noStage {
+		if len(changedFiles) == 0 {
+			return fmt.Errorf("nothing is staged\nStage the files to commit with 'git add', or drop --no-stage")
+		}
+		staged := make(map[string]bool)
+		for _, file := range changedFiles {
+			staged[file] = true
+		}
+		index := getIndexEntries()
+		for _, file := range getUnstagedFiles() {
+			if !staged[file] && index[file].mode != "160000" {
+				unrelatedFiles = append(unrelatedFiles, file)
+			}
+		}
+	}
+
+	// Pick up files created during resolution that were never git add-ed
+	untrackedFiles := make(map[string]bool)
+	if opts.includeUntracked {
+		for _, file := range getUntrackedFiles() {
+			changedFiles = append(changedFiles, file)
+			untrackedFiles[file] = true
+		}
+	}
+
+	// Files the merge changed without a conflict should still hold what it
+	// produced; an edit there would otherwise slip into the commit unnoticed
+	conflicted := make(map[string]bool)
+	conflicts, _ := readStateList(stateDir, "conflicts")
+	for _, file := range conflicts {
+		conflicted[file] = true
+	}
+	autoMerged, autoMergedErr := loadAutoMerged(stateDir)
+	index := getIndexEntries()
+	edited := []string{}
+	for _, file := range changedFiles {
+		expected, ok := autoMerged[file]
+		if !ok || conflicted[file] {
+			continue
+		}
+		if deletedFiles[file] {
+			if expected != "" {
+				edited = append(edited, file)
+			}
+		} else if index[file].sha != expected {
+			edited = append(edited, file)
+		}
+	}
+	if len(edited) > 0 && opts.conflictsOnly {
+		msg := "these auto-merged files were edited while resolving, and --conflicts-only would drop the edits:"
+		for _, file := range edited {
+			msg += "\n    " + displayPath(file)
+		}
+		return fmt.Errorf("%s\nUndo the edits, or drop --conflicts-only to commit them with the resolution", msg)
+	}
+	if len(edited) > 0 {
+		printf("⚠️  These auto-merged files differ from what the merge produced:\n")
+		for _, file := range edited {
+			printf("    %s\n", displayPath(file))
+		}
+		printf("They are committed as they are now\n\n")
+	}
+
+	// --conflicts-only leaves what the merge resolved by itself to the real
+	// merge. Other changes that are not part of the merge at all are kept
+	// out of the commit like any unrelated edit.
+	if opts.conflictsOnly {
+		if autoMergedErr != nil {
+			return fmt.Errorf("--conflicts-only needs a session started by this version; the auto-merged files were not recorded")
+		}
+		kept := []string{}
+		dropped := 0
+		for _, file := range changedFiles {
+			if conflicted[file] {
+				kept = append(kept, file)
+				continue
+			}
+			delete(deletedFiles, file)
+			if _, ok := autoMerged[file]; ok {
+				dropped++
+			} else if !untrackedFiles[file] {
+				unrelatedFiles = append(unrelatedFiles, file)
+			}
+		}
+		changedFiles = kept
+		if dropped > 0 {
+			printf("✔ Leaving %d auto-merged files to the real merge (--conflicts-only)\n", dropped)
+		}
+	}
+
+	// Submodule pointers are committed as staged. The merge moves them
+	// without the submodule's checkout following, so they are easy to
+	// commit unnoticed; --skip-submodules leaves out those the merge staged
+	gitlinks := make(map[string]bool)
+	kept := []string{}
+	for _, file := range changedFiles {
+		if deletedFiles[file] || untrackedFiles[file] {
+			kept = append(kept, file)
+			continue
+		}
+		entry := index[file]
+		if entry.mode != "160000" {
+			kept = append(kept, file)
+			continue
+		}
+		if opts.skipSubmodules && autoMerged[file] == entry.sha {
+			printf("✔ Leaving submodule %s out of the commit (--skip-submodules)\n", displayPath(file))
+			continue
+		}
+		if !opts.skipSubmodules {
+			printf("⚠️  Submodule %s moves to %s in this commit; use --skip-submodules to leave it out\n", displayPath(file), truncateSHA(entry.sha))
+		}
+		gitlinks[file] = true
+		kept = append(kept, file)
+	}
+	changedFiles = kept
+
+	if opts.dryRun {
+		printContinuePlan(state, opts, changedFiles, deletedFiles, unrelatedFiles, messageFromFile)
+		emitNoCommit(opts, "dry run")
+		return nil
+	}
+
+	// Check if there's anything to commit
+	if len(changedFiles) == 0 && opts.empty == "drop" {
+		printf("✨ No changes to commit - branches are compatible!\n")
+		abortMerge()
+		recordMetrics(opts.metricsFile, stateDir, "resolved", 0)
+		recordHistory(stateDir, "resolved", "")
+		removeState(stateDir)
+		emitNoCommit(opts, "nothing to commit")
+		return nil
+	}
+
+	printf("✔ Extracting resolution (%d files)...\n", len(changedFiles))
+
+	// Save the content of all changed files BEFORE aborting merge
+	// (skip deleted files - we'll handle them separately)
+	// Contents go into the object store as blobs rather than into memory,
+	// so large files are streamed through git instead of held in RAM. They
+	// are hashed without filters and written back byte for byte, so a BOM,
+	// CRLF line endings or a missing final newline survive the round trip;
+	// git add then runs them through their clean filters as usual.
+	// Files outside a sparse-checkout cone are not on disk, and Git LFS
+	// files only hold a pointer in the index that must not be run through
+	// the filters again; for both the resolved index entries are carried
+	// over as-is instead, as are submodule pointers. --keep-index does the
+	// same for every file.
+	fileBlobs := make(map[string]string)
+	toHash := []string{}
+	indexEntries := make(map[string]indexEntry)
+	symlinks := make(map[string]string) // Path to link target
+	fileModes := make(map[string]os.FileMode)
+	filePerms := make(map[string]os.FileMode) // Permissions of resolved files already on disk
+	skipWorktree := getSkipWorktreeFiles()
+	lfsFiles := getLFSFiles(changedFiles)
+	for _, file := range changedFiles {
+		if deletedFiles[file] {
+			continue // Skip deleted files
+		}
+		if (skipWorktree[file] || lfsFiles[file] || gitlinks[file] || opts.keepIndex) && !untrackedFiles[file] {
+			entry, ok := index[file]
+			if !ok {
+				return fmt.Errorf("failed to read resolved file %s: it is not in the index", file)
+			}
+			if lfsFiles[file] {
+				printf("ℹ️  %s is tracked by Git LFS, keeping its staged pointer\n", displayPath(file))
+			}
+			indexEntries[file] = entry
+			continue
+		}
+		// The executable bit follows the resolved index entry, so a new
+		// executable from the target stays executable (untracked files
+		// keep their working-tree mode). A new file gets what the umask
+		// allows, like a git checkout; a file already on disk keeps its
+		// other permission bits.
+		var entry indexEntry
+		if !untrackedFiles[file] {
+			entry = index[file]
+		}
+		info, statErr := os.Lstat(file)
+		executable := entry.mode == "100755" || untrackedFiles[file] && statErr == nil && info.Mode()&0111 != 0
+		fileModes[file] = 0666
+		if executable {
+			fileModes[file] = 0777
+		}
+		if statErr == nil && info.Mode().IsRegular() {
+			filePerms[file] = withExecBit(info.Mode().Perm(), executable)
+		}
+
+		// Symlinks are captured as their target, not the file they point to
+		if opts.fromIndex && !untrackedFiles[file] {
+			if entry.sha == "" {
+				return fmt.Errorf("failed to read resolved file %s: not in the index", file)
+			}
+			if entry.mode == "120000" {
+				target, err := readIndexFile(file)
+				if err != nil {
+					return fmt.Errorf("failed to read resolved file %s: %w", file, err)
+				}
+				symlinks[file] = string(target)
+			} else {
+				fileBlobs[file] = entry.sha
+			}
+		} else if info, err := os.Lstat(file); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(file)
+			if err != nil {
+				return fmt.Errorf("failed to read resolved file %s: %w", file, err)
+			}
+			symlinks[file] = target
+		} else {
+			toHash = append(toHash, file)
+		}
+	}
+	hashed, err := hashFiles(toHash)
+	if err != nil {
+		return fmt.Errorf("failed to save resolved files: %w", err)
+	}
+	for i, file := range toHash {
+		fileBlobs[file] = hashed[i]
+	}
+
+	// Save unrelated edits so they survive the reset
+	unrelatedBlobs := make(map[string]string) // "" when deleted
+	unrelatedPerms := make(map[string]os.FileMode)
+	toHash = []string{}
+	for _, file := range unrelatedFiles {
+		info, err := os.Lstat(file)
+		if os.IsNotExist(err) {
+			unrelatedBlobs[file] = ""
+			continue
+		}
+		if err == nil && info.Mode().IsRegular() {
+			unrelatedPerms[file] = info.Mode().Perm()
+		}
+		toHash = append(toHash, file)
+	}
+	hashed, err = hashFiles(toHash)
+	if err != nil {
+		return fmt.Errorf("failed to save unrelated changes: %w", err)
+	}
+	for i, file := range toHash {
+		unrelatedBlobs[file] = hashed[i]
+	}
+
+	// Aborting the merge below deletes MERGE_MSG
+	mergeMsg := ""
+	if opts.mergeMsg {
+		mergeMsg = readMergeMsg(filepath.Join(filepath.Dir(stateDir), "MERGE_MSG"))
+		if mergeMsg == "" {
+			printf("⚠️  No conflict summary in MERGE_MSG to add to the message\n")
+		}
+	}
+
+	// Timestamp-sensitive builds would otherwise see every rewritten file
+	// as changed
+	mtimes := make(map[string]time.Time)
+	if opts.preserveMtime {
+		for _, file := range append(append([]string{}, changedFiles...), unrelatedFiles...) {
+			if info, err := os.Lstat(file); err == nil && info.Mode().IsRegular() {
+				mtimes[file] = info.ModTime()
+			}
+		}
+	}
+
+	timer.mark("capture")
+
+	// Other unstaged working-tree edits are not part of the resolution and a
+	// hard reset below throws them away, so make sure that is intended
+	unstaged := []string{}
+	for _, file := range getUnstagedFiles() {
+		if _, ok := unrelatedBlobs[file]; !ok {
+			unstaged = append(unstaged, file)
+		}
+	}
+	if len(unstaged) > 0 && opts.resetMode == "hard" && !opts.yes {
+		promptf("⚠️  These working-tree changes are not staged and will be discarded:\n")
+		for _, file := range unstaged {
+			promptf("    %s\n", displayPath(file))
+		}
+		if !confirm("Proceed?") {
+			return fmt.Errorf("continue cancelled; nothing was changed")
+		}
+	}
+
+	// Record what is being reapplied, so an interrupted run can be
+	// recovered with --recommit
+	if err := writeStateList(stateDir, "reapplying", changedFiles); err != nil {
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+
+	// Abort the merge and reset to original HEAD to ensure clean state.
+	// keep and merge leave unrelated local changes alone and refuse where
+	// hard would clobber them.
+	if !isUnborn {
+		abortMerge()
+		resetCmd := gitCommand("reset", "--"+opts.resetMode, origHead)
+		stopSpinner := startSpinner("resetting")
+		output, err := resetCmd.CombinedOutput()
+		stopSpinner()
+		if err != nil {
+			if opts.resetMode == "hard" {
+				return fmt.Errorf("failed to reset to original state: %w", err)
+			}
+			return fmt.Errorf("git reset --%s refused to reset to the original HEAD:\n%s\nCommit or stash your local changes, or use --reset-mode hard", opts.resetMode, strings.TrimSpace(string(output)))
+		}
+	}
+
+	// Handle deleted files first - a deleted file may stand where the
+	// resolution needs a directory, or empty a directory it replaces
+	for file := range deletedFiles {
+		os.Remove(file) // Ignore errors - file might not exist
+		removeEmptyParents(file)
+	}
+
+	// Write back the resolved file contents. Files that already hold them
+	// (untracked files, or anything --reset-mode keep left alone) are not
+	// rewritten, so their mtimes don't change.
+	printf("✔ Applying resolution to %s...\n", currentBranch)
+	blobs, err := newBlobReader()
+	if err != nil {
+		return fmt.Errorf("failed to read the resolution back: %w", err)
+	}
+	defer blobs.Close()
+	onDisk := filesHoldingBlobs(fileBlobs, fileModes)
+	for file, sha := range fileBlobs {
+		if onDisk[file] {
+			continue
+		}
+		if err := preparePath(file); err != nil {
+			return fmt.Errorf("failed to write resolved file %s: %w", file, err)
+		}
+		if err := blobs.writeBlob(file, sha, fileModes[file]); err != nil {
+			return fmt.Errorf("failed to write resolved file %s: %w", file, err)
+		}
+		if perm, ok := filePerms[file]; ok {
+			if err := os.Chmod(file, perm); err != nil {
+				return fmt.Errorf("failed to write resolved file %s: %w", file, err)
+			}
+		}
+	}
+	for file, target := range symlinks {
+		if err := preparePath(file); err != nil {
+			return fmt.Errorf("failed to write resolved file %s: %w", file, err)
+		}
+		if err := os.Symlink(target, file); err != nil {
+			return fmt.Errorf("failed to write resolved file %s: %w", file, err)
+		}
+	}
+
+	// Put unrelated edits back, unstaged
+	if len(unrelatedBlobs) > 0 {
+		printf("✔ Keeping unrelated changes out of the commit (%d files)...\n", len(unrelatedBlobs))
+	}
+	onDisk = filesHoldingBlobs(unrelatedBlobs, nil)
+	for file, sha := range unrelatedBlobs {
+		if sha == "" {
+			os.Remove(file)
+			continue
+		}
+		if !onDisk[file] {
+			if err := blobs.writeBlob(file, sha, 0666); err != nil {
+				return fmt.Errorf("failed to restore %s: %w", file, err)
+			}
+		}
+		// The reset may have changed the mode along with the content
+		if perm, ok := unrelatedPerms[file]; ok {
+			if err := os.Chmod(file, perm); err != nil {
+				return fmt.Errorf("failed to restore %s: %w", file, err)
+			}
+		}
+	}
+
+	// Format the resolved files before they are staged. A failure leaves
+	// them in the working tree, where --recommit picks them up.
+	formatCmd := opts.formatCmd
+	if formatCmd == "" {
+		formatCmd = getConfig("anticipate.formatCmd")
+	}
+	if formatCmd != "" && len(fileBlobs) > 0 {
+		toFormat := make([]string, 0, len(fileBlobs))
+		for file := range fileBlobs {
+			toFormat = append(toFormat, file)
+		}
+		sort.Strings(toFormat)
+		printf("✔ Formatting %d files with %s...\n", len(toFormat), formatCmd)
+		// Run like a git alias: the files are appended as arguments
+		shellCmd := exec.Command("sh", append([]string{"-c", formatCmd + ` "$@"`, formatCmd}, toFormat...)...)
+		shellCmd.Stdout = out
+		shellCmd.Stderr = os.Stderr
+		if err := shellCmd.Run(); err != nil {
+			return fmt.Errorf("format command '%s' failed: %w\nThe resolution is in the working tree; fix it and run 'git anticipate --continue --recommit'", formatCmd, err)
+		}
+	}
+
+	// With --patch the files are only marked intent-to-add here and the
+	// user picks the hunks afterwards
+	patch := opts.patch && isInteractive()
+	if opts.patch && !patch {
+		printf("⚠️  --patch needs a terminal, staging all changes\n")
+	}
+	var patchFiles []string
+
+	// Stage all the changed files. Plain adds and removals are batched into
+	// one git process each, however many files the resolution has.
+	var toRemove, toAdd, toForceAdd []string
+	toCheck := []string{}
+	for _, file := range changedFiles {
+		if _, ok := indexEntries[file]; !ok && !deletedFiles[file] {
+			toCheck = append(toCheck, file)
+		}
+	}
+	ignored := getIgnoredFiles(toCheck)
+	for _, file := range changedFiles {
+		if deletedFiles[file] {
+			toRemove = append(toRemove, file)
+		} else if entry, ok := indexEntries[file]; ok {
+			if err := restoreIndexEntry(file, entry); err != nil {
+				return fmt.Errorf("failed to stage file %s: %w", file, err)
+			}
+			// Keep sparse files out of the cone; check LFS files out
+			// through the smudge filter. A submodule's checkout is left
+			// alone, as git merge leaves it. update-index takes plain paths,
+			// not pathspecs, so only checkout needs the literal form.
+			if skipWorktree[file] {
+				err = gitCommand("update-index", "--skip-worktree", "--", file).Run()
+			} else if !gitlinks[file] {
+				err = gitCommand("checkout", "--", literalPath(file)).Run()
+			}
+			if err != nil {
+				return fmt.Errorf("failed to restore file %s: %w", file, err)
+			}
+		} else {
+			if patch {
+				patchFiles = append(patchFiles, file)
+			}
+			if ignored[file] {
+				// Brought in by the merge but matched by .gitignore; a plain
+				// git add would refuse it and drop it from the resolution
+				printf("⚠️  %s is ignored by .gitignore, adding it anyway\n", displayPath(file))
+				toForceAdd = append(toForceAdd, file)
+			} else {
+				toAdd = append(toAdd, file)
+			}
+		}
+	}
+	if len(toRemove) > 0 {
+		if err := pathspecCommand(toRemove, "rm", "-q", "--cached", "--ignore-unmatch").Run(); err != nil {
+			return fmt.Errorf("failed to stage the deleted files: %w", err)
+		}
+	}
+	addArgs := []string{"add"}
+	if patch {
+		// Intent to add only; git add -p below picks the hunks
+		addArgs = append(addArgs, "-N")
+	}
+	if len(toAdd) > 0 {
+		if output, err := pathspecCommand(toAdd, addArgs...).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to stage the resolved files: %s", strings.TrimSpace(string(output)))
+		}
+	}
+	if len(toForceAdd) > 0 {
+		if output, err := pathspecCommand(toForceAdd, append(addArgs, "-f")...).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to stage the resolved files: %s", strings.TrimSpace(string(output)))
+		}
+	}
+
+	// A file whose content changed after it was captured, say by
+	// --format-cmd, keeps its new mtime so the change is not hidden
+	captured := make(map[string]string)
+	for file := range mtimes {
+		if sha, ok := fileBlobs[file]; ok {
+			captured[file] = sha
+		} else if sha, ok := unrelatedBlobs[file]; ok {
+			captured[file] = sha
+		}
+	}
+	unchanged := filesHoldingBlobs(captured, nil)
+	for file, mtime := range mtimes {
+		if _, ok := captured[file]; ok && !unchanged[file] {
+			continue
+		}
+		if err := os.Chtimes(file, mtime, mtime); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Warning: failed to restore the modification time of %s: %v\n", displayPath(file), err)
+		}
+	}
+
+	if len(patchFiles) > 0 {
+		patchCmd := gitCommand(append([]string{"add", "-p", "--"}, patchFiles...)...)
+		patchCmd.Stdin = os.Stdin
+		patchCmd.Stdout = os.Stdout
+		patchCmd.Stderr = os.Stderr
+		if err := patchCmd.Run(); err != nil {
+			return fmt.Errorf("git add -p failed: %w", err)
+		}
+		if !hasStagedChanges() {
+			return fmt.Errorf("no changes selected; the resolution is left in the working tree\nStage the hunks you want and commit them yourself")
+		}
+	}
+
+	// The resolution is staged again; a rerun takes it from the index
+	os.Remove(filepath.Join(stateDir, "reapplying"))
+
+	// A file resolved to exactly what the original HEAD had stages as a
+	// no-op; leave it out, and if that leaves nothing there is no commit
+	if !patch {
+		stillChanged, _, err := getStagedChanges()
+		if err != nil {
+			return fmt.Errorf("failed to get changed files: %w", err)
+		}
+		staged := make(map[string]bool)
+		for _, file := range stillChanged {
+			staged[file] = true
+		}
+		kept := changedFiles[:0]
+		for _, file := range changedFiles {
+			if staged[file] {
+				kept = append(kept, file)
+			}
+		}
+		changedFiles = kept
+		if len(changedFiles) == 0 && opts.empty == "drop" {
+			printf("✨ No changes to commit - the resolution matches %s already!\n", currentBranch)
+			recordMetrics(opts.metricsFile, stateDir, "resolved", 0)
+			recordHistory(stateDir, "resolved", "")
+			removeState(stateDir)
+			emitNoCommit(opts, "nothing to commit")
+			return nil
+		}
+	}
+
+	// The working tree and index are at the original HEAD plus the
+	// resolution, so the new branch starts there and takes them along
+	if opts.newBranch != "" {
+		printf("✔ Creating branch %s...\n", opts.newBranch)
+		if output, err := gitCommand("checkout", "-q", "-b", opts.newBranch).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to create branch %s: %s", opts.newBranch, strings.TrimSpace(string(output)))
+		}
+		currentBranch = opts.newBranch
+	}
+
+	timer.mark("reapply")
+
+	// Create commit
+	commitMsg := defaultCommitMessage(state)
+	if opts.messagePrefix != "" {
+		commitMsg = opts.messagePrefix + " " + commitMsg
+	}
+	if opts.messageSet {
+		commitMsg = opts.message
+	}
+	if mergeMsg != "" {
+		commitMsg = strings.TrimRight(commitMsg, "\n") + "\n\n" + mergeMsg
+	}
+
+	// --into-stash leaves the branch at the original HEAD and keeps the
+	// resolution in a stash, named after the commit it would have made.
+	// Only the resolved paths are stashed; unrelated edits stay put.
+	if opts.intoStash {
+		if len(changedFiles) == 0 {
+			return fmt.Errorf("the resolution has no changes to stash")
+		}
+		printf("✔ Stashing resolution...\n")
+		message := commitMsg
+		if messageFromFile != nil {
+			message = strings.TrimSpace(string(messageFromFile))
+		}
+		subject, _, _ := strings.Cut(message, "\n")
+		if output, err := pathspecCommand(changedFiles, "stash", "push", "-q", "-m", subject).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to stash the resolution: %s\nIt is left staged; stash or commit it yourself and run 'git anticipate clean'", strings.TrimSpace(string(output)))
+		}
+		stashSHA, _ := getRevisionSHA("refs/stash")
+		recordMetrics(opts.metricsFile, stateDir, "resolved", len(changedFiles))
+		recordHistory(stateDir, "stashed", stashSHA)
+		removeState(stateDir)
+		printf("\n✨ Success! Resolution stashed as stash@{0} (%s)\n", truncateSHA(stashSHA))
+		printf("Apply it to %s with 'git stash pop' when you are ready\n", currentBranch)
+		return nil
+	}
+
+	perFile := opts.perFile && len(changedFiles) > 0
+	if perFile {
+		printf("✔ Creating %d commits, one per file...\n", len(changedFiles))
+	} else {
+		printf("✔ Creating commit...\n")
+	}
+
+	commitArgs := []string{"commit", "-m", commitMsg}
+	if opts.fixup != "" {
+		// git writes the "fixup! <subject>" message itself
+		commitArgs = []string{"commit", "--fixup=" + opts.fixup}
+	} else if messageFromFile != nil {
+		commitArgs = []string{"commit", "-F", "-"}
+	}
+	if opts.edit {
+		// The editor needs the terminal, so the seed goes in a file rather
+		// than on stdin
+		seed := commitMsg
+		if messageFromFile != nil {
+			seed = string(messageFromFile)
+		}
+		conflicts, _ := readStateList(stateDir, "conflicts")
+		seedFile, err := os.CreateTemp("", "anticipate-msg-")
+		if err != nil {
+			return fmt.Errorf("failed to prepare the commit message: %w", err)
+		}
+		defer os.Remove(seedFile.Name())
+		_, err = seedFile.WriteString(editTemplate(seed, state, conflicts, changedFiles))
+		if closeErr := seedFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to prepare the commit message: %w", err)
+		}
+		commitArgs = []string{"commit", "-e", "-F", seedFile.Name(), "--cleanup=scissors"}
+		messageFromFile = nil
+	}
+	if len(changedFiles) == 0 {
+		// Only reached with --empty=keep
+		printf("ℹ️  The resolution changes nothing, committing it empty (--empty=keep)\n")
+		commitArgs = append(commitArgs, "--allow-empty")
+	}
+	commitArgs = withCommitOptions(commitArgs, opts, targetSHA)
+	if perFile {
+		err = commitPerFile(commitArgs, commitMsg, changedFiles, deletedFiles, skipWorktree)
+	} else {
+		// Hooks such as formatters fix the files and fail, expecting the
+		// commit to be retried with their changes staged
+		unstagedBefore := make(map[string]bool)
+		if opts.retryHook {
+			for _, file := range getUnstagedFiles() {
+				unstagedBefore[file] = true
+			}
+		}
+		for attempt := 1; ; attempt++ {
+			commitCmd := gitCommand(commitArgs...)
+			if messageFromFile != nil {
+				commitCmd.Stdin = bytes.NewReader(messageFromFile)
+			}
+			commitCmd.Stdout = out
+			if opts.edit {
+				commitCmd.Stdin = os.Stdin
+				commitCmd.Stdout = os.Stdout
+			}
+			commitCmd.Stderr = os.Stderr
+			err = commitCmd.Run()
+			if err == nil || !opts.retryHook || attempt > 1 {
+				break
+			}
+			inCommit := make(map[string]bool)
+			for _, file := range changedFiles {
+				inCommit[file] = true
+			}
+			modified := []string{}
+			for _, file := range getUnstagedFiles() {
+				if inCommit[file] && !unstagedBefore[file] {
+					modified = append(modified, file)
+				}
+			}
+			if len(modified) == 0 {
+				break
+			}
+			printf("✔ Hooks modified %d files; staging their changes and committing again...\n", len(modified))
+			if err := pathspecCommand(modified, "add").Run(); err != nil {
+				return fmt.Errorf("failed to stage the files modified by hooks: %w", err)
+			}
+		}
+	}
+	timer.mark("commit")
+	if err != nil && perFile {
+		return fmt.Errorf("%w\nThe remaining files are staged; commit them yourself and run 'git anticipate clean'", err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create commit: %w\n\nTip: If pre-commit hooks are failing, you can:\n  1. Fix the issues and run 'git anticipate --continue' again\n  2. Or run 'git anticipate --continue --no-verify' to skip hooks\n  3. If a hook fixed the files itself, use --retry-hook to commit its changes", err)
+	}
+
+	// Clean up state
+	headSHA, _ := getRevisionSHA("HEAD")
+	writeStateFile(stateDir, "committed", headSHA)
+	recordMetrics(opts.metricsFile, stateDir, "resolved", len(changedFiles))
+	if opts.noteRef != "" {
+		conflicts, _ := readStateList(stateDir, "conflicts")
+		if err := addResolutionNote(opts.noteRef, headSHA, targetBranch, targetSHA, conflicts); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to add note: %v\n", err)
+		}
+	}
+	recordHistory(stateDir, "resolved", headSHA)
+	removeState(stateDir)
+
+	// The scratch branch has the commit; the original branch never moved,
+	// so switching back to it puts the working tree where it was
+	if opts.scratch {
+		back := []string{"checkout", "-q", state.currentBranch}
+		if state.currentBranch == "HEAD" {
+			back = []string{"checkout", "-q", "--detach", origHead}
+		}
+		if output, err := gitCommand(back...).CombinedOutput(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to switch back to %s: %s\n", state.currentBranch, strings.TrimSpace(string(output)))
+		} else {
+			printf("✔ Switched back to %s, which is unchanged\n", state.currentBranch)
+		}
+	}
+
+	printf("\n✨ Success! Resolution committed to %s\n", currentBranch)
+	if perFile {
+		printf("Created %d commits, ending at %s\n", len(changedFiles), truncateSHA(headSHA))
+	} else {
+		printf("Created commit %s\n", truncateSHA(headSHA))
+	}
+	if opts.scratch {
+		printf("%s is prepared for merging into %s\n", currentBranch, targetBranch)
+	} else {
+		printf("Your branch is now prepared for merging into %s\n", targetBranch)
+	}
+	source := currentBranch
+	if source == "HEAD" {
+		source = truncateSHA(headSHA)
+	}
+	printf("\nTo merge for real (or open a pull request from %s into %s):\n", source, targetBranch)
+	printf("  %s\n", mergeCommand(targetBranch, source, prefix, state.unrelated || isUnborn))
+
+	// The commit exists at this point, so leftover markers only warn
+	if marked := findCommittedMarkers(headSHA, changedFiles); len(marked) > 0 {
+		printf("\n⚠️  The commit still contains conflict markers in:\n")
+		for _, file := range marked {
+			printf("    %s\n", displayPath(file))
+		}
+		printf("Fix them and run 'git commit --amend' before merging\n")
+	}
+
+	result := continueResult{Committed: &headSHA, Timings: timer.phases}
+	if opts.scratch {
+		result.Branch = opts.newBranch
+	}
+	if opts.checkMerge {
+		if remaining, ok := checkRemainingConflicts(headSHA, targetBranch, targetSHA, prefix, state.unrelated || isUnborn); ok {
+			result.RemainingConflicts = &remaining
+		}
+	}
+
+	if opts.json {
+		emitJSON(result)
+	}
+	return nil
+}
+
+// checkRemainingConflicts merges the target into the new commit with
+// merge-tree, without touching the working tree, and reports which files
+// would still conflict in the real merge. The target is taken as it is now,
+// falling back to the commit the session started from. ok is false when the
+// check could not be made.
+func checkRemainingConflicts(headSHA, targetBranch, targetSHA, prefix string, unrelated bool) (remaining []string, ok bool) {
+	if prefix != "" {
+		printf("\n⚠️  Cannot check the remaining conflicts of a --prefix session; merge-tree has no subtree strategy\n")
+		return nil, false
+	}
+	if current, err := getRevisionSHA(targetBranch + "^{commit}"); err == nil {
+		targetSHA = current
+	}
+	remaining, _, err := mergeTreeConflicts(headSHA, targetSHA, unrelated)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to check the remaining conflicts (--check-merge needs Git 2.38 or later): %v\n", err)
+		return nil, false
+	}
+	printf("\nRemaining conflicts after resolution: %d\n", len(remaining))
+	for _, file := range remaining {
+		printf("    ❌ %s\n", displayPath(file))
+	}
+	return remaining, true
+}
+
+// withCommitOptions adds what the commit options ask for (trailers, signing,
+// identity, hooks and cleanup) to a git commit command line. The identity
+// options are applied to the environment the commit inherits.
+func withCommitOptions(commitArgs []string, opts continueOptions, targetSHA string) []string {
+	for _, coAuthor := range opts.coAuthors {
+		commitArgs = append(commitArgs, "--trailer", "Co-authored-by: "+coAuthor)
+	}
+	for _, trailer := range opts.trailers {
+		match := trailerPattern.FindStringSubmatch(trailer)
+		commitArgs = append(commitArgs, "--trailer", match[1]+": "+strings.TrimSpace(match[2]))
+	}
+	if opts.resetAuthor {
+		// git commit only honours --reset-author with -C, -c or --amend; for
+		// a fresh commit the author comes from the environment, then config
+		for _, name := range []string{"GIT_AUTHOR_NAME", "GIT_AUTHOR_EMAIL", "GIT_AUTHOR_DATE"} {
+			os.Unsetenv(name)
+		}
+	}
+	if opts.committer != "" {
+		name, email, _ := strings.Cut(opts.committer, " <")
+		os.Setenv("GIT_COMMITTER_NAME", name)
+		os.Setenv("GIT_COMMITTER_EMAIL", strings.TrimSuffix(email, ">"))
+	}
+	if opts.recordMergeParent {
+		// A trailer rather than a note, so it survives rebases and pushes
+		commitArgs = append(commitArgs, "--trailer", mergeParentTrailer+": "+targetSHA)
+	}
+	if opts.allowEmptyMessage {
+		commitArgs = append(commitArgs, "--allow-empty-message")
+	}
+	if opts.cleanup != "" && !opts.edit {
+		commitArgs = append(commitArgs, "--cleanup="+opts.cleanup)
+	}
+	if opts.noVerify {
+		commitArgs = append(commitArgs, "--no-verify")
+	}
+	if opts.sshSign != "" {
+		// Same as gpg.format=ssh and user.signingkey in the config
+		commitArgs = append([]string{"-c", "gpg.format=ssh", "-c", "user.signingkey=" + opts.sshSign}, commitArgs...)
+		if opts.gpgSign == "" {
+			opts.gpgSign = "default"
+		}
+	}
+	if opts.gpgSign != "" {
+		// -S alone uses the default key from user.signingkey
+		if opts.gpgSign == "default" {
+			commitArgs = append(commitArgs, "-S")
+		} else {
+			commitArgs = append(commitArgs, "-S"+opts.gpgSign)
+		}
+	}
+	if opts.gpgProgram != "" {
+		commitArgs = append([]string{"-c", "gpg.program=" + opts.gpgProgram}, commitArgs...)
+	}
+	return commitArgs
+}
+
+// commitTrialMerge commits the merge in progress as it is staged, for
+// --no-reset. The result is a real merge of the original HEAD and the target,
+// so the branch's history changes shape; nothing is reset or reapplied.
+func commitTrialMerge(stateDir string, state *sessionState, opts continueOptions, messageFromFile []byte) error {
+	if !isMergeInProgress() {
+		return fmt.Errorf("--no-reset needs the trial merge in progress; there is none to commit")
+	}
+	printf("⚠️  --no-reset is experimental: this makes a merge commit of %s and %s, not a single-parent preparation commit\n", state.currentBranch, state.target)
+	printf("✔ Committing the merge...\n")
+
+	commitArgs := []string{"commit", "--no-edit"}
+	if opts.messageSet {
+		commitArgs = []string{"commit", "-m", opts.message}
+	} else if messageFromFile != nil {
+		commitArgs = []string{"commit", "-F", "-"}
+	}
+	commitArgs = withCommitOptions(commitArgs, opts, state.targetSHA)
+	commitCmd := gitCommand(commitArgs...)
+	if messageFromFile != nil {
+		commitCmd.Stdin = bytes.NewReader(messageFromFile)
+	}
+	commitCmd.Stdout = out
+	commitCmd.Stderr = os.Stderr
+	if err := commitCmd.Run(); err != nil {
+		return fmt.Errorf("failed to commit the merge: %w\nThe merge is still in progress; fix the problem and run 'git anticipate --continue --no-reset' again", err)
+	}
+
+	headSHA, _ := getRevisionSHA("HEAD")
+	writeStateFile(stateDir, "committed", headSHA)
+	conflicts, _ := readStateList(stateDir, "conflicts")
+	recordMetrics(opts.metricsFile, stateDir, "resolved", len(conflicts))
+	recordHistory(stateDir, "resolved", headSHA)
+	removeState(stateDir)
+
+	printf("\n✨ Success! Merged %s into %s\n", state.target, state.currentBranch)
+	printf("Created merge commit %s\n", truncateSHA(headSHA))
+	if opts.json {
+		emitJSON(continueResult{Committed: &headSHA})
+	}
+	return nil
+}
+
+// commitPerFile commits the staged resolution one file at a time, in path
+// order. Each commit reuses commitArgs with the file appended to the subject
+// of message; deletions get their own "delete <file>" commit.
+func commitPerFile(commitArgs []string, message string, files []string, deleted, skipWorktree map[string]bool) error {
+	sorted := append([]string{}, files...)
+	sort.Strings(sorted)
+
+	// Take the staged entries out of the index and put them back one by one
+	entries := make(map[string]indexEntry)
+	index := getIndexEntries()
+	for _, file := range sorted {
+		if !deleted[file] {
+			entry, ok := index[file]
+			if !ok {
+				return fmt.Errorf("failed to read staged file %s: it is not in the index", file)
+			}
+			entries[file] = entry
+		}
+	}
+	if err := pathspecCommand(sorted, "reset", "-q").Run(); err != nil {
+		return fmt.Errorf("failed to unstage the resolution: %w", err)
+	}
+
+	subject, body, hasBody := strings.Cut(message, "\n")
+	for i, file := range sorted {
+		var err error
+		msg := subject + ": " + file
+		if deleted[file] {
+			msg = subject + ": delete " + file
+			err = gitCommand("rm", "-q", "--cached", "--ignore-unmatch", "--", literalPath(file)).Run()
+		} else {
+			err = restoreIndexEntry(file, entries[file])
+			if err == nil && skipWorktree[file] {
+				err = gitCommand("update-index", "--skip-worktree", "--", file).Run()
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to stage file %s: %w", file, err)
+		}
+		if hasBody {
+			msg += "\n" + body
+		}
+
+		// The message is the argument after -m; everything else stays
+		args := append([]string{}, commitArgs...)
+		for j := range args {
+			if args[j] == "-m" {
+				args[j+1] = msg
+				break
+			}
+		}
+		commitCmd := gitCommand(args...)
+		commitCmd.Stdout = out
+		commitCmd.Stderr = os.Stderr
+		if err := commitCmd.Run(); err != nil {
+			return fmt.Errorf("failed to commit %s (%d of %d files committed): %w", file, i, len(sorted), err)
+		}
+	}
+	return nil
+}
+
+// readMergeMsg returns the body of the MERGE_MSG git wrote for the trial
+// merge, without its "Merge branch" subject. The conflict list git comments
+// out is uncommented so it survives into the commit.
+func readMergeMsg(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	comment := "#"
+	if c := getConfig("core.commentChar"); len(c) == 1 {
+		comment = c
+	}
+	_, body, _ := strings.Cut(string(data), "\n")
+	lines := []string{}
+	for _, line := range strings.Split(body, "\n") {
+		if rest, ok := strings.CutPrefix(line, comment); ok {
+			line = strings.TrimPrefix(rest, " ")
+		}
+		lines = append(lines, line)
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// defaultCommitMessage is the message of the resolution commit when none
+// is given
+func defaultCommitMessage(state *sessionState) string {
+	msg := fmt.Sprintf("Preemptive conflict resolution vs %s@%s", state.target, truncateSHA(state.targetSHA))
+	if state.prefix != "" {
+		msg += fmt.Sprintf(" in %s/", state.prefix)
+	}
+	if state.unrelated {
+		msg += " (unrelated histories)"
+	}
+	return msg
+}
+
+// editTemplate is the editor buffer for --edit: the message, then below a
+// scissors line (which --cleanup=scissors cuts at) what is being resolved
+func editTemplate(message string, state *sessionState, conflicts []string, files []string) string {
+	comment := "#"
+	if c := getConfig("core.commentChar"); len(c) == 1 {
+		comment = c
+	}
+	var b strings.Builder
+	b.WriteString(strings.TrimRight(message, "\n") + "\n\n")
+	fmt.Fprintf(&b, "%s ------------------------ >8 ------------------------\n", comment)
+	fmt.Fprintf(&b, "%s Do not modify or remove the line above.\n", comment)
+	fmt.Fprintf(&b, "%s Everything below it will be ignored.\n", comment)
+	fmt.Fprintf(&b, "\nResolving conflicts with %s@%s\n", state.target, truncateSHA(state.targetSHA))
+	b.WriteString("\nConflicted files:\n")
+	for _, file := range conflicts {
+		fmt.Fprintf(&b, "    %s\n", file)
+	}
+	b.WriteString("\nFiles in this commit:\n")
+	for _, file := range files {
+		fmt.Fprintf(&b, "    %s\n", file)
+	}
+	return b.String()
+}
+
+// scratchBranchName picks an unused branch name for --scratch, from the
+// branch the session started on and the current time
+func scratchBranchName(currentBranch string) string {
+	base := "anticipate-scratch/" + currentBranch + "-" + time.Now().Format("20060102-150405")
+	name := base
+	for i := 2; ; i++ {
+		if _, err := getRevisionSHA("refs/heads/" + name); err != nil {
+			return name
+		}
+		name = fmt.Sprintf("%s-%d", base, i)
+	}
+}
+
+// printContinuePlan describes what --continue would do, for --dry-run
+func printContinuePlan(state *sessionState, opts continueOptions, changedFiles []string, deletedFiles map[string]bool, unrelatedFiles []string, messageFromFile []byte) {
+	branch := state.currentBranch
+	if opts.newBranch != "" {
+		branch = opts.newBranch + " (new, from " + state.currentBranch + ")"
+	}
+	printf("Would reset to %s (--reset-mode %s) and commit onto %s:\n", truncateSHA(state.origHead), opts.resetMode, branch)
+	for _, file := range changedFiles {
+		if deletedFiles[file] {
+			printf("    deleted: %s\n", displayPath(file))
+		} else {
+			printf("    %s\n", displayPath(file))
+		}
+	}
+	if len(changedFiles) == 0 {
+		printf("    (no changes; --empty=%s)\n", opts.empty)
+	}
+	if len(unrelatedFiles) > 0 {
+		printf("\nWould keep out of the commit:\n")
+		for _, file := range unrelatedFiles {
+			printf("    %s\n", displayPath(file))
+		}
+	}
+
+	message := defaultCommitMessage(state)
+	switch {
+	case opts.messagePrefix != "":
+		message = opts.messagePrefix + " " + message
+	case opts.fixup != "":
+		subject, _ := gitCommand("log", "-1", "--format=%s", opts.fixup).Output()
+		message = "fixup! " + strings.TrimSpace(string(subject))
+	case messageFromFile != nil:
+		message, _, _ = strings.Cut(strings.TrimSpace(string(messageFromFile)), "\n")
+	case opts.messageSet:
+		message = opts.message
+	}
+	if opts.perFile && len(changedFiles) > 0 {
+		printf("\nOne commit per file, each with the file added to:\n    %s\n", message)
+	} else {
+		printf("\nCommit message:\n    %s\n", message)
+	}
+	printf("\nDry run: nothing was changed. Run 'git anticipate --continue' to apply the resolution.\n")
+}
+
+// addResolutionNote attaches a note to commit recording what it resolved,
+// so the commit message can stay short
+func addResolutionNote(ref, commit, targetBranch, targetSHA string, conflicts []string) error {
+	var note strings.Builder
+	fmt.Fprintf(&note, "Target: %s\n", targetBranch)
+	fmt.Fprintf(&note, "Target SHA: %s\n", targetSHA)
+	note.WriteString("Resolved files:\n")
+	for _, file := range conflicts {
+		fmt.Fprintf(&note, "    %s\n", file)
+	}
+
+	notesCmd := gitCommand("notes", "--ref", ref, "add", "-f", "-F", "-", commit)
+	notesCmd.Stdin = strings.NewReader(note.String())
+	if output, err := notesCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s", strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// checkSSHSigningKey verifies that an SSH signing key names a readable
+// file. Literal keys ("key::ssh-ed25519 ...") are passed through.
+func checkSSHSigningKey(key string) error {
+	if strings.HasPrefix(key, "key::") {
+		return nil
+	}
+	path := key
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, rest)
+		}
+	}
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("SSH signing key '%s' not found\nPass a key file or key::<public key> to --ssh-sign, or fix user.signingkey", key)
+	}
+	return nil
+}
+
+// abortAnticipate aborts the current anticipate session
+//
+// With soft, the working tree is left alone: HEAD and the index go back to
+// the original HEAD but the resolution stays behind as uncommitted changes.
+// This does not restore the original state.
+func abortAnticipate(stateDir, metricsFile string, soft, yes bool) error {
+	if !isAnticipateInProgress(stateDir) {
+		return fmt.Errorf("no anticipate in progress")
+	}
+
+	printf("🚀 git-anticipate: Aborting\n\n")
+
+	// Read original HEAD
+	state, err := loadState(stateDir)
+	if err != nil {
+		return err
+	}
+	origHead := state.origHead
+
+	if soft {
+		// git merge --abort would throw the resolution away; a mixed reset
+		// ends the merge and keeps the working tree
+		printf("✔ Resetting to original HEAD, keeping the working tree...\n")
+		resetCmd := gitCommand("reset", "--mixed", "-q", origHead)
+		if err := resetCmd.Run(); err != nil {
+			return fmt.Errorf("failed to reset to original HEAD: %w", err)
+		}
+		recordMetrics(metricsFile, stateDir, "aborted", 0)
+		recordHistory(stateDir, "aborted", "")
+		removeState(stateDir)
+		printf("✔ Anticipate aborted. The resolution is left as uncommitted changes.\n")
+		return nil
+	}
+
+	if lost := discardedWork(stateDir); len(lost) > 0 && !yes {
+		printf("⚠️  Aborting discards:\n")
+		for _, line := range lost {
+			printf("    %s\n", line)
+		}
+		if !confirm("Abort anyway?") {
+			return fmt.Errorf("abort cancelled; nothing was changed\nUse --abort --soft to keep the resolution as uncommitted changes")
+		}
+	}
+
+	// Abort any merge in progress
+	abortMerge()
+
+	// Reset to original HEAD
+	printf("✔ Restoring original state...\n")
+	resetCmd := gitCommand("reset", "--hard", origHead)
+	stopSpinner := startSpinner("resetting")
+	err = resetCmd.Run()
+	stopSpinner()
+	if err != nil {
+		return fmt.Errorf("failed to reset to original state: %w", err)
+	}
+
+	// Clean up state
+	recordMetrics(metricsFile, stateDir, "aborted", 0)
+	recordHistory(stateDir, "aborted", "")
+	removeState(stateDir)
+
+	printf("✔ Anticipate aborted. Restored to original state.\n")
+	return nil
+}
+
+// showStatus shows the current anticipate status
+func showStatus(stateDir string, short bool) error {
+	if short {
+		return showShortStatus(stateDir)
+	}
+	if !isAnticipateInProgress(stateDir) {
+		printf("No anticipate in progress.\n\n")
+		printf("Usage: git anticipate <target-branch>\n")
+		return nil
+	}
+
+	state, err := loadState(stateDir)
+	if err != nil {
+		return err
+	}
+	targetBranch, currentBranch, origHead := state.target, state.currentBranch, state.origHead
+	baseSHA, baseRef := state.base, state.baseRef
+
+	printf("🚀 git-anticipate: In Progress\n\n")
+	printf("Current branch:  %s\n", currentBranch)
+	printf("Target branch:   %s\n", targetBranch)
+	printf("Original HEAD:   %s\n", truncateSHA(origHead))
+	if state.prefix != "" {
+		printf("Prefix:          %s/\n", state.prefix)
+	}
+	if state.unrelated {
+		printf("Merge base:      none (unrelated histories)\n")
+	} else if baseRef != "" {
+		printf("Merge base:      %s (from --base %s)\n", truncateSHA(baseSHA), baseRef)
+	} else if baseSHA != "" {
+		printf("Merge base:      %s\n", truncateSHA(baseSHA))
+	}
+	if state.diffAlgorithm != "" {
+		printf("Diff algorithm:  %s\n", state.diffAlgorithm)
+	}
+	if started, ok := sessionStart(stateDir); ok {
+		printf("Started:         %s ago\n", formatAge(time.Since(started)))
+	}
+	printf("\n")
+
+	// Check for conflicts
+	conflictFiles := []string{}
+	if hasUnmergedFiles() {
+		conflictFiles = getConflictingFiles()
+		printf("⚠️  Unresolved conflicts (%d):\n", len(conflictFiles))
+		for _, file := range conflictFiles {
+			printf("    ❌ %s\n", displayPath(file))
+		}
+	} else {
+		printf("✔ All conflicts resolved!\n")
+	}
+
+	printf("\n")
+	printNextSteps(conflictFiles)
+	return nil
+}
+
+// sessionStart returns when the session was started, from started_at or,
+// for sessions saved before it was recorded, the state directory's mtime
+func sessionStart(stateDir string) (time.Time, bool) {
+	if startedAt, err := readStateFile(stateDir, "started_at"); err == nil {
+		if start, err := time.Parse(time.RFC3339, startedAt); err == nil {
+			return start, true
+		}
+	}
+	if info, err := os.Stat(stateDir); err == nil {
+		return info.ModTime(), true
+	}
+	return time.Time{}, false
+}
+
+// formatAge renders d coarsely, like 45s, 3h12m or 2d4h
+func formatAge(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh%dm", int(d.Hours()), int(d.Minutes())%60)
+	default:
+		return fmt.Sprintf("%dd%dh", int(d.Hours())/24, int(d.Hours())%24)
+	}
+}
+
+// showShortStatus prints the status as a single line for shell prompts,
+// such as "anticipate: feature→dev, 2 conflicts". It always succeeds so a
+// prompt never shows an error.
+func showShortStatus(stateDir string) error {
+	if !isAnticipateInProgress(stateDir) {
+		printf("anticipate: none\n")
+		return nil
+	}
+	state, err := loadState(stateDir)
+	if err != nil {
+		printf("anticipate: incomplete state\n")
+		return nil
+	}
+
+	summary := "resolved"
+	if n := len(getConflictingFiles()); n == 1 {
+		summary = "1 conflict"
+	} else if n > 1 {
+		summary = fmt.Sprintf("%d conflicts", n)
+	}
+	printf("anticipate: %s→%s, %s\n", state.currentBranch, state.target, summary)
+	return nil
+}
+
+// exportConflicts writes a combined diff of the unresolved files, conflict
+// markers included, to path so the conflicts can be reviewed offline
+func exportConflicts(stateDir, path string) error {
+	if !isAnticipateInProgress(stateDir) {
+		return fmt.Errorf("no anticipate in progress")
+	}
+
+	conflictFiles := getConflictingFiles()
+	if len(conflictFiles) == 0 {
+		return fmt.Errorf("no unresolved conflicts to export")
+	}
+
+	// git diff cannot read paths from stdin; selecting the unmerged paths
+	// with a filter gives the same diff without listing them
+	diffCmd := gitCommand("diff", "--cc", "--diff-filter=U")
+	output, err := diffCmd.Output()
+	if err != nil {
+		return fmt.Errorf("failed to diff conflicting files: %w", err)
+	}
+	if err := os.WriteFile(path, output, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+
+	printf("✔ Exported %d conflicting files to %s\n", len(conflictFiles), path)
+	return nil
+}
+
+// discardedWork summarizes what a hard abort would throw away: conflicts
+// already resolved, staged changes beyond what the merge staged itself, and
+// unstaged edits outside the files still conflicting
+func discardedWork(stateDir string) []string {
+	conflicted := make(map[string]bool)
+	conflicts, _ := readStateList(stateDir, "conflicts")
+	for _, file := range conflicts {
+		conflicted[file] = true
+	}
+	unmerged := make(map[string]bool)
+	for _, file := range getConflictingFiles() {
+		unmerged[file] = true
+	}
+
+	resolved := 0
+	for file := range conflicted {
+		if !unmerged[file] {
+			resolved++
+		}
+	}
+	staged := 0
+	if autoMerged, err := loadAutoMerged(stateDir); err == nil {
+		changedFiles, deletedFiles, _ := getStagedChanges()
+		index := getIndexEntries()
+		for _, file := range changedFiles {
+			if conflicted[file] {
+				continue
+			}
+			expected, ok := autoMerged[file]
+			if !ok {
+				staged++
+			} else if deletedFiles[file] {
+				if expected != "" {
+					staged++
+				}
+			} else if index[file].sha != expected {
+				staged++
+			}
+		}
+	}
+	unstaged := 0
+	for _, file := range getUnstagedFiles() {
+		if !unmerged[file] {
+			unstaged++
+		}
+	}
+
+	lost := []string{}
+	if resolved > 0 {
+		lost = append(lost, fmt.Sprintf("%d resolved of %d conflicting files", resolved, len(conflicted)))
+	}
+	if staged > 0 {
+		lost = append(lost, fmt.Sprintf("%d other staged changes", staged))
+	}
+	if unstaged > 0 {
+		lost = append(lost, fmt.Sprintf("%d files with unstaged edits", unstaged))
+	}
+	return lost
+}
+
+// remergeFile recreates the conflict markers in a single file of the
+// session, discarding whatever resolution it currently holds
+func remergeFile(stateDir, file string) error {
+	if !isAnticipateInProgress(stateDir) {
+		return fmt.Errorf("no anticipate in progress")
+	}
+
+	conflicts, _ := readStateList(stateDir, "conflicts")
+	conflicted := false
+	for _, f := range conflicts {
+		if f == file {
+			conflicted = true
+			break
+		}
+	}
+	if !conflicted {
+		return fmt.Errorf("'%s' did not conflict in this session", file)
+	}
+
+	// checkout -m also works after 'git add', using the index's
+	// resolve-undo information, and honours merge.conflictStyle
+	checkoutCmd := gitCommand("checkout", "-m", "--", literalPath(file))
+	if output, err := checkoutCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to recreate conflict in %s: %s", file, strings.TrimSpace(string(output)))
+	}
+
+	printf("✔ Restored conflict markers in %s\n", displayPath(file))
+	return nil
+}
+
+// applyResolutionInput resolves the unmerged files from a JSON object
+// mapping each path to "ours", "theirs" or a file holding the resolved
+// content, and stages the results. Every unmerged file must be covered.
+func applyResolutionInput(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read --input: %w", err)
+	}
+	var given map[string]string
+	if err := json.Unmarshal(data, &given); err != nil {
+		return fmt.Errorf("invalid --input %s: %w", path, err)
+	}
+	// Keys are working-tree paths, content files are relative to where
+	// the command was run
+	choices := make(map[string]string)
+	for file, choice := range given {
+		if choice != "ours" && choice != "theirs" {
+			choice = userPath(choice)
+		}
+		choices[repoPath(file)] = choice
+	}
+
+	conflictFiles := getConflictingFiles()
+	unmerged := make(map[string]bool)
+	missing := []string{}
+	for _, file := range conflictFiles {
+		unmerged[file] = true
+		if _, ok := choices[file]; !ok {
+			missing = append(missing, displayPath(file))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("--input does not cover every conflict; missing:\n    %s", strings.Join(missing, "\n    "))
+	}
+	for file := range choices {
+		if !unmerged[file] {
+			return fmt.Errorf("--input resolves '%s', which is not in conflict", displayPath(file))
+		}
+	}
+
+	for _, file := range conflictFiles {
+		choice := choices[file]
+		switch choice {
+		case "ours", "theirs":
+			stage := "2"
+			if choice == "theirs" {
+				stage = "3"
+			}
+			if !hasIndexStage(file, stage) {
+				// Deleted on the chosen side
+				rmCmd := gitCommand("rm", "-q", "--", literalPath(file))
+				if output, err := rmCmd.CombinedOutput(); err != nil {
+					return fmt.Errorf("failed to resolve %s: %s", file, strings.TrimSpace(string(output)))
+				}
+				printf("✔ Resolved %s (%s)\n", displayPath(file), choice)
+				continue
+			}
+			checkoutCmd := gitCommand("checkout", "--"+choice, "--", literalPath(file))
+			if output, err := checkoutCmd.CombinedOutput(); err != nil {
+				return fmt.Errorf("failed to resolve %s: %s", file, strings.TrimSpace(string(output)))
+			}
+		default:
+			content, err := os.ReadFile(choice)
+			if err != nil {
+				return fmt.Errorf("failed to read resolution for %s: %w", file, err)
+			}
+			if err := os.WriteFile(file, content, 0644); err != nil {
+				return fmt.Errorf("failed to write %s: %w", file, err)
+			}
+		}
+		addCmd := gitCommand("add", "--", literalPath(file))
+		if output, err := addCmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to stage %s: %s", file, strings.TrimSpace(string(output)))
+		}
+		printf("✔ Resolved %s (%s)\n", displayPath(file), choice)
+	}
+	return nil
+}
+
+// printNextSteps prints copy-pasteable commands for what to do next, based
+// on whether conflicts remain
+func printNextSteps(conflictFiles []string) {
+	if len(conflictFiles) > 0 {
+		quoted := make([]string, len(conflictFiles))
+		for i, file := range conflictFiles {
+			quoted[i] = shellQuote(displayPath(file))
+		}
+		printf("Resolve conflicts in your working directory, then:\n")
+		printf("  git add %s\n", strings.Join(quoted, " "))
+		printf("  git anticipate --continue\n")
+	} else {
+		printf("Apply the resolution with:\n")
+		printf("  git anticipate --continue\n")
+	}
+	printf("\nOr to abort:\n")
+	printf("  git anticipate --abort\n")
+}
+
+// mergeCommand suggests the commands that do the real merge of source into
+// target. A remote-tracking target is checked out by its local name, which
+// git checkout creates from the remote branch if needed. --no-ff keeps the
+// merge commit even if target has not moved since. Unrelated histories need
+// git merge's explicit permission.
+func mergeCommand(target, source, prefix string, unrelated bool) string {
+	checkout := target
+	if _, err := getRevisionSHA("refs/heads/" + target); err != nil {
+		if _, err := getRevisionSHA("refs/remotes/" + target); err == nil {
+			_, checkout, _ = strings.Cut(target, "/")
+		}
+	}
+	merge := "git merge --no-ff"
+	if unrelated {
+		merge += " --allow-unrelated-histories"
+	}
+	if prefix != "" {
+		merge += " -Xsubtree=" + shellQuote(prefix)
+	}
+	return fmt.Sprintf("git checkout %s && %s %s", shellQuote(checkout), merge, shellQuote(source))
+}
+
+// shellQuote quotes a path for a POSIX shell when it contains anything other
+// than safe characters
+func shellQuote(s string) string {
+	safe := true
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./+@%:,=", r)) {
+			safe = false
+			break
+		}
+	}
+	if safe && s != "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// === Conflict Statistics ===
+
+// startResult is the --json output of starting a session
+type startResult struct {
+	Target        string          `json:"target"`
+	CurrentBranch string          `json:"current_branch"`
+	Outcome       string          `json:"outcome"` // "conflicts" or "clean"
+	Conflicts     []string        `json:"conflicts"`
+	Effort        *conflictEffort `json:"effort,omitempty"`
+	Timings       []phaseTiming   `json:"timings,omitempty"`
+}
+
+// continueResult is the --json output of --continue
+type continueResult struct {
+	Committed          *string       `json:"committed"`                     // Null when nothing was committed
+	Reason             string        `json:"reason,omitempty"`              // Why no new commit was made
+	Branch             string        `json:"branch,omitempty"`              // The scratch branch, with --scratch
+	RemainingConflicts *[]string     `json:"remaining_conflicts,omitempty"` // With --check-merge; [] when none remain
+	Timings            []phaseTiming `json:"timings,omitempty"`
+}
+
+// conflictEffort is a rough estimate of how much work a set of conflicts is
+type conflictEffort struct {
+	Files  int    `json:"files"`
+	Hunks  int    `json:"hunks"`
+	Lines  int    `json:"lines"` // Lines between the conflict markers
+	Rating string `json:"rating"`
+}
+
+// measureEffort counts the conflict hunks and lines in the working-tree
+// copies of files and rates the total. Each hunk weighs two points and
+// every ten lines one more, plus one per file: up to 5 is low, up to 20
+// medium, anything above high.
+func measureEffort(files []string) conflictEffort {
+	effort := conflictEffort{Files: len(files)}
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			continue // Deleted on one side; no markers to count
+		}
+		inConflict := false
+		for _, line := range strings.Split(string(content), "\n") {
+			switch {
+			case strings.HasPrefix(line, "<<<<<<<"):
+				inConflict = true
+				effort.Hunks++
+			case strings.HasPrefix(line, ">>>>>>>"):
+				inConflict = false
+			case inConflict && !strings.HasPrefix(line, "=======") && !strings.HasPrefix(line, "|||||||"):
+				effort.Lines++
+			}
+		}
+	}
+
+	score := effort.Files + 2*effort.Hunks + effort.Lines/10
+	switch {
+	case score <= 5:
+		effort.Rating = "low"
+	case score <= 20:
+		effort.Rating = "medium"
+	default:
+		effort.Rating = "high"
+	}
+	return effort
+}
+
+// findCommittedMarkers returns the files whose committed version in commit
+// still has a conflict hunk. Files missing from the commit are skipped.
+// Contents are scanned as they stream out of git, so large files are not
+// read into memory.
+func findCommittedMarkers(commit string, files []string) []string {
+	var marked []string
+	output, err := gitCommand("ls-tree", "-r", "-z", commit).Output()
+	if err != nil {
+		return marked
+	}
+	// Format: <mode> <type> <sha>\t<path>\0
+	tree := make(map[string]string)
+	for _, record := range splitNul(output) {
+		meta, path, _ := strings.Cut(record, "\t")
+		if fields := strings.Fields(meta); len(fields) == 3 && fields[1] == "blob" {
+			tree[path] = fields[2]
+		}
+	}
+	blobs, err := newBlobReader()
+	if err != nil {
+		return marked
+	}
+	defer blobs.Close()
+	for _, file := range files {
+		sha, ok := tree[file]
+		if !ok {
+			continue
+		}
+		content, err := blobs.open(sha)
+		if err != nil {
+			continue
+		}
+		if hasConflictMarkers(content) {
+			marked = append(marked, file)
+		}
+	}
+	return marked
+}
+
+// hasConflictMarkers reports whether r has an opening conflict marker
+// followed later by a closing one, both at the start of a line
+func hasConflictMarkers(r io.Reader) bool {
+	reader := bufio.NewReader(r)
+	opened, lineStart := false, true
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if lineStart {
+			switch {
+			case bytes.HasPrefix(chunk, []byte("<<<<<<<")):
+				opened = true
+			case opened && bytes.HasPrefix(chunk, []byte(">>>>>>>")):
+				return true
+			}
+		}
+		// A line longer than the buffer comes in several chunks
+		lineStart = err != bufio.ErrBufferFull
+		if err != nil && err != bufio.ErrBufferFull {
+			return false
+		}
+	}
+}
+
+// emitNoCommit writes the --json result of a --continue that made no commit
+func emitNoCommit(opts continueOptions, reason string) {
+	if opts.json {
+		emitJSON(continueResult{Reason: reason})
+	}
+}
+
+// emitJSON writes v to stdout, bypassing out
+func emitJSON(v any) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to encode JSON: %v\n", err)
+		return
+	}
+	fmt.Fprintln(os.Stdout, string(data))
+}
+
+// === Timings ===
+
+// phaseTiming is how long one phase of a command took
+type phaseTiming struct {
+	Phase   string  `json:"phase"`
+	Seconds float64 `json:"seconds"`
+}
+
+// phaseTimer records phase durations for --timings. It does nothing until
+// begin is called, so the marks can stay in place unconditionally.
+type phaseTimer struct {
+	enabled bool
+	last    time.Time
+	phases  []phaseTiming
+}
+
+var timer phaseTimer
+
+func (t *phaseTimer) begin() {
+	t.enabled = true
+	t.last = time.Now()
+}
+
+// mark ends the current phase, naming it
+func (t *phaseTimer) mark(phase string) {
+	if !t.enabled {
+		return
+	}
+	now := time.Now()
+	t.phases = append(t.phases, phaseTiming{Phase: phase, Seconds: now.Sub(t.last).Seconds()})
+	t.last = now
+}
+
+// report prints the recorded phases as a table
+func (t *phaseTimer) report() {
+	if !t.enabled || len(t.phases) == 0 {
+		return
+	}
+	total := 0.0
+	printf("\nTimings:\n")
+	for _, p := range t.phases {
+		printf("    %-20s %8.3fs\n", p.Phase, p.Seconds)
+		total += p.Seconds
+	}
+	printf("    %-20s %8.3fs\n", "total", total)
+}
+
+// === Prompts ===
+
+// isInteractive reports whether the user can answer prompts. Prompts are only
+// shown when stdin is a terminal; GIT_ANTICIPATE_INTERACTIVE=1 forces them on
+// (e.g. for scripted input) and GIT_ANTICIPATE_INTERACTIVE=0 turns them off.
+func isInteractive() bool {
+	switch os.Getenv("GIT_ANTICIPATE_INTERACTIVE") {
+	case "1":
+		return true
+	case "0":
+		return false
+	}
+	return isTerminal(os.Stdin)
+}
+
+// isTerminal reports whether f is attached to a terminal. Character devices
+// other than the null device (which is what stdin is under cron, CI or
+// exec with no input) are treated as terminals.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	if devNull, err := os.Stat(os.DevNull); err == nil && os.SameFile(info, devNull) {
+		return false
+	}
+	return true
+}
+
+// spinnerDelay is how long an operation runs before startSpinner shows
+// anything, so quick merges and resets don't flicker
+const spinnerDelay = 300 * time.Millisecond
+
+// startSpinner shows a spinner and msg on stderr until the returned function
+// is called, then clears the line. Nothing is drawn unless stderr is a
+// terminal and output isn't suppressed (--json), so redirected or captured
+// output never sees it.
+func startSpinner(msg string) func() {
+	if out == io.Discard || !isTerminal(os.Stderr) {
+		return func() {}
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-done:
+			return
+		case <-time.After(spinnerDelay):
+		}
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		frames := `|/-\`
+		for i := 0; ; i++ {
+			fmt.Fprintf(os.Stderr, "\r%c %s...", frames[i%len(frames)], msg)
+			select {
+			case <-done:
+				fmt.Fprint(os.Stderr, "\r\033[K")
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// confirm asks a yes/no question. Non-interactive sessions proceed without
+// asking, matching the behavior before prompts existed.
+func confirm(question string) bool {
+	if !isInteractive() {
+		return true
+	}
+	promptf("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// === State Management ===
+
+func isAnticipateInProgress(stateDir string) bool {
+	_, err := os.Stat(stateDir)
+	return err == nil
+}
+
+func saveState(stateDir, targetBranch, origHead, targetSHA, currentBranch, baseSHA string) error {
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return err
+	}
+
+	files := map[string]string{
+		"target":         targetBranch,
+		"orig_head":      origHead,
+		"target_sha":     targetSHA,
+		"current_branch": currentBranch,
+		"base":           baseSHA,
+		"started_at":     time.Now().Format(time.RFC3339),
+	}
+
+	for name, content := range files {
+		path := filepath.Join(stateDir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeStateFile(stateDir, name, content string) error {
+	path := filepath.Join(stateDir, name)
+	return os.WriteFile(path, []byte(content), 0644)
+}
+
+func readStateFile(stateDir, name string) (string, error) {
+	path := filepath.Join(stateDir, name)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// writeStateList saves a list of paths, each terminated by a NUL so that
+// any character, newlines included, can appear in a path
+func writeStateList(stateDir, name string, paths []string) error {
+	var b strings.Builder
+	for _, path := range paths {
+		b.WriteString(path)
+		b.WriteByte(0)
+	}
+	return writeStateFile(stateDir, name, b.String())
+}
+
+// readStateList reads a list saved by writeStateList. Sessions started by
+// older versions saved one path per line.
+func readStateList(stateDir, name string) ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(stateDir, name))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.ContainsRune(data, 0) {
+		data = bytes.ReplaceAll(bytes.TrimSpace(data), []byte("\n"), []byte{0})
+	}
+	return splitNul(data), nil
+}
+
+// sessionState is the state of an in-progress session as saved on disk
+type sessionState struct {
+	target        string
+	origHead      string
+	targetSHA     string
+	currentBranch string
+	base          string // Recorded since --base; may be empty for older sessions
+	baseRef       string // Only set with --base
+	prefix        string // Only set with --prefix
+	unrelated     bool   // --allow-unrelated-histories; base is empty
+	diffAlgorithm string // Only set with --diff-algorithm
+}
+
+// loadAutoMerged reads the files the trial merge resolved by itself, as
+// recorded by getAutoMergedFiles when the session started
+func loadAutoMerged(stateDir string) (map[string]string, error) {
+	content, err := readStateFile(stateDir, "automerged")
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]string)
+	for _, line := range strings.Split(content, "\n") {
+		sha, file, ok := strings.Cut(line, "\t")
+		if !ok {
+			continue
+		}
+		if sha == "-" {
+			sha = ""
+		}
+		files[file] = sha
+	}
+	return files, nil
+}
+
+// loadState reads the session state, failing with a pointer to 'clean' when
+// a required file is missing, e.g. after a crash while the state was saved
+func loadState(stateDir string) (*sessionState, error) {
+	state := &sessionState{}
+	required := []struct {
+		name  string
+		value *string
+	}{
+		{"target", &state.target},
+		{"orig_head", &state.origHead},
+		{"target_sha", &state.targetSHA},
+		{"current_branch", &state.currentBranch},
+	}
+	for _, field := range required {
+		value, err := readStateFile(stateDir, field.name)
+		if err != nil || value == "" {
+			return nil, fmt.Errorf("anticipate state is incomplete or corrupt (missing %s)\nRun 'git anticipate clean' to reset it", field.name)
+		}
+		*field.value = value
+	}
+	state.base, _ = readStateFile(stateDir, "base")
+	state.baseRef, _ = readStateFile(stateDir, "base_ref")
+	state.prefix, _ = readStateFile(stateDir, "prefix")
+	unrelated, _ := readStateFile(stateDir, "unrelated")
+	state.unrelated = unrelated == "true"
+	state.diffAlgorithm, _ = readStateFile(stateDir, "diff_algorithm")
+	return state, nil
+}
+
+// cleanState removes the session state without touching the working tree
+func cleanState(stateDir string) error {
+	if !isAnticipateInProgress(stateDir) {
+		printf("No anticipate state to clean.\n")
+		return nil
+	}
+	removeState(stateDir)
+	printf("✔ Removed anticipate state\n")
+	if isMergeInProgress() {
+		printf("A merge is still in progress; run 'git merge --abort' to end it.\n")
+	}
+	return nil
+}
+
+// lockContinue takes the --continue lock in stateDir, failing if another
+// run holds it. The returned function releases it.
+func lockContinue(stateDir string) (func(), error) {
+	path := filepath.Join(stateDir, "continue.lock")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if os.IsNotExist(err) {
+		// The state went away since the check: another run just finished
+		return nil, fmt.Errorf("no anticipate in progress")
+	}
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("another 'git anticipate --continue' is running\nIf none is, a previous run was interrupted; remove %s and try again", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock the session: %w", err)
+	}
+	fmt.Fprintf(f, "%d\n", os.Getpid())
+	f.Close()
+	return func() { os.Remove(path) }, nil
+}
+
+func removeState(stateDir string) {
+	os.RemoveAll(stateDir)
+}
+
+// === Metrics ===
+
+// sessionMetrics is a single line of the --metrics-file log
+type sessionMetrics struct {
+	Timestamp     string  `json:"timestamp"`
+	Target        string  `json:"target"`
+	CurrentBranch string  `json:"current_branch"`
+	Conflicts     int     `json:"conflicts"`
+	FilesChanged  int     `json:"files_changed"`
+	Duration      float64 `json:"duration_seconds"`
+	Outcome       string  `json:"outcome"`
+}
+
+// recordMetrics appends a metrics line for the session in stateDir. It is
+// best-effort: failures are reported as warnings and never fail the command.
+func recordMetrics(metricsFile, stateDir, outcome string, filesChanged int) {
+	if metricsFile == "" {
+		return
+	}
+
+	target, _ := readStateFile(stateDir, "target")
+	currentBranch, _ := readStateFile(stateDir, "current_branch")
+	conflicts, _ := readStateList(stateDir, "conflicts")
+
+	m := sessionMetrics{
+		Timestamp:     time.Now().Format(time.RFC3339),
+		Target:        target,
+		CurrentBranch: currentBranch,
+		FilesChanged:  filesChanged,
+		Outcome:       outcome,
+		Conflicts:     len(conflicts),
+	}
+	if startedAt, err := readStateFile(stateDir, "started_at"); err == nil {
+		if start, err := time.Parse(time.RFC3339, startedAt); err == nil {
+			m.Duration = time.Since(start).Seconds()
+		}
+	}
+
+	line, err := json.Marshal(m)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to encode metrics: %v\n", err)
+		return
+	}
+
+	f, err := os.OpenFile(metricsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to write metrics: %v\n", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to write metrics: %v\n", err)
+	}
+}
+
+// === History ===
+
+// historyFile lives next to the state directory so it survives removeState
+const historyFile = "anticipate-history"
+
+// recordHistory appends a line for the finished session in stateDir to the
+// history log. commit is the resulting commit, or empty if none was made.
+// Like recordMetrics it is best-effort.
+func recordHistory(stateDir, outcome, commit string) {
+	target, _ := readStateFile(stateDir, "target")
+	currentBranch, _ := readStateFile(stateDir, "current_branch")
+	if commit == "" {
+		commit = "-"
+	}
+
+	// Format: <timestamp>\t<outcome>\t<target>\t<current branch>\t<commit>
+	line := strings.Join([]string{time.Now().Format(time.RFC3339), outcome, target, currentBranch, commit}, "\t")
+
+	path := filepath.Join(filepath.Dir(stateDir), historyFile)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to write history: %v\n", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.WriteString(line + "\n"); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to write history: %v\n", err)
+	}
+}
+
+// showHistory prints the history log, oldest first
+func showHistory(stateDir string) error {
+	content, err := os.ReadFile(filepath.Join(filepath.Dir(stateDir), historyFile))
+	if os.IsNotExist(err) || (err == nil && len(content) == 0) {
+		printf("No anticipate history yet.\n")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read history: %w", err)
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 5 {
+			continue
+		}
+		printf("%s  %-8s  %s -> %s  %s\n", fields[0], fields[1], fields[3], fields[2], truncateSHA(fields[4]))
+	}
+	return nil
+}
+
+// === Git Operations ===
+
+// gitProgram is the git executable, overridable with --git or GIT_ANTICIPATE_GIT
+var gitProgram = "git"
+
+// gitCommand builds a git invocation; all git calls go through here
+func gitCommand(args ...string) *exec.Cmd {
+	return exec.Command(gitProgram, args...)
+}
+
+// pathspecCommand is gitCommand for a command that takes a list of paths,
+// which must not be empty. The paths are passed on stdin, NUL-separated and
+// as literal pathspecs, so there is no limit on how many there are and no
+// character in them is special.
+func pathspecCommand(paths []string, args ...string) *exec.Cmd {
+	var input bytes.Buffer
+	for _, path := range paths {
+		input.WriteString(literalPath(path))
+		input.WriteByte(0)
+	}
+	cmd := gitCommand(append(append([]string{}, args...), "--pathspec-from-file=-", "--pathspec-file-nul")...)
+	cmd.Stdin = &input
+	return cmd
+}
+
+// literalPath turns a path into a pathspec that matches only that path;
+// otherwise git treats *, ? and [ in it as wildcards
+func literalPath(path string) string {
+	return ":(literal)" + path
+}
+
+// dubiousOwnershipPattern matches the error of Git 2.35.2+ for a repository
+// owned by another user, capturing its path
+var dubiousOwnershipPattern = regexp.MustCompile(`dubious ownership in repository at '([^']+)'`)
+
+func validateRepo() error {
+	cmd := gitCommand("rev-parse", "--git-dir")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// Common on CI runners, where the checkout belongs to another user
+		if match := dubiousOwnershipPattern.FindStringSubmatch(stderr.String()); match != nil {
+			return fmt.Errorf("git refuses to work in %s because it is owned by another user\nIf you trust this repository, mark it safe with:\n  git config --global --add safe.directory %s", match[1], shellQuote(match[1]))
+		}
+		return fmt.Errorf("not a git repository")
+	}
+	return nil
+}
+
+func getGitDir() (string, error) {
+	cmd := gitCommand("rev-parse", "--git-dir")
+	output, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// isProtectedBranch reports whether branch matches one of the patterns in
+// anticipate.protectedBranches (multi-valued, or separated by spaces or
+// commas) or in extra
+func isProtectedBranch(branch string, extra []string) bool {
+	patterns := append([]string{}, extra...)
+	if output, err := gitCommand("config", "--get-all", "anticipate.protectedBranches").Output(); err == nil {
+		patterns = append(patterns, strings.FieldsFunc(string(output), func(r rune) bool {
+			return r == ',' || unicode.IsSpace(r)
+		})...)
+	}
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, branch); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// useScratchIndex points git at a copy of the index for the rest of the
+// run. The returned function switches back and removes the copy.
+func useScratchIndex() (func(), error) {
+	output, err := gitCommand("rev-parse", "--git-path", "index").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate the index: %w", err)
+	}
+	data, err := os.ReadFile(strings.TrimSpace(string(output)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the index: %w", err)
+	}
+	scratch, err := os.CreateTemp("", "anticipate-index-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy the index: %w", err)
+	}
+	_, err = scratch.Write(data)
+	if closeErr := scratch.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(scratch.Name())
+		return nil, fmt.Errorf("failed to copy the index: %w", err)
+	}
+
+	previous, hadPrevious := os.LookupEnv("GIT_INDEX_FILE")
+	os.Setenv("GIT_INDEX_FILE", scratch.Name())
+	return func() {
+		if hadPrevious {
+			os.Setenv("GIT_INDEX_FILE", previous)
+		} else {
+			os.Unsetenv("GIT_INDEX_FILE")
+		}
+		os.Remove(scratch.Name())
+	}, nil
+}
+
+// getConfig returns a git config value, or "" when it is unset
+func getConfig(key string) string {
+	output, err := gitCommand("config", "--get", key).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// countCommits returns the number of commits in a revision range, or 0 if
+// it cannot be counted
+func countCommits(revRange string) int {
+	output, err := gitCommand("rev-list", "--count", revRange).Output()
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(string(output)))
+	return n
+}
+
+// resolveRefName turns a revision shorthand such as @{upstream} into the
+// short name of the ref it points at
+func resolveRefName(rev string) (string, error) {
+	cmd := gitCommand("rev-parse", "--abbrev-ref", rev)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", errors.New(strings.TrimPrefix(strings.TrimSpace(stderr.String()), "fatal: "))
+	}
+	name := strings.TrimSpace(string(output))
+	if name == "" || name == "HEAD" {
+		// Not a branch (e.g. a detached previous checkout); use it as given
+		return rev, nil
+	}
+	return name, nil
+}
+
+// defaultTarget is the branch to anticipate against when none is given:
+// anticipate.defaultTarget if set, then what origin/HEAD points at, then a
+// local main or master. It is "" when none of them exist.
+func defaultTarget() string {
+	if target := getConfig("anticipate.defaultTarget"); target != "" {
+		return target
+	}
+	if output, err := gitCommand("symbolic-ref", "-q", "--short", "refs/remotes/origin/HEAD").Output(); err == nil {
+		return strings.TrimSpace(string(output))
+	}
+	for _, branch := range []string{"main", "master"} {
+		if validateBranchExists("refs/heads/"+branch) == nil {
+			return branch
+		}
+	}
+	return ""
+}
+
+func validateBranchExists(branch string) error {
+	cmd := gitCommand("rev-parse", "--verify", branch)
+	return cmd.Run()
+}
+
+// suggestBranch returns the local branch closest to name by edit distance,
+// or "" if none is close enough to be a likely typo
+func suggestBranch(name string) string {
+	cmd := gitCommand("for-each-ref", "--format=%(refname:short)", "refs/heads")
+	output, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+
+	maxDistance := len(name) / 4
+	if maxDistance < 2 {
+		maxDistance = 2
+	}
+
+	best := ""
+	bestDistance := maxDistance + 1
+	for _, branch := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if branch == "" {
+			continue
+		}
+		if d := levenshtein(name, branch); d < bestDistance {
+			best = branch
+			bestDistance = d
+		}
+	}
+	return best
+}
+
+// levenshtein computes the edit distance between two strings
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+// checkHasCommits fails with a clear message on an unborn branch, where
+// HEAD names a branch that has no commits yet
+func checkHasCommits() error {
+	if gitCommand("rev-parse", "-q", "--verify", "HEAD").Run() != nil && gitCommand("symbolic-ref", "-q", "HEAD").Run() == nil {
+		return fmt.Errorf("repository has no commits yet; nothing to anticipate\nCommit something first, then run git anticipate again")
 	}
+	return nil
+}
 
-	// Read state
-	targetBranch, err := readStateFile(stateDir, "target")
+// unbornBranch returns the branch HEAD points at when it has no commits
+// yet, e.g. after 'git checkout --orphan'
+func unbornBranch() (string, bool) {
+	if gitCommand("rev-parse", "-q", "--verify", "HEAD").Run() == nil {
+		return "", false
+	}
+	output, err := gitCommand("symbolic-ref", "-q", "--short", "HEAD").Output()
 	if err != nil {
-		return fmt.Errorf("failed to read target branch: %w", err)
+		return "", false
 	}
+	return strings.TrimSpace(string(output)), true
+}
 
-	targetSHA, err := readStateFile(stateDir, "target_sha")
+func getCurrentBranch() (string, error) {
+	cmd := gitCommand("rev-parse", "--abbrev-ref", "HEAD")
+	output, err := cmd.Output()
 	if err != nil {
-		return fmt.Errorf("failed to read target SHA: %w", err)
+		return "", err
 	}
+	return strings.TrimSpace(string(output)), nil
+}
 
-	currentBranch, err := readStateFile(stateDir, "current_branch")
+func getRevisionSHA(revision string) (string, error) {
+	cmd := gitCommand("rev-parse", revision)
+	output, err := cmd.Output()
 	if err != nil {
-		return fmt.Errorf("failed to read current branch: %w", err)
+		return "", err
 	}
+	return strings.TrimSpace(string(output)), nil
+}
 
-	origHead, err := readStateFile(stateDir, "orig_head")
+func getMergeBase(branch1, branch2 string) (string, error) {
+	cmd := gitCommand("merge-base", branch1, branch2)
+	output, err := cmd.Output()
 	if err != nil {
-		return fmt.Errorf("failed to read original HEAD: %w", err)
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// resolveMergeBase finds the merge base of two revisions. In a shallow clone
+// the base is often missing from the truncated history, so the history is
+// deepened once before giving up with an actionable error.
+func resolveMergeBase(branch1, branch2 string, deepen int) (string, error) {
+	baseSHA, err := getMergeBase(branch1, branch2)
+	if err == nil {
+		return baseSHA, nil
+	}
+	if !isShallowRepo() {
+		return "", fmt.Errorf("failed to get merge base: %w", err)
 	}
 
-	fmt.Printf("🚀 git-anticipate: Applying resolution\n\n")
+	if deepen > 0 {
+		printf("Shallow clone: merge base not found, deepening history by %d commits...\n", deepen)
+		fetchCmd := gitCommand("fetch", fmt.Sprintf("--deepen=%d", deepen))
+		if output, fetchErr := fetchCmd.CombinedOutput(); fetchErr != nil {
+			fmt.Fprintf(os.Stderr, "Warning: git fetch --deepen failed: %s\n", strings.TrimSpace(string(output)))
+		} else if baseSHA, err = getMergeBase(branch1, branch2); err == nil {
+			return baseSHA, nil
+		}
+	}
 
-	// Stage all changes (in case user only did git add for some files)
-	stageCmd := exec.Command("git", "add", "-u")
-	stageCmd.Run()
+	return "", fmt.Errorf("merge base not found: this is a shallow clone and the common history is missing\nRun 'git fetch --unshallow' (or retry with a larger --deepen) and try again")
+}
 
-	// Get list of files that have changes (staged)
-	changedFilesCmd := exec.Command("git", "diff", "--cached", "--name-only")
-	changedFilesOutput, err := changedFilesCmd.Output()
+func isShallowRepo() bool {
+	cmd := gitCommand("rev-parse", "--is-shallow-repository")
+	output, err := cmd.Output()
 	if err != nil {
-		return fmt.Errorf("failed to get changed files: %w", err)
+		return false
 	}
+	return strings.TrimSpace(string(output)) == "true"
+}
 
-	changedFiles := []string{}
-	for _, f := range strings.Split(strings.TrimSpace(string(changedFilesOutput)), "\n") {
-		if f != "" {
-			changedFiles = append(changedFiles, f)
-		}
+func truncateSHA(sha string) string {
+	sha = strings.TrimSpace(sha)
+	if len(sha) > 8 {
+		return sha[:8]
+	}
+	if len(sha) == 0 {
+		return "unknown"
 	}
+	return sha
+}
 
-	// Check if there's anything to commit
-	if len(changedFiles) == 0 {
-		fmt.Printf("✨ No changes to commit - branches are compatible!\n")
-		abortMerge()
-		removeState(stateDir)
-		return nil
+// getStagedChanges lists the paths staged relative to HEAD and which of them
+// are deletions. Renames are detected so the source path of a rename is
+// reported as deleted and the destination as changed.
+func getStagedChanges() ([]string, map[string]bool, error) {
+	cmd := gitCommand("diff", "--cached", "--name-status", "-M", "-z")
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// Get list of deleted files separately
-	deletedFilesCmd := exec.Command("git", "diff", "--cached", "--name-only", "--diff-filter=D")
-	deletedFilesOutput, _ := deletedFilesCmd.Output()
+	// Format: <status>\0<path>\0, with a second path after renames and copies
+	changedFiles := []string{}
 	deletedFiles := make(map[string]bool)
-	for _, f := range strings.Split(strings.TrimSpace(string(deletedFilesOutput)), "\n") {
-		if f != "" {
-			deletedFiles[f] = true
+	fields := splitNul(output)
+	for i := 0; i+1 < len(fields); i += 2 {
+		status, path := fields[i], fields[i+1]
+		switch {
+		case (strings.HasPrefix(status, "R") || strings.HasPrefix(status, "C")) && i+2 < len(fields):
+			dest := fields[i+2]
+			i++
+			if status[0] == 'C' {
+				// Copy: source is untouched, only the destination is new
+				changedFiles = append(changedFiles, dest)
+				continue
+			}
+			// Rename: old path goes away, new path carries the content
+			changedFiles = append(changedFiles, path, dest)
+			deletedFiles[path] = true
+		case status == "D":
+			changedFiles = append(changedFiles, path)
+			deletedFiles[path] = true
+		default:
+			changedFiles = append(changedFiles, path)
 		}
 	}
+	return changedFiles, deletedFiles, nil
+}
 
-	fmt.Printf("✔ Extracting resolution (%d files)...\n", len(changedFiles))
-
-	// Save the content of all changed files BEFORE aborting merge
-	// (skip deleted files - we'll handle them separately)
-	fileContents := make(map[string][]byte)
-	for _, file := range changedFiles {
-		if deletedFiles[file] {
-			continue // Skip deleted files
-		}
-		content, err := os.ReadFile(file)
-		if err != nil {
-			return fmt.Errorf("failed to read resolved file %s: %w", file, err)
+// splitNul splits the output of a git command run with -z into its paths,
+// which are neither quoted nor limited in the characters they contain
+func splitNul(output []byte) []string {
+	paths := []string{}
+	for _, path := range strings.Split(string(output), "\x00") {
+		if path != "" {
+			paths = append(paths, path)
 		}
-		fileContents[file] = content
 	}
+	return paths
+}
 
-	// Abort the merge
-	abortMerge()
+// emptyTreeSHA returns the ID of the empty tree in this repository's hash
+func emptyTreeSHA() string {
+	cmd := gitCommand("hash-object", "-t", "tree", "--stdin")
+	cmd.Stdin = strings.NewReader("")
+	output, _ := cmd.Output()
+	return strings.TrimSpace(string(output))
+}
 
-	// Reset to original HEAD to ensure clean state
-	resetCmd := exec.Command("git", "reset", "--hard", origHead)
-	if err := resetCmd.Run(); err != nil {
-		return fmt.Errorf("failed to reset to original state: %w", err)
+// getMergeAffectedFiles returns the paths the target changed since the merge
+// base, i.e. every file the trial merge could have touched. With a subtree
+// prefix the paths are moved under it.
+func getMergeAffectedFiles(baseSHA, targetSHA, prefix string) (map[string]bool, error) {
+	cmd := gitCommand("diff", "--name-only", "--no-renames", "-z", baseSHA, targetSHA)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]bool)
+	for _, file := range splitNul(output) {
+		if prefix != "" {
+			file = prefix + "/" + file
+		}
+		files[file] = true
 	}
+	return files, nil
+}
 
-	// Write back the resolved file contents
-	fmt.Printf("✔ Applying resolution to %s...\n", currentBranch)
-	for file, content := range fileContents {
-		// Ensure directory exists
-		dir := filepath.Dir(file)
-		if dir != "." {
-			os.MkdirAll(dir, 0755)
+// getAutoMergedFiles returns the files the trial merge changed without a
+// conflict, with the blob it staged for each ("" when it deleted the file)
+func getAutoMergedFiles() (map[string]string, error) {
+	cmd := gitCommand("diff", "--cached", "--raw", "--no-abbrev", "--no-renames", "-z", "HEAD")
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	// Format: :<mode> <mode> <sha> <sha> <status>\0<path>\0
+	files := make(map[string]string)
+	fields := strings.Split(string(output), "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		meta := strings.Fields(fields[i])
+		if len(meta) != 5 {
+			continue
 		}
-		if err := os.WriteFile(file, content, 0644); err != nil {
-			return fmt.Errorf("failed to write resolved file %s: %w", file, err)
+		switch meta[4] {
+		case "U":
+			// Conflicted; unmerged paths are listed once more, so skip them
+		case "D":
+			files[fields[i+1]] = ""
+		default:
+			files[fields[i+1]] = meta[3]
 		}
 	}
+	return files, nil
+}
 
-	// Handle deleted files - remove them
-	for file := range deletedFiles {
-		os.Remove(file) // Ignore errors - file might not exist
+// getUntrackedFiles lists untracked files, honoring .gitignore
+func getUntrackedFiles() []string {
+	cmd := gitCommand("ls-files", "--others", "--exclude-standard", "-z")
+	output, err := cmd.Output()
+	if err != nil {
+		return []string{}
 	}
+	return splitNul(output)
+}
 
-	// Stage all the changed files
-	for _, file := range changedFiles {
-		if deletedFiles[file] {
-			// For deleted files, use git rm
-			rmCmd := exec.Command("git", "rm", "--cached", "--ignore-unmatch", file)
-			rmCmd.Run()
-		} else {
-			addCmd := exec.Command("git", "add", file)
-			if err := addCmd.Run(); err != nil {
-				return fmt.Errorf("failed to stage file %s: %w", file, err)
-			}
-		}
+// getUnstagedFiles lists tracked files whose working-tree content differs
+// from the index
+func getUnstagedFiles() []string {
+	cmd := gitCommand("diff", "--name-only", "-z")
+	output, err := cmd.Output()
+	if err != nil {
+		return []string{}
 	}
+	return splitNul(output)
+}
 
-	// Create commit
-	commitMsg := fmt.Sprintf("Preemptive conflict resolution vs %s@%s", targetBranch, truncateSHA(targetSHA))
-	fmt.Printf("✔ Creating commit...\n")
-
-	commitArgs := []string{"commit", "-m", commitMsg}
-	if noVerify {
-		commitArgs = append(commitArgs, "--no-verify")
+// getIgnoredFiles returns which of files are excluded by .gitignore, asking
+// git about all of them at once
+func getIgnoredFiles(files []string) map[string]bool {
+	ignored := make(map[string]bool)
+	if len(files) == 0 {
+		return ignored
 	}
-	commitCmd := exec.Command("git", commitArgs...)
-	commitCmd.Stdout = os.Stdout
-	commitCmd.Stderr = os.Stderr
-	if err := commitCmd.Run(); err != nil {
-		return fmt.Errorf("failed to create commit: %w\n\nTip: If pre-commit hooks are failing, you can:\n  1. Fix the issues and run 'git anticipate --continue' again\n  2. Or run 'git anticipate --continue --no-verify' to skip hooks", err)
+	var input bytes.Buffer
+	for _, file := range files {
+		input.WriteString(file)
+		input.WriteByte(0)
 	}
-
-	// Clean up state
-	removeState(stateDir)
-
-	fmt.Printf("\n✨ Success! Resolution committed to %s\n", currentBranch)
-	fmt.Printf("Your branch is now prepared for merging into %s\n", targetBranch)
-
-	return nil
+	cmd := gitCommand("check-ignore", "--stdin", "-z")
+	cmd.Stdin = &input
+	// Exits with 1 when none of the files is ignored
+	output, _ := cmd.Output()
+	for _, file := range splitNul(output) {
+		ignored[file] = true
+	}
+	return ignored
 }
 
-// abortAnticipate aborts the current anticipate session
-func abortAnticipate(stateDir string) error {
-	if !isAnticipateInProgress(stateDir) {
-		return fmt.Errorf("no anticipate in progress")
+// readIndexFile returns the staged (stage 0) content of a file
+func readIndexFile(file string) ([]byte, error) {
+	cmd := gitCommand("show", ":"+file)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s from index: %w", file, err)
 	}
+	return output, nil
+}
 
-	fmt.Printf("🚀 git-anticipate: Aborting\n\n")
-
-	// Abort any merge in progress
-	abortMerge()
-
-	// Read original HEAD
-	origHead, err := readStateFile(stateDir, "orig_head")
+// hashFiles writes the working-tree files to the object store as they are,
+// without clean filters, and returns their blob IDs in the same order
+func hashFiles(files []string) ([]string, error) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+	hashCmd := gitCommand("hash-object", "-w", "--no-filters", "--stdin-paths")
+	hashCmd.Stdin = strings.NewReader(stdinPaths(files))
+	output, err := hashCmd.Output()
 	if err != nil {
-		return fmt.Errorf("failed to read original HEAD: %w", err)
+		return nil, err
 	}
-
-	// Reset to original HEAD
-	fmt.Printf("✔ Restoring original state...\n")
-	resetCmd := exec.Command("git", "reset", "--hard", origHead)
-	if err := resetCmd.Run(); err != nil {
-		return fmt.Errorf("failed to reset to original state: %w", err)
+	shas := strings.Fields(string(output))
+	if len(shas) != len(files) {
+		return nil, fmt.Errorf("git hash-object returned %d IDs for %d files", len(shas), len(files))
 	}
-
-	// Clean up state
-	removeState(stateDir)
-
-	fmt.Printf("✔ Anticipate aborted. Restored to original state.\n")
-	return nil
+	return shas, nil
 }
 
-// showStatus shows the current anticipate status
-func showStatus(stateDir string) error {
-	if !isAnticipateInProgress(stateDir) {
-		fmt.Printf("No anticipate in progress.\n\n")
-		fmt.Printf("Usage: git anticipate <target-branch>\n")
-		return nil
+// stdinPaths formats paths for git hash-object --stdin-paths, one per line.
+// A path that would not survive as a line (it contains a line break, or
+// starts with a quote) is C-quoted, which git unquotes.
+func stdinPaths(paths []string) string {
+	var b strings.Builder
+	for _, path := range paths {
+		if !strings.ContainsAny(path, "\n\r") && !strings.HasPrefix(path, `"`) {
+			b.WriteString(path)
+			b.WriteByte('\n')
+			continue
+		}
+		b.WriteByte('"')
+		for i := 0; i < len(path); i++ {
+			switch c := path[i]; {
+			case c == '"' || c == '\\':
+				b.WriteByte('\\')
+				b.WriteByte(c)
+			case c < 0x20 || c == 0x7f:
+				fmt.Fprintf(&b, "\\%03o", c)
+			default:
+				b.WriteByte(c)
+			}
+		}
+		b.WriteString("\"\n")
 	}
+	return b.String()
+}
 
-	targetBranch, _ := readStateFile(stateDir, "target")
-	currentBranch, _ := readStateFile(stateDir, "current_branch")
-	origHead, _ := readStateFile(stateDir, "orig_head")
-
-	fmt.Printf("🚀 git-anticipate: In Progress\n\n")
-	fmt.Printf("Current branch:  %s\n", currentBranch)
-	fmt.Printf("Target branch:   %s\n", targetBranch)
-	fmt.Printf("Original HEAD:   %s\n", truncateSHA(origHead))
-	fmt.Printf("\n")
-
-	// Check for conflicts
-	if hasUnmergedFiles() {
-		conflictFiles := getConflictingFiles()
-		fmt.Printf("⚠️  Unresolved conflicts (%d):\n", len(conflictFiles))
-		for _, file := range conflictFiles {
-			fmt.Printf("    ❌ %s\n", file)
+// filesHoldingBlobs returns which files are already regular files with the
+// content of their blob, and with the executable bit of their mode when
+// modes is given. Nothing is written to the object store.
+func filesHoldingBlobs(blobs map[string]string, modes map[string]os.FileMode) map[string]bool {
+	candidates := []string{}
+	for file, sha := range blobs {
+		info, err := os.Lstat(file)
+		if sha == "" || err != nil || !info.Mode().IsRegular() {
+			continue
 		}
-		fmt.Printf("\nResolve conflicts, then:\n")
-		fmt.Printf("  git add <resolved-files>\n")
-		fmt.Printf("  git anticipate --continue\n")
-	} else {
-		fmt.Printf("✔ All conflicts resolved!\n")
-		fmt.Printf("\nRun 'git anticipate --continue' to apply resolution\n")
+		if modes != nil && info.Mode().Perm()&0100 != modes[file]&0100 {
+			continue
+		}
+		candidates = append(candidates, file)
 	}
-
-	fmt.Printf("\nOr run 'git anticipate --abort' to cancel\n")
-	return nil
+	holding := make(map[string]bool)
+	if len(candidates) == 0 {
+		return holding
+	}
+	hashCmd := gitCommand("hash-object", "--no-filters", "--stdin-paths")
+	hashCmd.Stdin = strings.NewReader(stdinPaths(candidates))
+	output, err := hashCmd.Output()
+	if err != nil {
+		return holding
+	}
+	shas := strings.Fields(string(output))
+	if len(shas) != len(candidates) {
+		return holding
+	}
+	for i, file := range candidates {
+		if shas[i] == blobs[file] {
+			holding[file] = true
+		}
+	}
+	return holding
 }
 
-// === State Management ===
-
-func isAnticipateInProgress(stateDir string) bool {
-	_, err := os.Stat(stateDir)
-	return err == nil
+// blobReader streams blobs out of the object store through a single
+// git cat-file --batch process, however many files are written back
+type blobReader struct {
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	stdout  *bufio.Reader
+	pending *io.LimitedReader // Content of the last blob not read yet
 }
 
-func saveState(stateDir, targetBranch, origHead, targetSHA, currentBranch string) error {
-	if err := os.MkdirAll(stateDir, 0755); err != nil {
-		return err
+func newBlobReader() (*blobReader, error) {
+	cmd := gitCommand("cat-file", "--batch")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
 	}
-
-	files := map[string]string{
-		"target":         targetBranch,
-		"orig_head":      origHead,
-		"target_sha":     targetSHA,
-		"current_branch": currentBranch,
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
 	}
+	return &blobReader{cmd: cmd, stdin: stdin, stdout: bufio.NewReader(stdout)}, nil
+}
 
-	for name, content := range files {
-		path := filepath.Join(stateDir, name)
-		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
-			return err
+// open returns a reader over the content of blob sha, valid until the
+// next call
+func (r *blobReader) open(sha string) (io.Reader, error) {
+	// Skip whatever the caller left of the previous blob
+	if r.pending != nil {
+		if _, err := io.Copy(io.Discard, r.pending); err != nil {
+			return nil, err
+		}
+		if _, err := r.stdout.Discard(1); err != nil {
+			return nil, err
 		}
+		r.pending = nil
 	}
-
-	return nil
+	if _, err := fmt.Fprintln(r.stdin, sha); err != nil {
+		return nil, err
+	}
+	// Format: <sha> <type> <size>\n<content>\n, or <sha> missing\n
+	header, err := r.stdout.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(header)
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("object %s is missing", sha)
+	}
+	size, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected cat-file output: %q", header)
+	}
+	r.pending = &io.LimitedReader{R: r.stdout, N: size}
+	return r.pending, nil
 }
 
-func readStateFile(stateDir, name string) (string, error) {
-	path := filepath.Join(stateDir, name)
-	data, err := os.ReadFile(path)
+// writeBlob streams a blob from the object store into file, byte for byte
+func (r *blobReader) writeBlob(file, sha string, mode os.FileMode) error {
+	content, err := r.open(sha)
 	if err != nil {
-		return "", err
+		return err
 	}
-	return strings.TrimSpace(string(data)), nil
+	// A new file gets mode less the umask, as in a git checkout; an
+	// existing one keeps its permissions
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, content); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
 
-func removeState(stateDir string) {
-	os.RemoveAll(stateDir)
+// Close ends the cat-file process
+func (r *blobReader) Close() error {
+	r.stdin.Close()
+	return r.cmd.Wait()
 }
 
-// === Git Operations ===
+// withExecBit sets or clears the executable bits of perm. Setting gives
+// execute permission to whoever can read the file.
+func withExecBit(perm os.FileMode, executable bool) os.FileMode {
+	if executable {
+		return perm | (perm&0444)>>2
+	}
+	return perm &^ 0111
+}
 
-func validateRepo() error {
-	cmd := exec.Command("git", "rev-parse", "--git-dir")
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("not a git repository")
+// preparePath makes room for writing file: leading path components that are
+// not directories (a file the resolution turned into a directory) are
+// removed, as is whatever is at file itself, so a symlink can replace a
+// file and vice versa. A directory that still has content is left alone and
+// the write fails.
+func preparePath(file string) error {
+	dir := filepath.Dir(file)
+	if dir != "." {
+		parts := strings.Split(dir, string(filepath.Separator))
+		for i := range parts {
+			prefix := filepath.Join(parts[:i+1]...)
+			if info, err := os.Lstat(prefix); err == nil && !info.IsDir() {
+				if err := os.Remove(prefix); err != nil {
+					return err
+				}
+			}
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Lstat(file); err == nil {
+		return os.Remove(file)
 	}
 	return nil
 }
 
-func getGitDir() (string, error) {
-	cmd := exec.Command("git", "rev-parse", "--git-dir")
-	output, err := cmd.Output()
-	if err != nil {
-		return "", err
+// removeEmptyParents removes the directories above a deleted file that it
+// left empty
+func removeEmptyParents(file string) {
+	for dir := filepath.Dir(file); dir != "."; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
 	}
-	return strings.TrimSpace(string(output)), nil
 }
 
-func validateBranchExists(branch string) error {
-	cmd := exec.Command("git", "rev-parse", "--verify", branch)
-	return cmd.Run()
+// indexEntry is a stage-0 index entry for a path that is not checked out
+type indexEntry struct {
+	mode string
+	sha  string
 }
 
-func getCurrentBranch() (string, error) {
-	cmd := exec.Command("git", "rev-parse", "--abbrev-ref", "HEAD")
+// getSkipWorktreeFiles returns tracked paths marked skip-worktree, such as
+// files outside the sparse-checkout cone
+func getSkipWorktreeFiles() map[string]bool {
+	files := make(map[string]bool)
+	cmd := gitCommand("ls-files", "-t", "-z")
 	output, err := cmd.Output()
 	if err != nil {
-		return "", err
+		return files
 	}
-	return strings.TrimSpace(string(output)), nil
+	for _, record := range splitNul(output) {
+		if path, ok := strings.CutPrefix(record, "S "); ok {
+			files[path] = true
+		}
+	}
+	return files
 }
 
-func getRevisionSHA(revision string) (string, error) {
-	cmd := exec.Command("git", "rev-parse", revision)
-	output, err := cmd.Output()
+// getIndexEntries reads the whole index in one go, keyed by path. A path
+// with conflict stages gets its first entry.
+func getIndexEntries() map[string]indexEntry {
+	entries := make(map[string]indexEntry)
+	output, err := gitCommand("ls-files", "-s", "-z").Output()
 	if err != nil {
-		return "", err
+		return entries
 	}
-	return strings.TrimSpace(string(output)), nil
+	// Format: <mode> <sha> <stage>\t<path>\0
+	for _, record := range splitNul(output) {
+		meta, path, _ := strings.Cut(record, "\t")
+		fields := strings.Fields(meta)
+		if _, seen := entries[path]; !seen && len(fields) == 3 {
+			entries[path] = indexEntry{mode: fields[0], sha: fields[1]}
+		}
+	}
+	return entries
 }
 
-func getMergeBase(branch1, branch2 string) (string, error) {
-	cmd := exec.Command("git", "merge-base", branch1, branch2)
+// restoreIndexEntry stages entry for file without touching the working tree
+func restoreIndexEntry(file string, entry indexEntry) error {
+	cacheinfo := entry.mode + "," + entry.sha + "," + file
+	return gitCommand("update-index", "--add", "--cacheinfo", cacheinfo).Run()
+}
+
+// getLFSFiles returns which of files are stored with Git LFS, going by the
+// filter attribute
+func getLFSFiles(files []string) map[string]bool {
+	lfs := make(map[string]bool)
+	if len(files) == 0 {
+		return lfs
+	}
+	var input bytes.Buffer
+	for _, file := range files {
+		input.WriteString(file)
+		input.WriteByte(0)
+	}
+	cmd := gitCommand("check-attr", "--stdin", "-z", "filter")
+	cmd.Stdin = &input
 	output, err := cmd.Output()
 	if err != nil {
-		return "", err
+		return lfs
 	}
-	return strings.TrimSpace(string(output)), nil
+	// Format: <path>\0filter\0<value>\0
+	fields := strings.Split(string(output), "\x00")
+	for i := 0; i+2 < len(fields); i += 3 {
+		if fields[i+2] == "lfs" {
+			lfs[fields[i]] = true
+		}
+	}
+	return lfs
 }
 
-func truncateSHA(sha string) string {
-	sha = strings.TrimSpace(sha)
-	if len(sha) > 8 {
-		return sha[:8]
-	}
-	if len(sha) == 0 {
-		return "unknown"
-	}
-	return sha
+func hasStagedChanges() bool {
+	return gitCommand("diff", "--cached", "--quiet").Run() != nil
 }
 
 func hasUncommittedChanges() bool {
-	cmd := exec.Command("git", "status", "--porcelain")
+	cmd := gitCommand("status", "--porcelain")
 	output, err := cmd.Output()
 	if err != nil {
 		return false
@@ -541,6 +4577,23 @@ func hasUncommittedChanges() bool {
 	return len(strings.TrimSpace(string(output))) > 0
 }
 
+func isMergeInProgress() bool {
+	cmd := gitCommand("rev-parse", "-q", "--verify", "MERGE_HEAD")
+	return cmd.Run() == nil
+}
+
+// isMergeOf reports whether revision is a merge commit with exactly the
+// given first and second parents
+func isMergeOf(revision, parent1, parent2 string) bool {
+	cmd := gitCommand("rev-list", "--parents", "-n", "1", revision)
+	output, err := cmd.Output()
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(output))
+	return len(fields) == 3 && fields[1] == parent1 && fields[2] == parent2
+}
+
 // MergeResult represents the outcome of a merge attempt
 type MergeResult int
 
@@ -550,8 +4603,20 @@ const (
 	MergeError                       // Merge failed for other reasons
 )
 
-func performMerge(targetBranch string) (MergeResult, error) {
-	cmd := exec.Command("git", "merge", targetBranch, "--no-commit", "--no-ff")
+// performMerge runs the trial merge. With a prefix the target is merged
+// into that subdirectory using the subtree strategy.
+func performMerge(targetBranch, prefix string, allowUnrelated bool, diffAlgorithm string) (MergeResult, error) {
+	args := []string{"merge", targetBranch, "--no-commit", "--no-ff"}
+	if prefix != "" {
+		args = append(args, "-s", "subtree", "-X", "subtree="+prefix)
+	}
+	if allowUnrelated {
+		args = append(args, "--allow-unrelated-histories")
+	}
+	if diffAlgorithm != "" {
+		args = append(args, "-X", "diff-algorithm="+diffAlgorithm)
+	}
+	cmd := gitCommand(args...)
 	output, err := cmd.CombinedOutput()
 
 	if err != nil {
@@ -565,7 +4630,7 @@ func performMerge(targetBranch string) (MergeResult, error) {
 }
 
 func hasUnmergedFiles() bool {
-	cmd := exec.Command("git", "ls-files", "-u")
+	cmd := gitCommand("ls-files", "-u")
 	output, err := cmd.Output()
 	if err != nil {
 		return false
@@ -573,23 +4638,35 @@ func hasUnmergedFiles() bool {
 	return len(strings.TrimSpace(string(output))) > 0
 }
 
+// getConflictingFiles lists the unmerged paths in the index
 func getConflictingFiles() []string {
-	cmd := exec.Command("git", "diff", "--name-only", "--diff-filter=U")
+	cmd := gitCommand("diff", "--name-only", "--diff-filter=U", "-z")
 	output, err := cmd.Output()
 	if err != nil {
 		return []string{}
 	}
+	return splitNul(output)
+}
 
-	files := []string{}
-	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
-		if line != "" {
-			files = append(files, line)
+// hasIndexStage reports whether an unmerged file has the given stage
+// ("1" base, "2" ours, "3" theirs) in the index
+func hasIndexStage(file, stage string) bool {
+	output, err := gitCommand("ls-files", "-u", "-z", "--", literalPath(file)).Output()
+	if err != nil {
+		return false
+	}
+	// Format: <mode> <sha> <stage>\t<path>\0
+	for _, record := range splitNul(output) {
+		meta, path, _ := strings.Cut(record, "\t")
+		fields := strings.Fields(meta)
+		if path == file && len(fields) == 3 && fields[2] == stage {
+			return true
 		}
 	}
-	return files
+	return false
 }
 
 func abortMerge() {
-	cmd := exec.Command("git", "merge", "--abort")
+	cmd := gitCommand("merge", "--abort")
 	cmd.Run() // Ignore errors - merge might not be in progress
 }
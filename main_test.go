@@ -1,11 +1,16 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
 // TestHelper provides utilities for setting up test git repos
@@ -63,6 +68,46 @@ func (h *TestHelper) RunExpectFailure(name string, args ...string) string {
 	return string(output)
 }
 
+// RunInDir runs a command from a subdirectory of the repo and returns its
+// output, logging failures like Run
+func (h *TestHelper) RunInDir(dir, name string, args ...string) string {
+	h.t.Helper()
+	cmd := exec.Command(name, args...)
+	cmd.Dir = filepath.Join(h.repoDir, dir)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		h.t.Logf("Command '%s %s' in %s failed: %v\nOutput: %s", name, strings.Join(args, " "), dir, err, output)
+	}
+	return string(output)
+}
+
+// RunExitCode runs a command and returns its output and exit code
+func (h *TestHelper) RunExitCode(name string, args ...string) (string, int) {
+	h.t.Helper()
+	cmd := exec.Command(name, args...)
+	cmd.Dir = h.repoDir
+	output, err := cmd.CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return string(output), exitErr.ExitCode()
+	} else if err != nil {
+		h.t.Fatalf("Command '%s %s' could not run: %v", name, strings.Join(args, " "), err)
+	}
+	return string(output), 0
+}
+
+// RunWithInput runs a command with the given text on stdin
+func (h *TestHelper) RunWithInput(input, name string, args ...string) string {
+	h.t.Helper()
+	cmd := exec.Command(name, args...)
+	cmd.Dir = h.repoDir
+	cmd.Stdin = strings.NewReader(input)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		h.t.Logf("Command '%s %s' failed: %v\nOutput: %s", name, strings.Join(args, " "), err, output)
+	}
+	return string(output)
+}
+
 func (h *TestHelper) WriteFile(path, content string) {
 	h.t.Helper()
 	fullPath := filepath.Join(h.repoDir, path)
@@ -144,6 +189,24 @@ func (h *TestHelper) CommitCount() int {
 	return count
 }
 
+// SetupConflict creates main, dev and feature branches that conflict on
+// file.txt and leaves feature checked out
+func (h *TestHelper) SetupConflict() {
+	h.t.Helper()
+	h.InitRepo()
+	h.WriteFile("file.txt", "original")
+	h.Commit("initial")
+
+	h.Branch("dev")
+	h.WriteFile("file.txt", "dev")
+	h.Commit("dev changes")
+
+	h.Checkout("main")
+	h.Branch("feature")
+	h.WriteFile("file.txt", "feature")
+	h.Commit("feature changes")
+}
+
 func (h *TestHelper) LastCommitMessage() string {
 	h.t.Helper()
 	output := h.RunExpectSuccess("git", "log", "-1", "--format=%s")
@@ -1144,3 +1207,4854 @@ func TestNoVerifyFlag(t *testing.T) {
 		t.Errorf("Expected success with --no-verify, got: %s", output)
 	}
 }
+
+// =============================================================================
+// TEST: Continue From Index
+// Content staged with git add is committed even if the working tree was
+// edited afterwards
+// =============================================================================
+
+func TestContinueFromIndex(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+
+	// Stage the resolution, then keep editing without staging
+	h.WriteFile("file.txt", "staged resolution")
+	h.Run("git", "add", "file.txt")
+	h.WriteFile("file.txt", "unstaged edit")
+
+	output := h.Run("git-anticipate", "--continue", "--no-verify", "--from-index")
+	if !strings.Contains(output, "Success") {
+		t.Fatalf("Expected success, got: %s", output)
+	}
+
+	committed := h.RunExpectSuccess("git", "show", "HEAD:file.txt")
+	if committed != "staged resolution" {
+		t.Errorf("Expected staged content to be committed, got: %s", committed)
+	}
+}
+
+// =============================================================================
+// TEST: Continue From Working Tree (default)
+// =============================================================================
+
+func TestContinueFromWorkingTree(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+
+	h.WriteFile("file.txt", "staged resolution")
+	h.Run("git", "add", "file.txt")
+	h.WriteFile("file.txt", "unstaged edit")
+
+	output := h.Run("git-anticipate", "--continue", "--no-verify")
+	if !strings.Contains(output, "Success") {
+		t.Fatalf("Expected success, got: %s", output)
+	}
+
+	committed := h.RunExpectSuccess("git", "show", "HEAD:file.txt")
+	if committed != "unstaged edit" {
+		t.Errorf("Expected working tree content to be committed, got: %s", committed)
+	}
+}
+
+// =============================================================================
+// TEST: Metrics File
+// =============================================================================
+
+func TestMetricsFileAfterContinue(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	metricsFile := filepath.Join(h.repoDir, ".git", "metrics.jsonl")
+
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+	output := h.Run("git-anticipate", "--continue", "--no-verify", "--metrics-file", metricsFile)
+	if !strings.Contains(output, "Success") {
+		t.Fatalf("Expected success, got: %s", output)
+	}
+
+	data, err := os.ReadFile(metricsFile)
+	if err != nil {
+		t.Fatalf("Expected metrics file to be written: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected one metrics line, got %d: %s", len(lines), data)
+	}
+
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &m); err != nil {
+		t.Fatalf("Metrics line is not valid JSON: %v\n%s", err, lines[0])
+	}
+	if m["outcome"] != "resolved" || m["target"] != "dev" || m["current_branch"] != "feature" {
+		t.Errorf("Unexpected metrics: %s", lines[0])
+	}
+	if m["conflicts"] != float64(1) || m["files_changed"] != float64(1) {
+		t.Errorf("Expected 1 conflict and 1 changed file, got: %s", lines[0])
+	}
+
+	// A second session appends rather than overwrites
+	h.Checkout("dev")
+	h.WriteFile("file.txt", "dev again")
+	h.Commit("dev again")
+	h.Checkout("feature")
+	h.Run("git-anticipate", "dev")
+	h.Run("git-anticipate", "--abort", "--metrics-file", metricsFile)
+
+	data, _ = os.ReadFile(metricsFile)
+	lines = strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[1], `"outcome":"aborted"`) {
+		t.Errorf("Expected an appended aborted line, got: %s", data)
+	}
+}
+
+// =============================================================================
+// TEST: Rename Tracking On Continue
+// Dev modifies old.txt while feature renames it to new.txt. Anticipating
+// feature from dev must carry the rename over: old.txt removed, new.txt added.
+// =============================================================================
+
+func TestRenameTrackedOnContinue(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	lines := []string{}
+	for i := 1; i <= 20; i++ {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+	}
+	original := strings.Join(lines, "\n") + "\n"
+
+	h.InitRepo()
+	h.WriteFile("old.txt", original)
+	h.Commit("initial")
+
+	h.Branch("dev")
+	h.WriteFile("old.txt", strings.Replace(original, "line 10\n", "dev line 10\n", 1))
+	h.Commit("dev modifies old.txt")
+
+	h.Checkout("main")
+	h.Branch("feature")
+	h.Run("git", "mv", "old.txt", "new.txt")
+	h.WriteFile("new.txt", strings.Replace(original, "line 10\n", "feature line 10\n", 1))
+	h.Commit("feature renames old.txt to new.txt")
+
+	h.Checkout("dev")
+	output := h.Run("git-anticipate", "feature")
+	if !strings.Contains(output, "Conflicts detected") {
+		t.Fatalf("Expected conflicts, got: %s", output)
+	}
+
+	// Keep the rename, merging both edits into new.txt
+	merged := strings.Replace(original, "line 10\n", "merged line 10\n", 1)
+	h.WriteFile("new.txt", merged)
+	h.Run("git", "add", "new.txt")
+
+	output = h.Run("git-anticipate", "--continue", "--no-verify")
+	if !strings.Contains(output, "Success") {
+		t.Fatalf("Expected success, got: %s", output)
+	}
+
+	tree := strings.TrimSpace(h.RunExpectSuccess("git", "ls-tree", "--name-only", "HEAD"))
+	if tree != "new.txt" {
+		t.Errorf("Expected only new.txt in the committed tree, got: %s", tree)
+	}
+	if h.FileExists("old.txt") {
+		t.Error("old.txt should be removed from the working tree")
+	}
+	if content := h.ReadFile("new.txt"); content != merged {
+		t.Errorf("Expected merged content in new.txt, got: %s", content)
+	}
+}
+
+// =============================================================================
+// TEST: Include Untracked Files On Continue
+// A file created while resolving (e.g. splitting a file) is committed only
+// with --include-untracked
+// =============================================================================
+
+func TestIncludeUntrackedOnContinue(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+
+	// Resolve by splitting into two files, the second one never added
+	h.WriteFile("file.txt", "feature")
+	h.WriteFile("split.txt", "dev")
+	h.Run("git", "add", "file.txt")
+
+	output := h.Run("git-anticipate", "--continue", "--no-verify", "--include-untracked")
+	if !strings.Contains(output, "Success") {
+		t.Fatalf("Expected success, got: %s", output)
+	}
+
+	committed := h.RunExpectSuccess("git", "show", "HEAD:split.txt")
+	if committed != "dev" {
+		t.Errorf("Expected split.txt to be committed, got: %s", committed)
+	}
+	status := strings.TrimSpace(h.RunExpectSuccess("git", "status", "--porcelain"))
+	if status != "" {
+		t.Errorf("Expected clean working tree after continue, got: %s", status)
+	}
+}
+
+// =============================================================================
+// TEST: Merge Base Override
+// =============================================================================
+
+func TestBaseOverride(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	base := strings.TrimSpace(h.RunExpectSuccess("git", "rev-parse", "main"))
+
+	output := h.Run("git-anticipate", "dev", "--base", "main")
+	if !strings.Contains(output, "Conflicts detected") {
+		t.Fatalf("Expected conflicts, got: %s", output)
+	}
+
+	output = h.Run("git-anticipate", "--status")
+	if !strings.Contains(output, base[:8]) || !strings.Contains(output, "from --base main") {
+		t.Errorf("Expected overridden base in status, got: %s", output)
+	}
+
+	h.Run("git-anticipate", "--abort")
+
+	// An invalid base is rejected before anything is touched
+	output = h.RunExpectFailure("git-anticipate", "dev", "--base", "no-such-ref")
+	if !strings.Contains(output, "not a valid commit") {
+		t.Errorf("Expected invalid base error, got: %s", output)
+	}
+	if h.FileExists(".git/anticipate") {
+		t.Error("State should not be saved for an invalid base")
+	}
+}
+
+// =============================================================================
+// TEST: Shallow Clone
+// A depth=1 clone has no merge base until history is deepened
+// =============================================================================
+
+func setupShallowClone(t *testing.T) (*TestHelper, *TestHelper) {
+	origin := NewTestHelper(t)
+	origin.SetupConflict()
+
+	clone := NewTestHelper(t)
+	clone.RunExpectSuccess("git", "clone", "-q", "--depth=1", "--no-single-branch", "file://"+origin.repoDir, ".")
+	clone.RunExpectSuccess("git", "config", "user.email", "test@test.com")
+	clone.RunExpectSuccess("git", "config", "user.name", "Test User")
+	clone.Checkout("feature")
+	return origin, clone
+}
+
+func TestShallowCloneDeepens(t *testing.T) {
+	origin, clone := setupShallowClone(t)
+	defer origin.Cleanup()
+	defer clone.Cleanup()
+
+	output := clone.Run("git-anticipate", "origin/dev")
+	if !strings.Contains(output, "deepening history") {
+		t.Errorf("Expected deepen attempt, got: %s", output)
+	}
+	if !strings.Contains(output, "Conflicts detected") {
+		t.Errorf("Expected the merge to proceed after deepening, got: %s", output)
+	}
+	clone.Run("git-anticipate", "--abort")
+}
+
+func TestShallowCloneActionableError(t *testing.T) {
+	origin, clone := setupShallowClone(t)
+	defer origin.Cleanup()
+	defer clone.Cleanup()
+
+	output := clone.RunExpectFailure("git-anticipate", "origin/dev", "--deepen", "0")
+	if !strings.Contains(output, "shallow clone") || !strings.Contains(output, "git fetch --unshallow") {
+		t.Errorf("Expected actionable shallow clone error, got: %s", output)
+	}
+}
+
+// =============================================================================
+// TEST: Confirmation Before Discarding Unstaged Changes
+// =============================================================================
+
+func TestContinueConfirmDeclined(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+	t.Setenv("GIT_ANTICIPATE_INTERACTIVE", "1")
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "staged resolution")
+	h.Run("git", "add", "file.txt")
+	h.WriteFile("file.txt", "unstaged edit")
+	commitsBefore := h.CommitCount()
+
+	output := h.RunWithInput("n\n", "git-anticipate", "--continue", "--no-verify", "--from-index")
+	if !strings.Contains(output, "will be discarded") || !strings.Contains(output, "cancelled") {
+		t.Errorf("Expected a declined confirmation, got: %s", output)
+	}
+
+	if h.CommitCount() != commitsBefore {
+		t.Error("No commit should be created when the prompt is declined")
+	}
+	if h.ReadFile("file.txt") != "unstaged edit" {
+		t.Error("Working tree should be untouched when the prompt is declined")
+	}
+	if !h.FileExists(".git/MERGE_HEAD") || !h.FileExists(".git/anticipate") {
+		t.Error("Merge and session should still be in progress")
+	}
+
+	// Accepting (or --yes) proceeds
+	output = h.RunWithInput("y\n", "git-anticipate", "--continue", "--no-verify", "--from-index")
+	if !strings.Contains(output, "Success") {
+		t.Errorf("Expected success after confirming, got: %s", output)
+	}
+}
+
+// =============================================================================
+// TEST: Gitignored Resolved File
+// Feature deletes a force-added, ignored file that dev modifies. Keeping dev's
+// version must stage it despite .gitignore instead of dropping it.
+// =============================================================================
+
+func TestIgnoredResolvedFile(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.InitRepo()
+	h.WriteFile(".gitignore", "*.log\n")
+	h.WriteFile("debug.log", "original")
+	h.Run("git", "add", ".gitignore")
+	h.Run("git", "add", "-f", "debug.log")
+	h.Commit("initial")
+
+	h.Branch("dev")
+	h.WriteFile("debug.log", "dev")
+	h.Run("git", "add", "-f", "debug.log")
+	h.Commit("dev modifies debug.log")
+
+	h.Checkout("main")
+	h.Branch("feature")
+	h.Run("git", "rm", "-q", "debug.log")
+	h.Commit("feature deletes debug.log")
+
+	output := h.Run("git-anticipate", "dev")
+	if !strings.Contains(output, "debug.log") {
+		t.Fatalf("Expected a conflict on debug.log, got: %s", output)
+	}
+
+	// Keep dev's version
+	h.WriteFile("debug.log", "dev")
+	h.Run("git", "add", "-f", "debug.log")
+
+	output = h.Run("git-anticipate", "--continue", "--no-verify")
+	if !strings.Contains(output, "Success") {
+		t.Fatalf("Expected success, got: %s", output)
+	}
+	if !strings.Contains(output, "debug.log is ignored") {
+		t.Errorf("Expected a warning about the ignored file, got: %s", output)
+	}
+
+	committed := h.RunExpectSuccess("git", "show", "HEAD:debug.log")
+	if committed != "dev" {
+		t.Errorf("Expected debug.log to be committed, got: %s", committed)
+	}
+}
+
+// =============================================================================
+// TEST: Empty Commit Message
+// =============================================================================
+
+func TestEmptyMessageRejected(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	output := h.RunExpectFailure("git-anticipate", "--continue", "--no-verify", "-m", "")
+	if !strings.Contains(output, "empty commit message") {
+		t.Errorf("Expected empty message error, got: %s", output)
+	}
+	if !h.FileExists(".git/MERGE_HEAD") {
+		t.Error("Merge should be untouched after rejecting the message")
+	}
+
+	output = h.Run("git-anticipate", "--continue", "--no-verify", "-m", "", "--allow-empty-message")
+	if !strings.Contains(output, "Success") {
+		t.Fatalf("Expected success with --allow-empty-message, got: %s", output)
+	}
+	if msg := h.LastCommitMessage(); msg != "" {
+		t.Errorf("Expected empty commit message, got: %q", msg)
+	}
+}
+
+func TestCustomMessage(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	output := h.Run("git-anticipate", "--continue", "--no-verify", "-m", "Resolve conflicts with dev")
+	if !strings.Contains(output, "Success") {
+		t.Fatalf("Expected success, got: %s", output)
+	}
+	if msg := h.LastCommitMessage(); msg != "Resolve conflicts with dev" {
+		t.Errorf("Expected custom commit message, got: %q", msg)
+	}
+}
+
+// =============================================================================
+// TEST: Branch Typo Suggestion
+// =============================================================================
+
+func TestBranchTypoSuggestion(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.InitRepo()
+	h.WriteFile("file.txt", "content")
+	h.Commit("initial")
+	h.Branch("develop")
+	h.Checkout("main")
+
+	output := h.RunExpectFailure("git-anticipate", "devlop")
+	if !strings.Contains(output, "does not exist") || !strings.Contains(output, "Did you mean 'develop'?") {
+		t.Errorf("Expected a suggestion for 'develop', got: %s", output)
+	}
+
+	// Nothing close enough: no suggestion
+	output = h.RunExpectFailure("git-anticipate", "something-else")
+	if strings.Contains(output, "Did you mean") {
+		t.Errorf("Expected no suggestion, got: %s", output)
+	}
+}
+
+// =============================================================================
+// TEST: Exit Zero On Conflict
+// =============================================================================
+
+func TestExitZeroOnConflict(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+
+	output, code := h.RunExitCode("git-anticipate", "dev", "--exit-zero-on-conflict")
+	if code != 0 {
+		t.Errorf("Expected exit code 0, got %d", code)
+	}
+	if !strings.Contains(output, "Conflicts detected") || !strings.Contains(output, "file.txt") {
+		t.Errorf("Expected conflict info to still be printed, got: %s", output)
+	}
+
+	// Without the flag, continuing with unresolved conflicts exits 1
+	_, code = h.RunExitCode("git-anticipate", "--continue")
+	if code != 1 {
+		t.Errorf("Expected exit code 1 without the flag, got %d", code)
+	}
+	_, code = h.RunExitCode("git-anticipate", "--continue", "--exit-zero-on-conflict")
+	if code != 0 {
+		t.Errorf("Expected exit code 0 for continue with the flag, got %d", code)
+	}
+
+	h.Run("git-anticipate", "--abort")
+}
+
+// =============================================================================
+// TEST: Next Step Suggestions
+// Start, status and continue all end with the exact command to run next
+// =============================================================================
+
+func TestNextStepSuggestions(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.InitRepo()
+	h.WriteFile("file.txt", "original")
+	h.WriteFile("my notes.txt", "original")
+	h.Commit("initial")
+	h.Branch("dev")
+	h.WriteFile("file.txt", "dev")
+	h.WriteFile("my notes.txt", "dev")
+	h.Commit("dev changes")
+	h.Checkout("main")
+	h.Branch("feature")
+	h.WriteFile("file.txt", "feature")
+	h.WriteFile("my notes.txt", "feature")
+	h.Commit("feature changes")
+
+	addBoth := "git add file.txt 'my notes.txt'"
+
+	output := h.Run("git-anticipate", "dev")
+	if !strings.Contains(output, addBoth) || !strings.Contains(output, "git anticipate --continue") {
+		t.Errorf("Expected exact git add command after start, got: %s", output)
+	}
+
+	// Bare invocation with a session in progress shows status
+	output = h.Run("git-anticipate")
+	if !strings.Contains(output, addBoth) {
+		t.Errorf("Expected exact git add command in status, got: %s", output)
+	}
+
+	// Partially resolved: only the remaining file is suggested
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+	output = h.Run("git-anticipate", "--continue")
+	if !strings.Contains(output, "git add 'my notes.txt'\n") {
+		t.Errorf("Expected git add for the remaining file, got: %s", output)
+	}
+
+	// Fully resolved: continue is the next step
+	h.WriteFile("my notes.txt", "merged")
+	h.Run("git", "add", "my notes.txt")
+	output = h.Run("git-anticipate", "--status")
+	if strings.Contains(output, "git add") || !strings.Contains(output, "Apply the resolution with:\n  git anticipate --continue") {
+		t.Errorf("Expected continue as the next step, got: %s", output)
+	}
+
+	h.Run("git-anticipate", "--abort")
+}
+
+// =============================================================================
+// TEST: Merge Committed Before Continue
+// The user ran 'git commit' mid-session, completing the real merge
+// =============================================================================
+
+func TestContinueAfterManualMergeCommit(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	origHead := strings.TrimSpace(h.RunExpectSuccess("git", "rev-parse", "HEAD"))
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+	h.RunExpectSuccess("git", "commit", "--no-edit", "--no-verify")
+
+	output := h.Run("git-anticipate", "--continue", "--no-verify")
+	if !strings.Contains(output, "already committed") || !strings.Contains(output, "Success") {
+		t.Fatalf("Expected the merge commit to be converted, got: %s", output)
+	}
+
+	parents := strings.Fields(h.RunExpectSuccess("git", "rev-list", "--parents", "-n", "1", "HEAD"))
+	if len(parents) != 2 || parents[1] != origHead {
+		t.Errorf("Expected a single-parent commit on top of the original HEAD, got: %v", parents)
+	}
+	if !strings.HasPrefix(h.LastCommitMessage(), "Preemptive conflict resolution vs dev@") {
+		t.Errorf("Unexpected commit message: %s", h.LastCommitMessage())
+	}
+	if content := h.ReadFile("file.txt"); content != "merged" {
+		t.Errorf("Expected merged content, got: %s", content)
+	}
+}
+
+func TestContinueKeepMerge(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+	h.RunExpectSuccess("git", "commit", "--no-edit", "--no-verify")
+	mergeCommit := strings.TrimSpace(h.RunExpectSuccess("git", "rev-parse", "HEAD"))
+
+	output := h.Run("git-anticipate", "--continue", "--keep-merge")
+	if !strings.Contains(output, "Keeping the merge commit") {
+		t.Errorf("Expected the merge to be kept, got: %s", output)
+	}
+	if head := strings.TrimSpace(h.RunExpectSuccess("git", "rev-parse", "HEAD")); head != mergeCommit {
+		t.Errorf("HEAD should still be the merge commit")
+	}
+	if h.FileExists(".git/anticipate") {
+		t.Error("Session state should be cleaned up")
+	}
+}
+
+// =============================================================================
+// TEST: Sparse Checkout
+// A file changed by the target lies outside the sparse-checkout cone
+// =============================================================================
+
+func TestSparseCheckoutOutOfConeFile(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.InitRepo()
+	h.WriteFile("src/a.txt", "original")
+	h.WriteFile("docs/readme.txt", "original docs")
+	h.Commit("Initial")
+	h.Branch("dev")
+	h.Checkout("dev")
+	h.WriteFile("src/a.txt", "dev")
+	h.WriteFile("docs/readme.txt", "dev docs")
+	h.Commit("Dev changes")
+	h.Checkout("main")
+	h.Branch("feature")
+	h.Checkout("feature")
+	h.WriteFile("src/a.txt", "feature")
+	h.Commit("Feature change")
+	h.RunExpectSuccess("git", "sparse-checkout", "set", "src")
+
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("src/a.txt", "merged")
+	h.Run("git", "add", "src/a.txt")
+
+	output := h.Run("git-anticipate", "--continue", "--no-verify")
+	if !strings.Contains(output, "Success") {
+		t.Fatalf("Expected continue to succeed, got: %s", output)
+	}
+	if content := h.RunExpectSuccess("git", "show", "HEAD:docs/readme.txt"); content != "dev docs" {
+		t.Errorf("Expected target's docs in the commit, got: %s", content)
+	}
+	if h.FileExists("docs/readme.txt") {
+		t.Error("Out-of-cone file should not be checked out")
+	}
+	if status := h.RunExpectSuccess("git", "status", "--porcelain"); status != "" {
+		t.Errorf("Expected a clean tree, got: %s", status)
+	}
+}
+
+// =============================================================================
+// TEST: Soft Abort
+// --abort --soft keeps the resolution as uncommitted changes
+// =============================================================================
+
+func TestAbortSoftKeepsResolution(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	origHead := strings.TrimSpace(h.RunExpectSuccess("git", "rev-parse", "HEAD"))
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	output := h.RunExpectSuccess("git-anticipate", "--abort", "--soft")
+	if !strings.Contains(output, "uncommitted changes") {
+		t.Errorf("Expected soft abort message, got: %s", output)
+	}
+	if content := h.ReadFile("file.txt"); content != "merged" {
+		t.Errorf("Expected resolved content to remain, got: %s", content)
+	}
+	if head := strings.TrimSpace(h.RunExpectSuccess("git", "rev-parse", "HEAD")); head != origHead {
+		t.Error("HEAD should be back at the original commit")
+	}
+	if h.FileExists(".git/MERGE_HEAD") || h.FileExists(".git/anticipate") {
+		t.Error("Merge and session state should be cleaned up")
+	}
+}
+
+// =============================================================================
+// TEST: Custom Git Executable
+// --git and GIT_ANTICIPATE_GIT route every git call through the given program
+// =============================================================================
+
+func TestCustomGitExecutable(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	logFile := filepath.Join(h.repoDir, ".git", "git-calls.log")
+	wrapper := filepath.Join(h.repoDir, ".git", "git-wrapper")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %s\nexec git \"$@\"\n", logFile)
+	if err := os.WriteFile(wrapper, []byte(script), 0755); err != nil {
+		t.Fatalf("failed to write wrapper: %v", err)
+	}
+
+	h.Run("git-anticipate", "--git", wrapper, "dev")
+	log := h.ReadFile(".git/git-calls.log")
+	if !strings.Contains(log, "merge dev --no-commit --no-ff") {
+		t.Errorf("Expected the merge to go through the wrapper, got: %s", log)
+	}
+
+	os.Remove(logFile)
+	t.Setenv("GIT_ANTICIPATE_GIT", wrapper)
+	h.Run("git-anticipate", "--abort")
+	if !strings.Contains(h.ReadFile(".git/git-calls.log"), "merge --abort") {
+		t.Error("Expected GIT_ANTICIPATE_GIT to be used for --abort")
+	}
+}
+
+// =============================================================================
+// TEST: Patch Mode
+// --continue --patch commits only the hunks selected in git add -p
+// =============================================================================
+
+func TestContinuePatchSelectsHunks(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	lines := []string{"l1", "l2", "l3", "l4", "l5", "l6", "l7", "l8", "l9", "l10"}
+	withLine := func(i int, s string) string {
+		l := append([]string(nil), lines...)
+		l[i] = s
+		return strings.Join(l, "\n") + "\n"
+	}
+
+	h.InitRepo()
+	h.WriteFile("file.txt", strings.Join(lines, "\n")+"\n")
+	h.Commit("Initial")
+	h.Branch("dev")
+	h.Checkout("dev")
+	h.WriteFile("file.txt", withLine(0, "dev"))
+	h.Commit("Dev change")
+	h.Checkout("main")
+	h.Branch("feature")
+	h.Checkout("feature")
+	h.WriteFile("file.txt", withLine(0, "feature"))
+	h.Commit("Feature change")
+
+	h.Run("git-anticipate", "dev")
+	resolved := withLine(0, "merged")
+	resolved = strings.Replace(resolved, "l10", "extra", 1)
+	h.WriteFile("file.txt", resolved)
+	h.Run("git", "add", "file.txt")
+
+	// Take the first hunk (the resolution), leave the second
+	t.Setenv("GIT_ANTICIPATE_INTERACTIVE", "1")
+	output := h.RunWithInput("y\nn\n", "git-anticipate", "--continue", "--patch", "--yes", "--no-verify")
+	if !strings.Contains(output, "Success") {
+		t.Fatalf("Expected continue to succeed, got: %s", output)
+	}
+
+	committed := h.RunExpectSuccess("git", "show", "HEAD:file.txt")
+	if !strings.Contains(committed, "merged") || strings.Contains(committed, "extra") {
+		t.Errorf("Expected only the selected hunk in the commit, got: %s", committed)
+	}
+	if !strings.Contains(h.ReadFile("file.txt"), "extra") {
+		t.Error("Unselected hunk should remain in the working tree")
+	}
+}
+
+// =============================================================================
+// TEST: Export Conflicts
+// --export writes the unresolved conflicts to a patch file
+// =============================================================================
+
+func TestExportConflicts(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+
+	exportPath := filepath.Join(h.repoDir, ".git", "conflicts.patch")
+	output := h.RunExpectSuccess("git-anticipate", "--export", exportPath)
+	if !strings.Contains(output, "Exported 1 conflicting files") {
+		t.Errorf("Expected export message, got: %s", output)
+	}
+
+	patch := h.ReadFile(".git/conflicts.patch")
+	if !strings.Contains(patch, "diff --cc file.txt") {
+		t.Errorf("Expected a combined diff for file.txt, got: %s", patch)
+	}
+	if !strings.Contains(patch, "<<<<<<<") || !strings.Contains(patch, ">>>>>>>") {
+		t.Errorf("Expected conflict markers in the export, got: %s", patch)
+	}
+
+	h.Run("git-anticipate", "--abort")
+}
+
+// =============================================================================
+// TEST: Reset Mode
+// --reset-mode keep preserves or refuses where hard discards
+// =============================================================================
+
+func TestResetModeKeepPreservesUnrelatedChanges(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.WriteFile("other.txt", "original")
+	h.Commit("Add other")
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+	h.WriteFile("other.txt", "local edit")
+
+	output := h.Run("git-anticipate", "--continue", "--from-index", "--reset-mode", "keep", "--no-verify")
+	if !strings.Contains(output, "Success") {
+		t.Fatalf("Expected continue to succeed, got: %s", output)
+	}
+	if content := h.ReadFile("other.txt"); content != "local edit" {
+		t.Errorf("Expected unrelated edit to be kept, got: %s", content)
+	}
+	if content := h.RunExpectSuccess("git", "show", "HEAD:other.txt"); content != "original" {
+		t.Errorf("Unrelated edit should not be committed, got: %s", content)
+	}
+}
+
+func TestResetModeHardDiscardsUnrelatedChanges(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.WriteFile("other.txt", "original")
+	h.Commit("Add other")
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+	h.WriteFile("other.txt", "local edit")
+
+	output := h.Run("git-anticipate", "--continue", "--from-index", "--reset-mode", "hard", "--no-verify")
+	if !strings.Contains(output, "Success") {
+		t.Fatalf("Expected continue to succeed, got: %s", output)
+	}
+	if content := h.ReadFile("other.txt"); content != "original" {
+		t.Errorf("Expected hard reset to discard the edit, got: %s", content)
+	}
+}
+
+func TestResetModeKeepRefusesDirtyFile(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+	h.WriteFile("file.txt", "edited after staging")
+
+	output := h.RunExpectFailure("git-anticipate", "--continue", "--from-index", "--reset-mode", "keep", "--no-verify")
+	if !strings.Contains(output, "refused to reset") {
+		t.Errorf("Expected keep reset to refuse, got: %s", output)
+	}
+	if !h.FileExists(".git/anticipate") {
+		t.Error("Session should still be in progress")
+	}
+
+	// hard goes ahead and commits the staged resolution
+	output = h.Run("git-anticipate", "--continue", "--from-index", "--reset-mode", "hard", "--no-verify")
+	if !strings.Contains(output, "Success") {
+		t.Fatalf("Expected hard continue to succeed, got: %s", output)
+	}
+	if content := h.RunExpectSuccess("git", "show", "HEAD:file.txt"); content != "merged" {
+		t.Errorf("Expected staged resolution to be committed, got: %s", content)
+	}
+}
+
+func TestResetModeInvalid(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+
+	output := h.RunExpectFailure("git-anticipate", "--continue", "--reset-mode", "soft")
+	if !strings.Contains(output, "invalid --reset-mode") {
+		t.Errorf("Expected invalid mode error, got: %s", output)
+	}
+	h.Run("git-anticipate", "--abort")
+}
+
+// =============================================================================
+// TEST: Remerge
+// --remerge restores the conflict markers in a clobbered file
+// =============================================================================
+
+func TestRemergeRestoresMarkers(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "oops")
+	h.Run("git", "add", "file.txt")
+
+	output := h.RunExpectSuccess("git-anticipate", "--remerge", "file.txt")
+	if !strings.Contains(output, "Restored conflict markers in file.txt") {
+		t.Errorf("Expected remerge message, got: %s", output)
+	}
+	content := h.ReadFile("file.txt")
+	if !strings.Contains(content, "<<<<<<<") || !strings.Contains(content, "dev") || !strings.Contains(content, "feature") {
+		t.Errorf("Expected conflict markers to be restored, got: %s", content)
+	}
+
+	output = h.RunExpectFailure("git-anticipate", "--remerge", "other.txt")
+	if !strings.Contains(output, "did not conflict") {
+		t.Errorf("Expected error for a file that did not conflict, got: %s", output)
+	}
+
+	h.Run("git-anticipate", "--abort")
+}
+
+// =============================================================================
+// TEST: Environment Variables in Target
+// '$BASE_BRANCH' is expanded without relying on the shell
+// =============================================================================
+
+func TestTargetEnvExpansion(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+
+	t.Setenv("BASE_BRANCH", "dev")
+	output := h.Run("git-anticipate", "$BASE_BRANCH")
+	if !strings.Contains(output, "Conflicts detected") {
+		t.Errorf("Expected $BASE_BRANCH to resolve to dev, got: %s", output)
+	}
+	if target := h.ReadFile(".git/anticipate/target"); target != "dev" {
+		t.Errorf("Expected target 'dev' in state, got: %s", target)
+	}
+	h.Run("git-anticipate", "--abort")
+
+	output = h.RunExpectFailure("git-anticipate", "${UNSET_BRANCH_VAR}")
+	if !strings.Contains(output, "expands to an empty branch name") {
+		t.Errorf("Expected empty expansion error, got: %s", output)
+	}
+}
+
+// =============================================================================
+// TEST: Unrelated Edits
+// Edits to files the merge did not touch stay out of the commit unless --all
+// =============================================================================
+
+func TestUnrelatedEditNotCommitted(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.WriteFile("other.txt", "original")
+	h.Commit("Add other")
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+	h.WriteFile("other.txt", "unrelated edit")
+
+	output := h.Run("git-anticipate", "--continue", "--no-verify")
+	if !strings.Contains(output, "Success") {
+		t.Fatalf("Expected continue to succeed, got: %s", output)
+	}
+	if content := h.RunExpectSuccess("git", "show", "HEAD:other.txt"); content != "original" {
+		t.Errorf("Unrelated edit should not be committed, got: %s", content)
+	}
+	if content := h.RunExpectSuccess("git", "show", "HEAD:file.txt"); content != "merged" {
+		t.Errorf("Expected resolution to be committed, got: %s", content)
+	}
+	if content := h.ReadFile("other.txt"); content != "unrelated edit" {
+		t.Errorf("Unrelated edit should be kept in the working tree, got: %s", content)
+	}
+}
+
+func TestAllCommitsUnrelatedEdit(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.WriteFile("other.txt", "original")
+	h.Commit("Add other")
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+	h.WriteFile("other.txt", "unrelated edit")
+
+	h.Run("git-anticipate", "--continue", "--all", "--no-verify")
+	if content := h.RunExpectSuccess("git", "show", "HEAD:other.txt"); content != "unrelated edit" {
+		t.Errorf("Expected --all to commit the edit, got: %s", content)
+	}
+}
+
+// =============================================================================
+// TEST: Commit Message Cleanup
+// --cleanup verbatim keeps comment-like lines in the message
+// =============================================================================
+
+func TestCleanupVerbatim(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	// git's default for -m would squash the blank lines and trailing spaces
+	message := "Prepare for dev\n\n\n# Conflicts:\n#   file.txt   \n"
+	h.Run("git-anticipate", "--continue", "--no-verify", "-m", message, "--cleanup", "verbatim")
+	raw := h.RunExpectSuccess("git", "cat-file", "commit", "HEAD")
+	if !strings.Contains(raw, message) {
+		t.Errorf("Expected the message to be kept verbatim, got: %q", raw)
+	}
+
+	// strip drops the comment lines
+	h.Run("git", "reset", "--hard", "HEAD~1")
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+	h.Run("git-anticipate", "--continue", "--no-verify", "-m", message, "--cleanup", "strip")
+	if body := h.LastCommitMessage(); strings.Contains(body, "#") {
+		t.Errorf("Expected strip to remove comment lines, got: %q", body)
+	}
+}
+
+func TestCleanupInvalidMode(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+
+	output := h.RunExpectFailure("git-anticipate", "--continue", "--cleanup", "tidy")
+	if !strings.Contains(output, "invalid --cleanup mode") {
+		t.Errorf("Expected invalid mode error, got: %s", output)
+	}
+	h.Run("git-anticipate", "--abort")
+}
+
+// =============================================================================
+// TEST: Session History
+// Finished sessions are logged and shown by 'git anticipate history'
+// =============================================================================
+
+func TestHistoryRecordsSessions(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+
+	output := h.RunExpectSuccess("git-anticipate", "history")
+	if !strings.Contains(output, "No anticipate history yet") {
+		t.Errorf("Expected empty history, got: %s", output)
+	}
+
+	h.Run("git-anticipate", "dev")
+	h.Run("git-anticipate", "--abort")
+
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+	h.Run("git-anticipate", "--continue", "--no-verify")
+	head := strings.TrimSpace(h.RunExpectSuccess("git", "rev-parse", "HEAD"))
+
+	lines := strings.Split(strings.TrimSpace(h.ReadFile(".git/anticipate-history")), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 history entries, got: %v", lines)
+	}
+	if fields := strings.Split(lines[0], "\t"); fields[1] != "aborted" || fields[2] != "dev" || fields[4] != "-" {
+		t.Errorf("Unexpected abort entry: %s", lines[0])
+	}
+	if fields := strings.Split(lines[1], "\t"); fields[1] != "resolved" || fields[3] != "feature" || fields[4] != head {
+		t.Errorf("Unexpected resolve entry: %s", lines[1])
+	}
+
+	output = h.RunExpectSuccess("git-anticipate", "history")
+	if !strings.Contains(output, "aborted") || !strings.Contains(output, "resolved") || !strings.Contains(output, "feature -> dev  "+head[:8]) {
+		t.Errorf("Expected both sessions in history output, got: %s", output)
+	}
+}
+
+// =============================================================================
+// TEST: Type Changes
+// The resolution turns a file into a directory or a symlink
+// =============================================================================
+
+func TestFileBecomesDirectory(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.InitRepo()
+	h.WriteFile("x", "original")
+	h.Commit("Initial")
+	h.Branch("dev")
+	h.Checkout("dev")
+	h.RunExpectSuccess("git", "rm", "-q", "x")
+	h.WriteFile("x/inner.txt", "inner")
+	h.Commit("Turn x into a directory")
+	h.Checkout("main")
+	h.Branch("feature")
+	h.Checkout("feature")
+	h.WriteFile("x", "feature")
+	h.Commit("Feature change")
+
+	h.Run("git-anticipate", "dev")
+	// Git moved our file aside to x~HEAD; keep dev's directory
+	h.Run("git", "rm", "-q", "x~HEAD")
+
+	output := h.Run("git-anticipate", "--continue", "--no-verify")
+	if !strings.Contains(output, "Success") {
+		t.Fatalf("Expected continue to succeed, got: %s", output)
+	}
+	if content := h.RunExpectSuccess("git", "show", "HEAD:x/inner.txt"); content != "inner" {
+		t.Errorf("Expected x/inner.txt in the commit, got: %s", content)
+	}
+	if info, err := os.Stat(filepath.Join(h.repoDir, "x")); err != nil || !info.IsDir() {
+		t.Error("Expected x to be a directory")
+	}
+}
+
+func TestFileBecomesSymlink(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.InitRepo()
+	h.WriteFile("target.txt", "target")
+	h.WriteFile("link", "original")
+	h.Commit("Initial")
+	h.Branch("dev")
+	h.Checkout("dev")
+	h.DeleteFile("link")
+	if err := os.Symlink("target.txt", filepath.Join(h.repoDir, "link")); err != nil {
+		t.Fatalf("failed to create symlink: %v", err)
+	}
+	h.Commit("Turn link into a symlink")
+	h.Checkout("main")
+	h.Branch("feature")
+	h.Checkout("feature")
+	h.WriteFile("link", "feature")
+	h.Commit("Feature change")
+
+	h.Run("git-anticipate", "dev")
+	// Keep dev's symlink and drop our file, which git moved aside
+	h.Run("git", "checkout", "--theirs", "link")
+	h.Run("git", "add", "link")
+	h.Run("git", "rm", "-q", "link~HEAD")
+
+	output := h.Run("git-anticipate", "--continue", "--no-verify")
+	if !strings.Contains(output, "Success") {
+		t.Fatalf("Expected continue to succeed, got: %s", output)
+	}
+	if mode := h.RunExpectSuccess("git", "ls-tree", "HEAD", "link"); !strings.HasPrefix(mode, "120000") {
+		t.Errorf("Expected link to be committed as a symlink, got: %s", mode)
+	}
+	if target, err := os.Readlink(filepath.Join(h.repoDir, "link")); err != nil || target != "target.txt" {
+		t.Errorf("Expected link -> target.txt on disk, got: %q (%v)", target, err)
+	}
+	if content := h.ReadFile("target.txt"); content != "target" {
+		t.Errorf("Symlink target should be untouched, got: %s", content)
+	}
+}
+
+// =============================================================================
+// TEST: Subtree Prefix
+// --prefix merges the target into a subdirectory
+// =============================================================================
+
+func TestPrefixSubtreeMerge(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.InitRepo()
+	h.WriteFile("app.txt", "app")
+	h.Commit("Initial")
+
+	// A library branch with its own history, vendored under vendor/
+	h.RunExpectSuccess("git", "checkout", "-q", "--orphan", "lib")
+	h.RunExpectSuccess("git", "rm", "-rqf", ".")
+	h.WriteFile("lib.txt", "v1")
+	h.Commit("Library v1")
+	h.Checkout("main")
+	h.RunExpectSuccess("git", "merge", "-q", "-s", "ours", "--no-commit", "--allow-unrelated-histories", "lib")
+	h.RunExpectSuccess("git", "read-tree", "--prefix=vendor/", "-u", "lib")
+	h.RunExpectSuccess("git", "commit", "-q", "-m", "Vendor library")
+
+	h.Checkout("lib")
+	h.WriteFile("lib.txt", "v2")
+	h.WriteFile("new.txt", "new")
+	h.Commit("Library v2")
+	h.Checkout("main")
+	h.Branch("feature")
+	h.Checkout("feature")
+	h.WriteFile("vendor/lib.txt", "patched")
+	h.Commit("Patch vendored library")
+
+	output := h.Run("git-anticipate", "lib", "--prefix", "vendor/")
+	if !strings.Contains(output, "vendor/lib.txt") {
+		t.Fatalf("Expected the conflict under vendor/, got: %s", output)
+	}
+	if !h.FileExists("vendor/new.txt") || h.FileExists("new.txt") {
+		t.Error("Expected new library files to land under vendor/")
+	}
+	if output := h.RunExpectSuccess("git-anticipate", "--status"); !strings.Contains(output, "Prefix:          vendor/") {
+		t.Errorf("Expected prefix in status, got: %s", output)
+	}
+
+	h.WriteFile("vendor/lib.txt", "v2 patched")
+	h.Run("git", "add", "vendor/lib.txt")
+	h.Run("git-anticipate", "--continue", "--no-verify")
+
+	if content := h.RunExpectSuccess("git", "show", "HEAD:vendor/new.txt"); content != "new" {
+		t.Errorf("Expected vendor/new.txt in the commit, got: %s", content)
+	}
+	if msg := h.LastCommitMessage(); !strings.HasSuffix(msg, " in vendor/") {
+		t.Errorf("Expected the prefix in the commit message, got: %s", msg)
+	}
+}
+
+// =============================================================================
+// TEST: Effort Estimate
+// Small conflict sets rate low, large ones high; --json carries the numbers
+// =============================================================================
+
+func TestEffortRatingSmall(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	output := h.Run("git-anticipate", "dev")
+	if !strings.Contains(output, "Effort: low (1 files, 1 hunks, 2 conflicting lines)") {
+		t.Errorf("Expected a low effort rating, got: %s", output)
+	}
+	h.Run("git-anticipate", "--abort")
+}
+
+func TestEffortRatingLargeJSON(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	// 15 changed lines far enough apart to conflict as separate hunks
+	lines := func(tag string) string {
+		var b strings.Builder
+		for i := 0; i < 15; i++ {
+			fmt.Fprintf(&b, "%s %d\nkeep\nkeep\nkeep\nkeep\n", tag, i)
+		}
+		return b.String()
+	}
+
+	h.InitRepo()
+	h.WriteFile("big.txt", lines("original"))
+	h.Commit("Initial")
+	h.Branch("dev")
+	h.Checkout("dev")
+	h.WriteFile("big.txt", lines("dev"))
+	h.Commit("Dev change")
+	h.Checkout("main")
+	h.Branch("feature")
+	h.Checkout("feature")
+	h.WriteFile("big.txt", lines("feature"))
+	h.Commit("Feature change")
+
+	output, code := h.RunExitCode("git-anticipate", "dev", "--json")
+	if code != 1 {
+		t.Errorf("Expected exit code 1, got %d", code)
+	}
+
+	var result struct {
+		Outcome string
+		Effort  struct {
+			Files, Hunks, Lines int
+			Rating              string
+		}
+	}
+	if err := json.Unmarshal([]byte(output), &result); err != nil {
+		t.Fatalf("Expected JSON output, got: %s (%v)", output, err)
+	}
+	if result.Outcome != "conflicts" || result.Effort.Hunks != 15 || result.Effort.Rating != "high" {
+		t.Errorf("Unexpected effort: %+v", result)
+	}
+	h.Run("git-anticipate", "--abort")
+}
+
+// =============================================================================
+// TEST: No Automatic Staging
+// --continue --no-stage commits only what the user staged
+// =============================================================================
+
+func TestNoStageCommitsOnlyStaged(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.WriteFile("a.txt", "a")
+	h.WriteFile("b.txt", "b")
+	h.Commit("Add a and b")
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+	h.WriteFile("a.txt", "a staged")
+	h.Run("git", "add", "a.txt")
+	h.WriteFile("b.txt", "b not staged")
+
+	output := h.Run("git-anticipate", "--continue", "--no-stage", "--no-verify")
+	if !strings.Contains(output, "Success") {
+		t.Fatalf("Expected continue to succeed, got: %s", output)
+	}
+	if content := h.RunExpectSuccess("git", "show", "HEAD:a.txt"); content != "a staged" {
+		t.Errorf("Expected staged a.txt to be committed, got: %s", content)
+	}
+	if content := h.RunExpectSuccess("git", "show", "HEAD:b.txt"); content != "b" {
+		t.Errorf("Unstaged b.txt should not be committed, got: %s", content)
+	}
+	if content := h.ReadFile("b.txt"); content != "b not staged" {
+		t.Errorf("Unstaged edit should stay in the working tree, got: %s", content)
+	}
+}
+
+// =============================================================================
+// TEST: Git LFS Files
+// LFS pointers are carried over, not rewritten through the filters again
+// =============================================================================
+
+func TestLFSFileNotCorrupted(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+
+	// A stand-in for git-lfs: clean stores the content and emits a pointer,
+	// smudge looks the content up again
+	store := filepath.Join(h.repoDir, ".git", "lfs-mock")
+	clean := filepath.Join(h.repoDir, ".git", "lfs-clean")
+	smudge := filepath.Join(h.repoDir, ".git", "lfs-smudge")
+	os.MkdirAll(store, 0755)
+	os.WriteFile(clean, []byte(fmt.Sprintf("#!/bin/sh\ntmp=$(mktemp)\ncat > \"$tmp\"\noid=$(sha1sum < \"$tmp\" | cut -d' ' -f1)\nmv \"$tmp\" %s/$oid\necho \"oid $oid\"\n", store)), 0755)
+	os.WriteFile(smudge, []byte(fmt.Sprintf("#!/bin/sh\nread _ oid\ncat %s/$oid\n", store)), 0755)
+	h.RunExpectSuccess("git", "config", "filter.lfs.clean", clean)
+	h.RunExpectSuccess("git", "config", "filter.lfs.smudge", smudge)
+	h.RunExpectSuccess("git", "config", "filter.lfs.required", "true")
+
+	h.Checkout("main")
+	h.WriteFile(".gitattributes", "*.bin filter=lfs\n")
+	h.WriteFile("asset.bin", "asset v1")
+	h.Commit("Add asset")
+	h.Checkout("dev")
+	h.RunExpectSuccess("git", "merge", "-q", "main")
+	h.WriteFile("asset.bin", "asset v2")
+	h.Commit("Update asset")
+	h.Checkout("feature")
+	h.RunExpectSuccess("git", "merge", "-q", "main")
+
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	output := h.Run("git-anticipate", "--continue", "--from-index", "--no-verify")
+	if !strings.Contains(output, "asset.bin is tracked by Git LFS") {
+		t.Errorf("Expected LFS file to be detected, got: %s", output)
+	}
+	committed := strings.TrimSpace(h.RunExpectSuccess("git", "rev-parse", "HEAD:asset.bin"))
+	expected := strings.TrimSpace(h.RunExpectSuccess("git", "rev-parse", "dev:asset.bin"))
+	if committed != expected {
+		t.Errorf("Expected dev's LFS pointer to be committed, got: %s", h.RunExpectSuccess("git", "show", "HEAD:asset.bin"))
+	}
+	if content := h.ReadFile("asset.bin"); content != "asset v2" {
+		t.Errorf("Expected the smudged content in the working tree, got: %s", content)
+	}
+}
+
+// =============================================================================
+// TEST: Signing Program
+// --gpg-program is used to sign the commit with -S
+// =============================================================================
+
+func TestGPGProgramSignsCommit(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	logFile := filepath.Join(h.repoDir, ".git", "gpg.log")
+	stub := filepath.Join(h.repoDir, ".git", "gpg-stub")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %s\ncat > /dev/null\nprintf '\\n[GNUPG:] SIG_CREATED D 1 8 00 0 STUB\\n' >&2\nprintf -- '-----BEGIN PGP SIGNATURE-----\\nstub\\n-----END PGP SIGNATURE-----\\n'\n", logFile)
+	if err := os.WriteFile(stub, []byte(script), 0755); err != nil {
+		t.Fatalf("failed to write stub: %v", err)
+	}
+
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	output := h.Run("git-anticipate", "--continue", "--no-verify", "-S", "--gpg-program", stub)
+	if !strings.Contains(output, "Success") {
+		t.Fatalf("Expected continue to succeed, got: %s", output)
+	}
+	if !h.FileExists(".git/gpg.log") {
+		t.Fatal("Expected the stub gpg program to be invoked")
+	}
+	if raw := h.RunExpectSuccess("git", "cat-file", "commit", "HEAD"); !strings.Contains(raw, "gpgsig -----BEGIN PGP SIGNATURE-----") {
+		t.Errorf("Expected a signed commit, got: %s", raw)
+	}
+}
+
+func TestSSHSignForwardsConfig(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	logFile := filepath.Join(h.repoDir, ".git", "ssh.log")
+	stub := filepath.Join(h.repoDir, ".git", "ssh-keygen-stub")
+	// Called as: -Y sign -n git -f <key> <buffer>; the signature goes to <buffer>.sig
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %s\nfor last; do :; done\nprintf -- '-----BEGIN SSH SIGNATURE-----\\nstub\\n-----END SSH SIGNATURE-----\\n' > \"$last.sig\"\n", logFile)
+	if err := os.WriteFile(stub, []byte(script), 0755); err != nil {
+		t.Fatalf("failed to write stub: %v", err)
+	}
+	key := filepath.Join(h.repoDir, ".git", "id_test.pub")
+	os.WriteFile(key, []byte("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIStub test\n"), 0644)
+	h.RunExpectSuccess("git", "config", "gpg.ssh.program", stub)
+
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	output := h.Run("git-anticipate", "--continue", "--no-verify", "--ssh-sign", key)
+	if !strings.Contains(output, "Success") {
+		t.Fatalf("Expected continue to succeed, got: %s", output)
+	}
+	if log := h.ReadFile(".git/ssh.log"); !strings.Contains(log, "-f "+key) {
+		t.Errorf("Expected the SSH signer to be called with the key, got: %s", log)
+	}
+	if raw := h.RunExpectSuccess("git", "cat-file", "commit", "HEAD"); !strings.Contains(raw, "gpgsig -----BEGIN SSH SIGNATURE-----") {
+		t.Errorf("Expected an SSH-signed commit, got: %s", raw)
+	}
+}
+
+func TestSSHSignMissingKey(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	output := h.RunExpectFailure("git-anticipate", "--continue", "--no-verify", "--ssh-sign", "/nonexistent/id.pub")
+	if !strings.Contains(output, "SSH signing key '/nonexistent/id.pub' not found") {
+		t.Errorf("Expected a missing key error, got: %s", output)
+	}
+	if !h.FileExists(".git/anticipate") {
+		t.Error("Expected the session to be kept")
+	}
+}
+
+// =============================================================================
+// TEST: Continue Summary
+// --continue reports the new commit, also as JSON
+// =============================================================================
+
+func TestContinuePrintsCommitSHA(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	output := h.Run("git-anticipate", "--continue", "--no-verify")
+	head := strings.TrimSpace(h.RunExpectSuccess("git", "rev-parse", "HEAD"))
+	if !strings.Contains(output, "Created commit "+head[:8]) {
+		t.Errorf("Expected the new commit %s in the output, got: %s", head[:8], output)
+	}
+}
+
+// =============================================================================
+// TEST: Committed Markers
+// --continue warns when the new commit still contains conflict markers
+// =============================================================================
+
+func TestContinueWarnsAboutCommittedMarkers(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	// Stage the file with its conflict markers still in it
+	h.Run("git", "add", "file.txt")
+
+	output := h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify")
+	if !strings.Contains(output, "still contains conflict markers") || !strings.Contains(output, "    file.txt") {
+		t.Errorf("Expected a warning about markers in file.txt, got: %s", output)
+	}
+	if !strings.Contains(output, "git commit --amend") {
+		t.Errorf("Expected the warning to recommend amending, got: %s", output)
+	}
+}
+
+func TestContinueNoMarkerWarningWhenClean(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	output := h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify")
+	if strings.Contains(output, "conflict markers") {
+		t.Errorf("Expected no marker warning, got: %s", output)
+	}
+}
+
+func TestContinueJSON(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	output := h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--json")
+	var result struct{ Committed string }
+	if err := json.Unmarshal([]byte(output), &result); err != nil {
+		t.Fatalf("Expected JSON output, got: %s (%v)", output, err)
+	}
+	if head := strings.TrimSpace(h.RunExpectSuccess("git", "rev-parse", "HEAD")); result.Committed != head {
+		t.Errorf("Expected committed %s, got %s", head, result.Committed)
+	}
+}
+
+// =============================================================================
+// TEST: Fixup Commit
+// --fixup commits the resolution as a fixup! of another commit
+// =============================================================================
+
+func TestContinueFixup(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	output := h.RunExpectFailure("git-anticipate", "--continue", "--fixup", "HEAD", "-m", "msg")
+	if !strings.Contains(output, "cannot be combined with --message") {
+		t.Errorf("Expected --fixup and -m to conflict, got: %s", output)
+	}
+	output = h.RunExpectFailure("git-anticipate", "--continue", "--fixup", "no-such-commit")
+	if !strings.Contains(output, "is not a valid commit") {
+		t.Errorf("Expected invalid fixup target error, got: %s", output)
+	}
+
+	h.Run("git-anticipate", "--continue", "--no-verify", "--fixup", "HEAD")
+	if msg := h.LastCommitMessage(); msg != "fixup! feature changes" {
+		t.Errorf("Expected a fixup! message for the feature commit, got: %s", msg)
+	}
+}
+
+// =============================================================================
+// TEST: Co-authors
+// --co-author adds Co-authored-by trailers
+// =============================================================================
+
+func TestContinueCoAuthors(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	output := h.RunExpectFailure("git-anticipate", "--continue", "--co-author", "Ada Lovelace")
+	if !strings.Contains(output, "invalid --co-author") {
+		t.Errorf("Expected invalid co-author error, got: %s", output)
+	}
+
+	h.Run("git-anticipate", "--continue", "--no-verify",
+		"--co-author", "Ada Lovelace <ada@example.com>",
+		"--co-author", "Alan Turing <alan@example.com>")
+	body := h.RunExpectSuccess("git", "log", "-1", "--format=%B")
+	if !strings.HasPrefix(body, "Preemptive conflict resolution vs dev@") {
+		t.Errorf("Expected the default message to be kept, got: %s", body)
+	}
+	for _, trailer := range []string{"Co-authored-by: Ada Lovelace <ada@example.com>", "Co-authored-by: Alan Turing <alan@example.com>"} {
+		if !strings.Contains(body, trailer) {
+			t.Errorf("Expected trailer %q, got: %s", trailer, body)
+		}
+	}
+}
+
+func TestContinueTrailers(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	output := h.RunExpectFailure("git-anticipate", "--continue", "--trailer", "Reviewed-by")
+	if !strings.Contains(output, "invalid --trailer") {
+		t.Errorf("Expected invalid trailer error, got: %s", output)
+	}
+
+	h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "-m", "Prepare for dev",
+		"--trailer", "Reviewed-by=Grace Hopper <grace@example.com>",
+		"--trailer", "Ticket=OPS-42")
+	body := h.RunExpectSuccess("git", "log", "-1", "--format=%B")
+	want := "Prepare for dev\n\nReviewed-by: Grace Hopper <grace@example.com>\nTicket: OPS-42"
+	if !strings.HasPrefix(body, want) {
+		t.Errorf("Expected both trailers in order after the message, got: %s", body)
+	}
+}
+
+// =============================================================================
+// TEST: Revision Shorthands
+// @{upstream} and @{-1} are resolved to branch names
+// =============================================================================
+
+func TestTargetUpstreamShorthand(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.RunExpectSuccess("git", "branch", "--set-upstream-to=dev")
+
+	h.Run("git-anticipate", "@{upstream}")
+	if target := h.ReadFile(".git/anticipate/target"); target != "dev" {
+		t.Fatalf("Expected @{upstream} to be stored as dev, got: %s", target)
+	}
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+	h.Run("git-anticipate", "--continue", "--no-verify")
+	if msg := h.LastCommitMessage(); !strings.HasPrefix(msg, "Preemptive conflict resolution vs dev@") {
+		t.Errorf("Expected the branch name in the commit message, got: %s", msg)
+	}
+}
+
+func TestTargetPreviousBranchShorthand(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Checkout("dev")
+	h.Checkout("feature")
+
+	output := h.Run("git-anticipate", "@{-1}")
+	if !strings.Contains(output, "Target branch: dev") {
+		t.Errorf("Expected @{-1} to resolve to dev, got: %s", output)
+	}
+	h.Run("git-anticipate", "--abort")
+
+	output = h.RunExpectFailure("git-anticipate", "@{-9}")
+	if !strings.Contains(output, "cannot resolve '@{-9}'") {
+		t.Errorf("Expected an error for an unknown shorthand, got: %s", output)
+	}
+}
+
+// =============================================================================
+// TEST: Divergence Warning
+// A target far ahead triggers a warning and confirmation
+// =============================================================================
+
+func TestMaxAheadWarning(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Checkout("dev")
+	h.WriteFile("more.txt", "1")
+	h.Commit("More dev work")
+	h.WriteFile("more.txt", "2")
+	h.Commit("Even more dev work")
+	h.Checkout("feature")
+
+	output := h.Run("git-anticipate", "dev", "--max-ahead", "2")
+	if !strings.Contains(output, "dev is 3 commits ahead of feature (limit 2") {
+		t.Errorf("Expected divergence warning, got: %s", output)
+	}
+	if !strings.Contains(output, "Conflicts detected") {
+		t.Errorf("Expected the merge to go ahead without a terminal, got: %s", output)
+	}
+	h.Run("git-anticipate", "--abort")
+
+	t.Setenv("GIT_ANTICIPATE_INTERACTIVE", "1")
+	output = h.RunWithInput("n\n", "git-anticipate", "dev", "--max-ahead", "2")
+	if !strings.Contains(output, "cancelled") {
+		t.Errorf("Expected the merge to be cancelled, got: %s", output)
+	}
+	if h.FileExists(".git/anticipate") {
+		t.Error("No session should be started after declining")
+	}
+}
+
+// =============================================================================
+// TEST: Message File
+// --message-file reads the commit message from a file or stdin
+// =============================================================================
+
+func TestContinueMessageFile(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	output := h.RunExpectFailure("git-anticipate", "--continue", "--message-file", "missing.txt")
+	if !strings.Contains(output, "failed to read message file") {
+		t.Errorf("Expected missing file error, got: %s", output)
+	}
+
+	message := "Prepare for dev\n\nResolved file.txt by hand.\nSee the review thread."
+	msgPath := filepath.Join(h.repoDir, ".git", "msg.txt")
+	os.WriteFile(msgPath, []byte(message+"\n"), 0644)
+	h.Run("git-anticipate", "--continue", "--no-verify", "--message-file", msgPath)
+	if body := strings.TrimSpace(h.RunExpectSuccess("git", "log", "-1", "--format=%B")); body != message {
+		t.Errorf("Expected the message from the file, got: %q", body)
+	}
+}
+
+func TestContinueMessageFromStdin(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	h.RunWithInput("From stdin\n\nBody line\n", "git-anticipate", "--continue", "--no-verify", "-F", "-")
+	if body := strings.TrimSpace(h.RunExpectSuccess("git", "log", "-1", "--format=%B")); body != "From stdin\n\nBody line" {
+		t.Errorf("Expected the message from stdin, got: %q", body)
+	}
+}
+
+// =============================================================================
+// TEST: Incomplete State
+// A partial state directory gets a friendly error and 'clean' removes it
+// =============================================================================
+
+func TestIncompleteStateAndClean(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	// As if a crash happened right after the state directory was created
+	h.WriteFile(".git/anticipate/target", "dev")
+
+	for _, flag := range []string{"--continue", "--abort", "--status"} {
+		output := h.RunExpectFailure("git-anticipate", flag)
+		if !strings.Contains(output, "anticipate state is incomplete or corrupt") || !strings.Contains(output, "git anticipate clean") {
+			t.Errorf("%s: expected incomplete state error, got: %s", flag, output)
+		}
+	}
+
+	output := h.RunExpectSuccess("git-anticipate", "clean")
+	if !strings.Contains(output, "Removed anticipate state") {
+		t.Errorf("Expected clean to remove the state, got: %s", output)
+	}
+	if h.FileExists(".git/anticipate") {
+		t.Error("State directory should be gone")
+	}
+
+	output = h.Run("git-anticipate", "dev")
+	if !strings.Contains(output, "Conflicts detected") {
+		t.Errorf("Expected a new session to start after clean, got: %s", output)
+	}
+	h.Run("git-anticipate", "--abort")
+}
+
+// =============================================================================
+// TEST: File Modes
+// A new executable from the target stays executable after --continue
+// =============================================================================
+
+func TestNewExecutableFromTarget(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Checkout("dev")
+	h.WriteFile("script.sh", "#!/bin/sh\necho hi\n")
+	os.Chmod(filepath.Join(h.repoDir, "script.sh"), 0755)
+	h.Commit("Add script")
+	h.Checkout("feature")
+
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+	h.Run("git-anticipate", "--continue", "--no-verify")
+
+	info, err := os.Stat(filepath.Join(h.repoDir, "script.sh"))
+	if err != nil {
+		t.Fatalf("Failed to stat script.sh: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0755 {
+		t.Errorf("Expected script.sh to be 0755 on disk, got: %v", perm)
+	}
+	if entry := h.RunExpectSuccess("git", "ls-tree", "HEAD", "script.sh"); !strings.HasPrefix(entry, "100755") {
+		t.Errorf("Expected script.sh to be committed as executable, got: %s", entry)
+	}
+}
+
+// =============================================================================
+// TEST: Keep State on Merge Error
+// --no-abort-on-error preserves the session when git merge fails
+// =============================================================================
+
+func TestNoAbortOnErrorKeepsState(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.RunExpectSuccess("git", "checkout", "-q", "--orphan", "unrelated")
+	h.WriteFile("other.txt", "other")
+	h.Commit("Unrelated root")
+	h.Checkout("feature")
+
+	// --base gets past the merge-base lookup so that git merge itself fails
+	h.RunExpectFailure("git-anticipate", "unrelated", "--base", "HEAD")
+	if h.FileExists(".git/anticipate") {
+		t.Error("State should be cleaned up by default")
+	}
+
+	output := h.RunExpectFailure("git-anticipate", "unrelated", "--base", "HEAD", "--no-abort-on-error")
+	if !strings.Contains(output, "unrelated histories") || !strings.Contains(output, "--no-abort-on-error") {
+		t.Errorf("Expected the merge error and a note about the kept state, got: %s", output)
+	}
+	if !h.FileExists(".git/anticipate/orig_head") {
+		t.Error("State should be preserved with --no-abort-on-error")
+	}
+
+	h.RunExpectSuccess("git-anticipate", "--abort")
+	if h.FileExists(".git/anticipate") {
+		t.Error("--abort should clean up the preserved state")
+	}
+}
+
+// =============================================================================
+// TEST: Unrelated Histories
+// --allow-unrelated-histories merges a branch with its own root commit
+// =============================================================================
+
+func TestAllowUnrelatedHistories(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.InitRepo()
+	h.WriteFile("file.txt", "ours")
+	h.Commit("Our root")
+	h.RunExpectSuccess("git", "checkout", "-q", "--orphan", "imported")
+	h.RunExpectSuccess("git", "rm", "-rqf", ".")
+	h.WriteFile("file.txt", "theirs")
+	h.WriteFile("extra.txt", "extra")
+	h.Commit("Their root")
+	h.Checkout("main")
+
+	output := h.RunExpectFailure("git-anticipate", "imported")
+	if strings.Contains(output, "Conflicts detected") {
+		t.Errorf("Expected unrelated branches to be refused by default, got: %s", output)
+	}
+
+	output = h.Run("git-anticipate", "imported", "--allow-unrelated-histories")
+	if !strings.Contains(output, "Merge base: none (unrelated histories)") || !strings.Contains(output, "Conflicts detected") {
+		t.Fatalf("Expected the trial merge to proceed, got: %s", output)
+	}
+	if output := h.RunExpectSuccess("git-anticipate", "--status"); !strings.Contains(output, "unrelated histories") {
+		t.Errorf("Expected unrelated histories in status, got: %s", output)
+	}
+
+	h.WriteFile("file.txt", "both")
+	h.Run("git", "add", "file.txt")
+	h.Run("git-anticipate", "--continue", "--no-verify")
+	if msg := h.LastCommitMessage(); !strings.HasSuffix(msg, "(unrelated histories)") {
+		t.Errorf("Expected unrelated histories in the commit message, got: %s", msg)
+	}
+	if content := h.RunExpectSuccess("git", "show", "HEAD:extra.txt"); content != "extra" {
+		t.Errorf("Expected extra.txt from the imported branch, got: %s", content)
+	}
+}
+
+// =============================================================================
+// TEST: Resolution Input
+// --input resolves every conflict from a JSON map without any editing
+// =============================================================================
+
+func setupTwoConflicts(h *TestHelper) {
+	h.t.Helper()
+	h.InitRepo()
+	h.WriteFile("a.txt", "original a")
+	h.WriteFile("b.txt", "original b")
+	h.WriteFile("c.txt", "original c")
+	h.Commit("initial")
+
+	h.Branch("dev")
+	h.WriteFile("a.txt", "dev a")
+	h.WriteFile("b.txt", "dev b")
+	h.WriteFile("c.txt", "dev c")
+	h.Commit("dev changes")
+
+	h.Checkout("main")
+	h.Branch("feature")
+	h.WriteFile("a.txt", "feature a")
+	h.WriteFile("b.txt", "feature b")
+	h.WriteFile("c.txt", "feature c")
+	h.Commit("feature changes")
+}
+
+func TestContinueInputResolvesConflicts(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	setupTwoConflicts(h)
+	h.Run("git-anticipate", "dev")
+
+	content := filepath.Join(t.TempDir(), "c-resolved")
+	os.WriteFile(content, []byte("merged c"), 0644)
+	input := filepath.Join(t.TempDir(), "input.json")
+	os.WriteFile(input, []byte(`{"a.txt": "ours", "b.txt": "theirs", "c.txt": "`+content+`"}`), 0644)
+
+	h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--input", input)
+
+	for file, want := range map[string]string{"a.txt": "feature a", "b.txt": "dev b", "c.txt": "merged c"} {
+		if got := h.RunExpectSuccess("git", "show", "HEAD:"+file); got != want {
+			t.Errorf("Expected %s to be committed as %q, got %q", file, want, got)
+		}
+	}
+	if h.FileExists(".git/anticipate") {
+		t.Error("Expected the session to be finished")
+	}
+}
+
+func TestContinueInputMustCoverEveryConflict(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	setupTwoConflicts(h)
+	h.Run("git-anticipate", "dev")
+
+	input := filepath.Join(t.TempDir(), "input.json")
+	os.WriteFile(input, []byte(`{"a.txt": "ours", "b.txt": "theirs"}`), 0644)
+
+	output := h.RunExpectFailure("git-anticipate", "--continue", "--no-verify", "--input", input)
+	if !strings.Contains(output, "missing") || !strings.Contains(output, "c.txt") {
+		t.Errorf("Expected c.txt to be reported as missing, got: %s", output)
+	}
+	if !strings.Contains(h.RunExpectSuccess("git", "status", "--porcelain"), "UU a.txt") {
+		t.Error("Expected nothing to be resolved when the input is incomplete")
+	}
+}
+
+// =============================================================================
+// TEST: Resolution Note
+// --note records the target and resolved files as a git note on the commit
+// =============================================================================
+
+func TestContinueNote(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--note")
+
+	devSHA := h.RunExpectSuccess("git", "rev-parse", "dev")
+	note := h.RunExpectSuccess("git", "notes", "--ref", "anticipate", "show", "HEAD")
+	for _, want := range []string{"Target: dev", "Target SHA: " + devSHA, "Resolved files:\n    file.txt"} {
+		if !strings.Contains(note, want) {
+			t.Errorf("Expected %q in the note, got: %s", want, note)
+		}
+	}
+}
+
+func TestContinueNoteCustomRef(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--note", "--notes-ref", "refs/notes/review")
+
+	if note := h.RunExpectSuccess("git", "notes", "--ref", "review", "show", "HEAD"); !strings.Contains(note, "Target: dev") {
+		t.Errorf("Expected the note under refs/notes/review, got: %s", note)
+	}
+	if _, code := h.RunExitCode("git", "notes", "--ref", "anticipate", "show", "HEAD"); code == 0 {
+		t.Error("Expected no note under the default ref")
+	}
+}
+
+// =============================================================================
+// TEST: Relative Paths
+// Run from a subdirectory, paths are shown relative to it like git does
+// =============================================================================
+
+func setupSubdirConflict(h *TestHelper) {
+	h.t.Helper()
+	h.InitRepo()
+	h.WriteFile("src/file.txt", "original")
+	h.Commit("initial")
+
+	h.Branch("dev")
+	h.WriteFile("src/file.txt", "dev")
+	h.Commit("dev changes")
+
+	h.Checkout("main")
+	h.Branch("feature")
+	h.WriteFile("src/file.txt", "feature")
+	h.Commit("feature changes")
+}
+
+func TestConflictPathsRelativeToCwd(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	setupSubdirConflict(h)
+	output := h.RunInDir("src", "git-anticipate", "dev")
+	if !strings.Contains(output, "❌ file.txt") || !strings.Contains(output, "git add file.txt") {
+		t.Errorf("Expected file.txt relative to src/, got: %s", output)
+	}
+	if strings.Contains(output, "src/file.txt") {
+		t.Errorf("Expected no root-relative paths, got: %s", output)
+	}
+
+	// The whole session works from the subdirectory
+	h.WriteFile("src/file.txt", "merged")
+	h.RunInDir("src", "git", "add", "file.txt")
+	h.RunInDir("src", "git-anticipate", "--continue", "--no-verify")
+	if content := h.RunExpectSuccess("git", "show", "HEAD:src/file.txt"); content != "merged" {
+		t.Errorf("Expected the resolution to be committed, got: %s", content)
+	}
+}
+
+func TestConflictPathsRelativeToRoot(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	setupSubdirConflict(h)
+	output := h.RunInDir("src", "git-anticipate", "--relative", "root", "dev")
+	if !strings.Contains(output, "❌ src/file.txt") {
+		t.Errorf("Expected src/file.txt with --relative=root, got: %s", output)
+	}
+}
+
+// =============================================================================
+// TEST: No-op Resolution
+// A resolution identical to the current branch creates no commit
+// =============================================================================
+
+func TestResolutionMatchingHeadCreatesNoCommit(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	before := h.CommitCount()
+	h.Run("git-anticipate", "dev")
+	// Keep the feature side exactly
+	h.WriteFile("file.txt", "feature")
+	h.Run("git", "add", "file.txt")
+
+	output := h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify")
+	if !strings.Contains(output, "No changes to commit") {
+		t.Errorf("Expected the no-changes message, got: %s", output)
+	}
+	if after := h.CommitCount(); after != before {
+		t.Errorf("Expected no new commit, had %d commits and now %d", before, after)
+	}
+	if h.FileExists(".git/anticipate") {
+		t.Error("Expected the session to be finished")
+	}
+}
+
+func TestReappliedContentMatchingHeadCreatesNoCommit(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	before := h.CommitCount()
+	h.Run("git-anticipate", "dev")
+	// The index differs from HEAD, but the working tree that gets
+	// reapplied is back to the current branch's version
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+	h.WriteFile("file.txt", "feature")
+
+	output := h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--no-stage")
+	if !strings.Contains(output, "No changes to commit") {
+		t.Errorf("Expected the no-changes message, got: %s", output)
+	}
+	if after := h.CommitCount(); after != before {
+		t.Errorf("Expected no new commit, had %d commits and now %d", before, after)
+	}
+}
+
+// =============================================================================
+// TEST: Timings
+// --timings reports how long each phase of start and continue took
+// =============================================================================
+
+func TestTimingsReport(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	output := h.Run("git-anticipate", "--timings", "dev")
+	for _, phase := range []string{"Timings:", "merge", "conflict detection", "total"} {
+		if !strings.Contains(output, phase) {
+			t.Errorf("Expected %q in the start timings, got: %s", phase, output)
+		}
+	}
+
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+	output = h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--timings", "--json")
+	var result struct {
+		Timings []struct{ Phase string }
+	}
+	if err := json.Unmarshal([]byte(output), &result); err != nil {
+		t.Fatalf("Expected JSON output, got: %s (%v)", output, err)
+	}
+	phases := []string{}
+	for _, timing := range result.Timings {
+		phases = append(phases, timing.Phase)
+	}
+	if got := strings.Join(phases, ","); got != "capture,reapply,commit" {
+		t.Errorf("Expected capture, reapply and commit phases, got: %s", got)
+	}
+}
+
+// =============================================================================
+// TEST: Large Files
+// Resolved contents are streamed through the object store, not held in memory
+// =============================================================================
+
+func TestLargeFileResolutionIsStreamed(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peak memory is read from Linux rusage")
+	}
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	// Let git stream big files too, so only anticipate's own use is measured
+	h.RunExpectSuccess("git", "config", "core.bigFileThreshold", "1m")
+	h.Checkout("dev")
+	// Written in chunks: a child's peak memory includes the parent's at
+	// the time it was started
+	const size = 64 << 20
+	f, err := os.Create(filepath.Join(h.repoDir, "big.bin"))
+	if err != nil {
+		t.Fatalf("failed to create big.bin: %v", err)
+	}
+	chunk := []byte(strings.Repeat("0123456789abcdef", 1<<16))
+	for written := 0; written < size; written += len(chunk) {
+		f.Write(chunk)
+	}
+	f.Close()
+	h.Commit("add big file")
+	h.Checkout("feature")
+
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	cmd := exec.Command("git-anticipate", "--continue", "--no-verify")
+	cmd.Dir = h.repoDir
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Expected continue to succeed: %v\n%s", err, output)
+	}
+	// Maxrss is in kilobytes on Linux
+	if peak := cmd.ProcessState.SysUsage().(*syscall.Rusage).Maxrss * 1024; peak >= size {
+		t.Errorf("Expected peak memory below the %d byte file, got %d", size, peak)
+	}
+	if info, err := os.Stat(filepath.Join(h.repoDir, "big.bin")); err != nil || info.Size() != size {
+		t.Errorf("Expected big.bin to be restored at full size, got %v (%v)", info, err)
+	}
+	if got := strings.TrimSpace(h.RunExpectSuccess("git", "cat-file", "-s", "HEAD:big.bin")); got != fmt.Sprint(size) {
+		t.Errorf("Expected big.bin to be committed at full size, got %s", got)
+	}
+}
+
+// =============================================================================
+// TEST: New Branch
+// --new-branch commits the resolution on a fresh branch from the original HEAD
+// =============================================================================
+
+func TestContinueNewBranch(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	featureHead := h.RunExpectSuccess("git", "rev-parse", "feature")
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	output := h.RunExpectFailure("git-anticipate", "--continue", "--no-verify", "--new-branch", "dev")
+	if !strings.Contains(output, "branch 'dev' already exists") {
+		t.Errorf("Expected an existing branch to be refused, got: %s", output)
+	}
+
+	output = h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--new-branch", "feature-prepared")
+	if !strings.Contains(output, "Resolution committed to feature-prepared") {
+		t.Errorf("Expected the new branch in the output, got: %s", output)
+	}
+	if branch := h.CurrentBranch(); branch != "feature-prepared" {
+		t.Errorf("Expected to be on feature-prepared, got %s", branch)
+	}
+	if head := h.RunExpectSuccess("git", "rev-parse", "feature"); head != featureHead {
+		t.Errorf("Expected feature to stay at %s, got %s", featureHead, head)
+	}
+	if parent := h.RunExpectSuccess("git", "rev-parse", "feature-prepared^"); parent != featureHead {
+		t.Errorf("Expected the new branch to start from feature, got parent %s", parent)
+	}
+	if content := h.RunExpectSuccess("git", "show", "feature-prepared:file.txt"); content != "merged" {
+		t.Errorf("Expected the resolution on the new branch, got: %s", content)
+	}
+}
+
+// =============================================================================
+// TEST: Short Status
+// --status --short prints one line for shell prompts and always exits 0
+// =============================================================================
+
+func TestShortStatusIdle(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	output, code := h.RunExitCode("git-anticipate", "--status", "--short")
+	if code != 0 {
+		t.Errorf("Expected exit code 0, got %d", code)
+	}
+	if output != "anticipate: none\n" {
+		t.Errorf("Expected the idle line, got: %q", output)
+	}
+}
+
+func TestShortStatusInProgress(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	setupTwoConflicts(h)
+	h.Run("git-anticipate", "dev")
+
+	output, code := h.RunExitCode("git-anticipate", "--status", "--short")
+	if code != 0 {
+		t.Errorf("Expected exit code 0, got %d", code)
+	}
+	if output != "anticipate: feature→dev, 3 conflicts\n" {
+		t.Errorf("Expected the in-progress line, got: %q", output)
+	}
+
+	h.Run("git", "add", "a.txt", "b.txt")
+	if output := h.RunExpectSuccess("git-anticipate", "--status", "--short"); output != "anticipate: feature→dev, 1 conflict\n" {
+		t.Errorf("Expected one conflict left, got: %q", output)
+	}
+
+	h.Run("git", "add", "c.txt")
+	if output := h.RunExpectSuccess("git-anticipate", "--status", "--short"); output != "anticipate: feature→dev, resolved\n" {
+		t.Errorf("Expected the resolved line, got: %q", output)
+	}
+}
+
+// =============================================================================
+// TEST: ASCII Output
+// GIT_ANTICIPATE_ASCII and non-UTF-8 locales replace the emoji with ASCII
+// =============================================================================
+
+// assertASCII fails the test if output has any byte outside ASCII
+func assertASCII(t *testing.T, output string) {
+	t.Helper()
+	for i := 0; i < len(output); i++ {
+		if output[i] > 0x7f {
+			t.Errorf("Expected ASCII-only output, got: %s", output)
+			return
+		}
+	}
+}
+
+func TestASCIIOutputFromEnv(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+	t.Setenv("GIT_ANTICIPATE_ASCII", "1")
+
+	h.SetupConflict()
+	output := h.Run("git-anticipate", "dev")
+	assertASCII(t, output)
+	if !strings.Contains(output, "[x] file.txt") {
+		t.Errorf("Expected the ASCII conflict marker, got: %s", output)
+	}
+	assertASCII(t, h.RunExpectSuccess("git-anticipate", "--status"))
+	assertASCII(t, h.RunExpectSuccess("git-anticipate", "--status", "--short"))
+
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+	assertASCII(t, h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify"))
+	assertASCII(t, h.RunExpectSuccess("git-anticipate", "--status"))
+}
+
+func TestASCIIOutputForNonUTF8Locale(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+	t.Setenv("GIT_ANTICIPATE_ASCII", "")
+	t.Setenv("LC_ALL", "C")
+
+	h.SetupConflict()
+	assertASCII(t, h.Run("git-anticipate", "dev"))
+
+	t.Setenv("LC_ALL", "en_US.UTF-8")
+	if output := h.RunExpectSuccess("git-anticipate", "--status"); !strings.Contains(output, "❌ file.txt") {
+		t.Errorf("Expected emoji with a UTF-8 locale, got: %s", output)
+	}
+}
+
+// =============================================================================
+// TEST: Empty Resolutions
+// --empty decides whether a resolution that changes nothing is committed
+// =============================================================================
+
+func TestEmptyDropSkipsCommit(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	before := h.CommitCount()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "feature")
+	h.Run("git", "add", "file.txt")
+
+	output := h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--empty=drop")
+	if !strings.Contains(output, "No changes to commit") {
+		t.Errorf("Expected the no-changes message, got: %s", output)
+	}
+	if after := h.CommitCount(); after != before {
+		t.Errorf("Expected no new commit, had %d commits and now %d", before, after)
+	}
+}
+
+func TestEmptyKeepCommitsEmpty(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	before := h.CommitCount()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "feature")
+	h.Run("git", "add", "file.txt")
+
+	output := h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--empty=keep")
+	if !strings.Contains(output, "committing it empty") {
+		t.Errorf("Expected a note about the empty commit, got: %s", output)
+	}
+	if after := h.CommitCount(); after != before+1 {
+		t.Errorf("Expected one new commit, had %d commits and now %d", before, after)
+	}
+	if diff := h.RunExpectSuccess("git", "diff", "--name-only", "HEAD^", "HEAD"); diff != "" {
+		t.Errorf("Expected the commit to be empty, got changes in: %s", diff)
+	}
+	if msg := h.LastCommitMessage(); !strings.HasPrefix(msg, "Preemptive conflict resolution vs dev@") {
+		t.Errorf("Expected the default message, got: %s", msg)
+	}
+	if h.FileExists(".git/anticipate") {
+		t.Error("Expected the session to be finished")
+	}
+}
+
+func TestEmptyInvalidMode(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.Run("git", "add", "file.txt")
+
+	output := h.RunExpectFailure("git-anticipate", "--continue", "--empty=stop")
+	if !strings.Contains(output, "invalid --empty 'stop'") {
+		t.Errorf("Expected invalid mode error, got: %s", output)
+	}
+}
+
+// =============================================================================
+// TEST: Strip Markers
+// strip-markers resolves every hunk of a file to the chosen side
+// =============================================================================
+
+func TestStripMarkersEachSide(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.InitRepo()
+	// Far enough apart for git to keep the two conflicts separate
+	middle := "3\n4\n5\n6\n7\n8\n9\n10\n"
+	h.WriteFile("file.txt", "1\n2\n"+middle+"11\n12\n")
+	h.Commit("initial")
+	h.Branch("dev")
+	h.WriteFile("file.txt", "1\n2 dev\n"+middle+"11 dev\n12\n")
+	h.Commit("dev changes")
+	h.Checkout("main")
+	h.Branch("feature")
+	h.WriteFile("file.txt", "1\n2 feature\n"+middle+"11 feature\n12\n")
+	h.Commit("feature changes")
+	h.Run("git-anticipate", "dev")
+
+	want := map[string]string{
+		"ours":   "1\n2 feature\n" + middle + "11 feature\n12\n",
+		"theirs": "1\n2 dev\n" + middle + "11 dev\n12\n",
+		"union":  "1\n2 feature\n2 dev\n" + middle + "11 feature\n11 dev\n12\n",
+	}
+	for _, side := range []string{"ours", "theirs", "union"} {
+		h.RunExpectSuccess("git", "checkout", "-m", "--", "file.txt")
+		output := h.RunExpectSuccess("git-anticipate", "strip-markers", "--"+side, "file.txt")
+		if !strings.Contains(output, "Resolved 2 conflicts in file.txt") {
+			t.Errorf("Expected two hunks resolved with --%s, got: %s", side, output)
+		}
+		if got := h.ReadFile("file.txt"); got != want[side] {
+			t.Errorf("Expected --%s to give %q, got %q", side, want[side], got)
+		}
+	}
+}
+
+func TestStripMarkersNeedsOneSide(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+
+	output := h.RunExpectFailure("git-anticipate", "strip-markers", "file.txt")
+	if !strings.Contains(output, "choose the side to keep") {
+		t.Errorf("Expected a missing side error, got: %s", output)
+	}
+	output = h.RunExpectFailure("git-anticipate", "strip-markers", "--ours", "--theirs", "file.txt")
+	if !strings.Contains(output, "--ours and --theirs cannot be combined") {
+		t.Errorf("Expected a conflicting sides error, got: %s", output)
+	}
+}
+
+// =============================================================================
+// TEST: Protected Branches
+// --continue refuses to commit onto a protected branch unless forced
+// =============================================================================
+
+func setupConflictOnMain(h *TestHelper) {
+	h.t.Helper()
+	h.InitRepo()
+	h.WriteFile("file.txt", "original")
+	h.Commit("initial")
+	h.Branch("dev")
+	h.WriteFile("file.txt", "dev")
+	h.Commit("dev changes")
+	h.Checkout("main")
+	h.WriteFile("file.txt", "main")
+	h.Commit("main changes")
+}
+
+func TestProtectedBranchRefused(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	setupConflictOnMain(h)
+	h.RunExpectSuccess("git", "config", "anticipate.protectedBranches", "main, release/*")
+	before := h.CommitCount()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	output := h.RunExpectFailure("git-anticipate", "--continue", "--no-verify")
+	if !strings.Contains(output, "protected branch 'main'") {
+		t.Errorf("Expected a protected branch refusal, got: %s", output)
+	}
+	if !h.FileExists(".git/anticipate") || h.ReadFile("file.txt") != "merged" {
+		t.Error("Expected the session and resolution to be left alone")
+	}
+
+	h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--force")
+	if after := h.CommitCount(); after != before+1 {
+		t.Errorf("Expected --force to commit, had %d commits and now %d", before, after)
+	}
+}
+
+func TestProtectFlag(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	setupConflictOnMain(h)
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	output := h.RunExpectFailure("git-anticipate", "--continue", "--no-verify", "--protect", "ma*")
+	if !strings.Contains(output, "protected branch 'main'") {
+		t.Errorf("Expected --protect to refuse main, got: %s", output)
+	}
+	h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--protect", "release/*")
+}
+
+// =============================================================================
+// TEST: Continue Dry Run
+// --continue --dry-run prints the plan and leaves the session untouched
+// =============================================================================
+
+func TestContinueDryRun(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.WriteFile("notes.txt", "original notes")
+	h.Commit("add notes")
+	head := h.RunExpectSuccess("git", "rev-parse", "HEAD")
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+	h.WriteFile("notes.txt", "local notes")
+	index := h.ReadFile(".git/index")
+
+	output := h.RunExpectSuccess("git-anticipate", "--continue", "--dry-run", "-m", "Prepare for dev")
+	for _, want := range []string{"    file.txt", "Would keep out of the commit:\n    notes.txt", "Commit message:\n    Prepare for dev", "nothing was changed"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Expected %q in the plan, got: %s", want, output)
+		}
+	}
+
+	if now := h.RunExpectSuccess("git", "rev-parse", "HEAD"); now != head {
+		t.Errorf("Expected HEAD to stay at %s, got %s", head, now)
+	}
+	if !h.FileExists(".git/anticipate") || !h.FileExists(".git/MERGE_HEAD") {
+		t.Error("Expected the session and trial merge to still be in progress")
+	}
+	if h.ReadFile(".git/index") != index {
+		t.Error("Expected the index to be untouched")
+	}
+	if h.ReadFile("file.txt") != "merged" || h.ReadFile("notes.txt") != "local notes" {
+		t.Error("Expected the working tree to be untouched")
+	}
+
+	// A real continue still works afterwards
+	h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify")
+	if content := h.RunExpectSuccess("git", "show", "HEAD:file.txt"); content != "merged" {
+		t.Errorf("Expected the resolution to be committed, got: %s", content)
+	}
+}
+
+// =============================================================================
+// TEST: HEAD Moved
+// --continue refuses to reset away commits made on the branch mid-session
+// =============================================================================
+
+func TestContinueRefusesWhenHeadMoved(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+	h.RunExpectSuccess("git", "commit", "-q", "--no-edit")
+	h.WriteFile("extra.txt", "more work")
+	h.Commit("extra work")
+	head := h.RunExpectSuccess("git", "rev-parse", "HEAD")
+
+	output := h.RunExpectFailure("git-anticipate", "--continue", "--no-verify")
+	if !strings.Contains(output, "HEAD moved since the session started") || !strings.Contains(output, "extra work") {
+		t.Errorf("Expected a refusal listing the new commit, got: %s", output)
+	}
+	if now := h.RunExpectSuccess("git", "rev-parse", "HEAD"); now != head {
+		t.Errorf("Expected HEAD to stay at %s, got %s", head, now)
+	}
+	if !h.FileExists(".git/anticipate") {
+		t.Error("Expected the session to be kept")
+	}
+
+	output = h.RunExpectFailure("git-anticipate", "--continue", "--no-verify", "--force")
+	if !strings.Contains(output, "--discard-moved-head") {
+		t.Errorf("Expected --force not to override the HEAD check, got: %s", output)
+	}
+
+	h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--discard-moved-head")
+	if h.FileExists(".git/anticipate") {
+		t.Error("Expected --discard-moved-head to finish the session")
+	}
+}
+
+// =============================================================================
+// TEST: Deleting a Conflicting File
+// A conflicting file removed without 'git rm' is committed as a deletion
+// =============================================================================
+
+func TestDeletedConflictWithoutGitRm(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.WriteFile("other.txt", "kept")
+	h.Commit("add other")
+	h.Run("git-anticipate", "dev")
+	h.DeleteFile("file.txt")
+
+	output := h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify")
+	if !strings.Contains(output, "file.txt was deleted") {
+		t.Errorf("Expected the deletion to be reported, got: %s", output)
+	}
+	if tree := h.RunExpectSuccess("git", "ls-tree", "--name-only", "HEAD"); strings.Contains(tree, "file.txt") {
+		t.Errorf("Expected file.txt to be deleted in the commit, got tree: %s", tree)
+	}
+	if h.FileExists("file.txt") {
+		t.Error("Expected file.txt to stay deleted in the working tree")
+	}
+}
+
+func TestModifyDeleteConflictResolvedByDeleting(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.InitRepo()
+	h.WriteFile("file.txt", "original")
+	h.WriteFile("other.txt", "kept")
+	h.Commit("initial")
+	h.Branch("dev")
+	h.DeleteFile("file.txt")
+	h.Commit("remove file")
+	h.Checkout("main")
+	h.Branch("feature")
+	h.WriteFile("file.txt", "feature")
+	h.Commit("feature changes")
+
+	h.Run("git-anticipate", "dev")
+	if !h.FileExists("file.txt") {
+		t.Fatal("Expected git to leave the modified side in the working tree")
+	}
+	h.DeleteFile("file.txt")
+
+	h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify")
+	if tree := h.RunExpectSuccess("git", "ls-tree", "--name-only", "HEAD"); strings.Contains(tree, "file.txt") {
+		t.Errorf("Expected file.txt to be deleted in the commit, got tree: %s", tree)
+	}
+}
+
+// =============================================================================
+// TEST: Install
+// install adds alias.anticipate to the global config, idempotently
+// =============================================================================
+
+func TestInstallWritesAlias(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	global := filepath.Join(t.TempDir(), "gitconfig")
+	t.Setenv("GIT_CONFIG_GLOBAL", global)
+
+	output := h.RunExpectSuccess("git-anticipate", "install", "--alias")
+	if !strings.Contains(output, "Added alias.anticipate = !git-anticipate") {
+		t.Errorf("Expected the alias to be added, got: %s", output)
+	}
+	if alias := h.RunExpectSuccess("git", "config", "--file", global, "alias.anticipate"); alias != "!git-anticipate\n" {
+		t.Errorf("Expected the alias in the global config, got: %q", alias)
+	}
+
+	output = h.RunExpectSuccess("git-anticipate", "install", "--alias")
+	if !strings.Contains(output, "already set") {
+		t.Errorf("Expected a second install to change nothing, got: %s", output)
+	}
+}
+
+func TestInstallKeepsExistingAlias(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	global := filepath.Join(t.TempDir(), "gitconfig")
+	t.Setenv("GIT_CONFIG_GLOBAL", global)
+	h.RunExpectSuccess("git", "config", "--file", global, "alias.anticipate", "!my-wrapper")
+
+	output := h.RunExpectSuccess("git-anticipate", "install", "--alias")
+	if !strings.Contains(output, "leaving it alone") {
+		t.Errorf("Expected the existing alias to be kept, got: %s", output)
+	}
+	if alias := h.RunExpectSuccess("git", "config", "--file", global, "alias.anticipate"); alias != "!my-wrapper\n" {
+		t.Errorf("Expected the alias to be unchanged, got: %q", alias)
+	}
+}
+
+// =============================================================================
+// TEST: Edit Message
+// --edit shows the resolution below a scissors line that is not committed
+// =============================================================================
+
+func TestContinueEditStripsScissors(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	buffer := filepath.Join(t.TempDir(), "buffer")
+	editor := filepath.Join(t.TempDir(), "editor.sh")
+	script := "#!/bin/sh\ncp \"$1\" " + buffer + "\nsed -i '1s/.*/User text/' \"$1\"\n"
+	if err := os.WriteFile(editor, []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to write editor: %v", err)
+	}
+	t.Setenv("GIT_EDITOR", editor)
+
+	output := h.RunExpectFailure("git-anticipate", "--continue", "--no-verify", "--edit", "--cleanup=strip")
+	if !strings.Contains(output, "--edit needs --cleanup=scissors") {
+		t.Errorf("Expected other cleanup modes to be refused, got: %s", output)
+	}
+
+	h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--edit")
+	seen, err := os.ReadFile(buffer)
+	if err != nil {
+		t.Fatalf("Expected the editor to be opened: %v", err)
+	}
+	if !strings.Contains(string(seen), "# ------------------------ >8 ------------------------") {
+		t.Errorf("Expected a scissors line in the editor, got: %s", seen)
+	}
+	if !strings.Contains(string(seen), "    file.txt") {
+		t.Errorf("Expected the resolved file below the scissors, got: %s", seen)
+	}
+	if body := h.RunExpectSuccess("git", "log", "-1", "--format=%B"); strings.TrimSpace(body) != "User text" {
+		t.Errorf("Expected only the user's text to be committed, got: %q", body)
+	}
+}
+
+// =============================================================================
+// TEST: Recommit After Interruption
+// --recommit commits a resolution left behind by a --continue killed after
+// the reset, without losing other working-tree edits
+// =============================================================================
+
+func TestRecommitAfterInterruptedContinue(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.WriteFile("notes.txt", "base notes")
+	h.Run("git", "add", "notes.txt")
+	h.Run("git", "commit", "-m", "Add notes")
+	origHead := strings.TrimSpace(h.RunExpectSuccess("git", "rev-parse", "HEAD"))
+	h.Run("git-anticipate", "dev")
+
+	// Simulate a --continue that died right after 'git reset --hard'
+	// and writing the resolved file back
+	stateFile := filepath.Join(h.repoDir, ".git", "anticipate", "reapplying")
+	if err := os.WriteFile(stateFile, []byte("file.txt\n"), 0644); err != nil {
+		t.Fatalf("Failed to write state: %v", err)
+	}
+	h.Run("git", "merge", "--abort")
+	h.Run("git", "reset", "--hard", origHead)
+	h.WriteFile("file.txt", "merged")
+	h.WriteFile("notes.txt", "local notes")
+
+	output := h.RunExpectFailure("git-anticipate", "--continue", "--no-verify")
+	if !strings.Contains(output, "--continue --recommit") {
+		t.Errorf("Expected a pointer to --recommit, got: %s", output)
+	}
+
+	output = h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--recommit")
+	if !strings.Contains(output, "Recovering the interrupted resolution") {
+		t.Errorf("Expected the recovery message, got: %s", output)
+	}
+	if content := h.RunExpectSuccess("git", "show", "HEAD:file.txt"); content != "merged" {
+		t.Errorf("Expected the recovered resolution to be committed, got: %s", content)
+	}
+	if parent := strings.TrimSpace(h.RunExpectSuccess("git", "rev-parse", "HEAD^")); parent != origHead {
+		t.Errorf("Expected the commit on top of %s, got parent %s", origHead, parent)
+	}
+	if files := h.RunExpectSuccess("git", "show", "--name-only", "--format=", "HEAD"); strings.TrimSpace(files) != "file.txt" {
+		t.Errorf("Expected only file.txt in the commit, got: %s", files)
+	}
+	if content := h.ReadFile("notes.txt"); content != "local notes" {
+		t.Errorf("Expected the unrelated edit to survive, got: %s", content)
+	}
+	if h.FileExists(".git/anticipate") {
+		t.Error("Expected the session to be finished")
+	}
+}
+
+func TestRecommitWithoutInterruption(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	output := h.RunExpectFailure("git-anticipate", "--continue", "--no-verify", "--recommit")
+	if !strings.Contains(output, "no interrupted --continue to recover") {
+		t.Errorf("Expected --recommit to be refused, got: %s", output)
+	}
+}
+
+// =============================================================================
+// TEST: Reverse Direction
+// --into previews merging the current branch into the target, leaving the
+// checkout and working tree as they were
+// =============================================================================
+
+func TestIntoReportsConflictsOnTarget(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Checkout("dev")
+	h.WriteFile("dev-only.txt", "dev")
+	h.Commit("dev-only file")
+	h.Checkout("feature")
+	head := h.RunExpectSuccess("git", "rev-parse", "HEAD")
+	h.WriteFile("scratch.txt", "uncommitted")
+
+	output, code := h.RunExitCode("git-anticipate", "--into", "dev")
+	if code != 1 {
+		t.Errorf("Expected exit code 1 for conflicts, got %d: %s", code, output)
+	}
+	if !strings.Contains(output, "Attempting merge of feature into dev") {
+		t.Errorf("Expected the merge direction to be reported, got: %s", output)
+	}
+	if !strings.Contains(output, "❌ file.txt") || strings.Contains(output, "dev-only.txt") {
+		t.Errorf("Expected only file.txt to conflict, got: %s", output)
+	}
+
+	if branch := h.CurrentBranch(); branch != "feature" {
+		t.Errorf("Expected to stay on feature, got %s", branch)
+	}
+	if after := h.RunExpectSuccess("git", "rev-parse", "HEAD"); after != head {
+		t.Errorf("Expected HEAD to stay at %s, got %s", head, after)
+	}
+	if status := h.RunExpectSuccess("git", "status", "--porcelain"); strings.TrimSpace(status) != "?? scratch.txt" {
+		t.Errorf("Expected the working tree to be untouched, got: %s", status)
+	}
+	if content := h.ReadFile("file.txt"); content != "feature" {
+		t.Errorf("Expected file.txt to keep the feature content, got: %s", content)
+	}
+	if h.FileExists(".git/anticipate") {
+		t.Error("Expected no session to be started")
+	}
+}
+
+func TestIntoJSON(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	output, _ := h.RunExitCode("git-anticipate", "--into", "--json", "dev")
+	var result struct {
+		Target        string   `json:"target"`
+		CurrentBranch string   `json:"current_branch"`
+		Outcome       string   `json:"outcome"`
+		Conflicts     []string `json:"conflicts"`
+	}
+	if err := json.Unmarshal([]byte(output), &result); err != nil {
+		t.Fatalf("Expected JSON output, got: %s", output)
+	}
+	if result.Target != "dev" || result.CurrentBranch != "feature" || result.Outcome != "conflicts" {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+	if len(result.Conflicts) != 1 || result.Conflicts[0] != "file.txt" {
+		t.Errorf("Expected file.txt to conflict, got %v", result.Conflicts)
+	}
+}
+
+// =============================================================================
+// TEST: Conflicts Only
+// --conflicts-only commits just the conflicted files; auto-merged changes are
+// left to the real merge, and edits to them are caught
+// =============================================================================
+
+// setupConflictWithAutoMerge makes file.txt conflict with dev while dev's
+// changes to other.txt and new.txt merge cleanly
+func setupConflictWithAutoMerge(h *TestHelper) {
+	h.t.Helper()
+	h.InitRepo()
+	h.WriteFile("file.txt", "original")
+	h.WriteFile("other.txt", "original")
+	h.Commit("initial")
+
+	h.Branch("dev")
+	h.WriteFile("file.txt", "dev")
+	h.WriteFile("other.txt", "dev")
+	h.WriteFile("new.txt", "dev")
+	h.Commit("dev changes")
+
+	h.Checkout("main")
+	h.Branch("feature")
+	h.WriteFile("file.txt", "feature")
+	h.Commit("feature changes")
+}
+
+func TestConflictsOnlyCommitsConflictedFiles(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	setupConflictWithAutoMerge(h)
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	output := h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--conflicts-only")
+	if !strings.Contains(output, "Leaving 2 auto-merged files to the real merge") {
+		t.Errorf("Expected the auto-merged files to be left out, got: %s", output)
+	}
+	if files := h.RunExpectSuccess("git", "show", "--name-only", "--format=", "HEAD"); strings.TrimSpace(files) != "file.txt" {
+		t.Errorf("Expected only the conflicted file in the commit, got: %s", files)
+	}
+	if content := h.ReadFile("other.txt"); content != "original" {
+		t.Errorf("Expected other.txt to stay as on feature, got: %s", content)
+	}
+	if h.FileExists("new.txt") {
+		t.Error("Expected new.txt to be left to the real merge")
+	}
+}
+
+func TestEditedAutoMergedFileIsReported(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	setupConflictWithAutoMerge(h)
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.WriteFile("other.txt", "dev, edited")
+	h.Run("git", "add", "file.txt")
+
+	output := h.RunExpectFailure("git-anticipate", "--continue", "--no-verify", "--conflicts-only")
+	if !strings.Contains(output, "--conflicts-only would drop the edits") || !strings.Contains(output, "other.txt") {
+		t.Errorf("Expected the edited auto-merged file to be refused, got: %s", output)
+	}
+
+	output = h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify")
+	if !strings.Contains(output, "differ from what the merge produced") || !strings.Contains(output, "    other.txt") {
+		t.Errorf("Expected a warning about other.txt, got: %s", output)
+	}
+	if strings.Contains(output, "    new.txt") {
+		t.Errorf("Expected new.txt to match the merge, got: %s", output)
+	}
+	if content := h.RunExpectSuccess("git", "show", "HEAD:other.txt"); content != "dev, edited" {
+		t.Errorf("Expected the edit to be committed, got: %s", content)
+	}
+}
+
+// =============================================================================
+// TEST: Default Target
+// With no target, the default branch is found from anticipate.defaultTarget
+// or origin/HEAD and used with --default
+// =============================================================================
+
+func TestDefaultTargetFromOriginHead(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git", "branch", "develop", "dev")
+	h.Run("git", "update-ref", "refs/remotes/origin/develop", "develop")
+	h.Run("git", "symbolic-ref", "refs/remotes/origin/HEAD", "refs/remotes/origin/develop")
+
+	output := h.RunExpectFailure("git-anticipate")
+	if !strings.Contains(output, "The default target is origin/develop") {
+		t.Errorf("Expected origin/develop to be offered, got: %s", output)
+	}
+	if h.FileExists(".git/anticipate") {
+		t.Error("Expected no session without --default")
+	}
+
+	output = h.RunExpectFailure("git-anticipate", "--default", "dev")
+	if !strings.Contains(output, "--default cannot be combined with a target branch") {
+		t.Errorf("Expected --default with a target to be refused, got: %s", output)
+	}
+
+	output, code := h.RunExitCode("git-anticipate", "--default")
+	if code != 1 || !strings.Contains(output, "Target branch: origin/develop") {
+		t.Errorf("Expected a session against origin/develop, got exit %d: %s", code, output)
+	}
+	h.RunExpectSuccess("git-anticipate", "--abort")
+
+	h.Run("git", "config", "anticipate.defaultTarget", "dev")
+	output, _ = h.RunExitCode("git-anticipate", "--default")
+	if !strings.Contains(output, "Target branch: dev") {
+		t.Errorf("Expected anticipate.defaultTarget to win, got: %s", output)
+	}
+}
+
+// =============================================================================
+// TEST: Per-File Commits
+// --per-file commits each resolved file separately, deletions included
+// =============================================================================
+
+func TestContinuePerFile(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	setupTwoConflicts(h)
+	before := h.CommitCount()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("a.txt", "merged a")
+	h.WriteFile("b.txt", "merged b")
+	h.Run("git", "add", "a.txt", "b.txt")
+	h.Run("git", "rm", "-q", "c.txt")
+
+	output := h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--per-file", "-m", "Resolve dev")
+	if !strings.Contains(output, "Created 3 commits") {
+		t.Errorf("Expected three commits to be reported, got: %s", output)
+	}
+	if after := h.CommitCount(); after != before+3 {
+		t.Fatalf("Expected 3 new commits, had %d and now %d", before, after)
+	}
+
+	subjects := h.RunExpectSuccess("git", "log", "-3", "--reverse", "--format=%s")
+	expected := "Resolve dev: a.txt\nResolve dev: b.txt\nResolve dev: delete c.txt"
+	if strings.TrimSpace(subjects) != expected {
+		t.Errorf("Expected subjects:\n%s\ngot:\n%s", expected, subjects)
+	}
+	for i, file := range []string{"c.txt", "b.txt", "a.txt"} {
+		changed := h.RunExpectSuccess("git", "show", "--name-only", "--format=", fmt.Sprintf("HEAD~%d", i))
+		if strings.TrimSpace(changed) != file {
+			t.Errorf("Expected HEAD~%d to change only %s, got: %s", i, file, changed)
+		}
+	}
+	if content := h.RunExpectSuccess("git", "show", "HEAD:a.txt"); content != "merged a" {
+		t.Errorf("Expected the resolution of a.txt, got: %s", content)
+	}
+	if status := h.RunExpectSuccess("git", "status", "--porcelain"); strings.TrimSpace(status) != "" {
+		t.Errorf("Expected a clean working tree, got: %s", status)
+	}
+}
+
+// =============================================================================
+// TEST: Target Already Merged
+// A target the current branch already contains starts no session
+// =============================================================================
+
+func TestTargetAlreadyMerged(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.InitRepo()
+	h.WriteFile("file.txt", "original")
+	h.Commit("initial")
+	h.Branch("dev")
+	h.Checkout("main")
+	h.Branch("feature")
+	h.WriteFile("file.txt", "feature")
+	h.Commit("feature changes")
+
+	output := h.RunExpectSuccess("git-anticipate", "dev")
+	if !strings.Contains(output, "dev is already merged into feature - nothing to anticipate") {
+		t.Errorf("Expected the already-merged message, got: %s", output)
+	}
+	if h.FileExists(".git/anticipate") {
+		t.Error("Expected no session state to be left")
+	}
+	if h.FileExists(".git/MERGE_HEAD") {
+		t.Error("Expected no merge to be started")
+	}
+}
+
+// =============================================================================
+// TEST: Keep Index
+// --keep-index commits exactly the staged entries, without re-adding files
+// through the clean filters
+// =============================================================================
+
+func TestContinueKeepIndex(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+
+	// Stage a blob the clean filter would never produce, so re-adding the
+	// file would change what is committed
+	h.WriteFile(".git/info/attributes", "file.txt filter=upper\n")
+	h.Run("git", "config", "filter.upper.clean", "tr a-z A-Z")
+	h.Run("git", "config", "filter.upper.smudge", "cat")
+	blob := strings.TrimSpace(h.RunWithInput("merged by hand\n", "git", "hash-object", "-w", "--stdin"))
+	h.Run("git", "update-index", "--cacheinfo", "100644,"+blob+",file.txt")
+	h.WriteFile("file.txt", "working tree only")
+	staged := strings.TrimSpace(h.RunExpectSuccess("git", "write-tree"))
+
+	h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--keep-index")
+	if tree := strings.TrimSpace(h.RunExpectSuccess("git", "rev-parse", "HEAD^{tree}")); tree != staged {
+		t.Errorf("Expected the committed tree to be the staged tree %s, got %s", staged, tree)
+	}
+	if content := h.RunExpectSuccess("git", "show", "HEAD:file.txt"); content != "merged by hand\n" {
+		t.Errorf("Expected the staged blob to be committed as-is, got: %q", content)
+	}
+}
+
+// =============================================================================
+// TEST: Message Prefix
+// --message-prefix prepends to the default message and keeps trailers
+// =============================================================================
+
+func TestContinueMessagePrefix(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	output := h.RunExpectFailure("git-anticipate", "--continue", "--no-verify", "--message-prefix", "[WIP]", "-m", "Custom")
+	if !strings.Contains(output, "--message-prefix only applies to the default message") {
+		t.Errorf("Expected --message-prefix with -m to be refused, got: %s", output)
+	}
+
+	h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--message-prefix", "[OPS-42]", "--trailer", "Ticket=OPS-42")
+	message := h.RunExpectSuccess("git", "log", "-1", "--format=%B")
+	if !strings.HasPrefix(message, "[OPS-42] Preemptive conflict resolution vs dev@") {
+		t.Errorf("Expected the prefix before the default message, got: %s", message)
+	}
+	if !strings.Contains(message, "\n\nTicket: OPS-42") {
+		t.Errorf("Expected the trailer to be kept, got: %s", message)
+	}
+}
+
+// =============================================================================
+// TEST: Dubious Ownership
+// A repository git refuses for its owner gets safe.directory guidance
+// =============================================================================
+
+func TestDubiousOwnershipGuidance(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	wrapper := filepath.Join(t.TempDir(), "git-wrapper")
+	script := "#!/bin/sh\n" +
+		"if [ \"$1\" = rev-parse ]; then\n" +
+		"  echo \"fatal: detected dubious ownership in repository at '/srv/ci/repo'\" >&2\n" +
+		"  exit 128\n" +
+		"fi\n" +
+		"exec git \"$@\"\n"
+	if err := os.WriteFile(wrapper, []byte(script), 0755); err != nil {
+		t.Fatalf("failed to write wrapper: %v", err)
+	}
+
+	output := h.RunExpectFailure("git-anticipate", "--git", wrapper, "dev")
+	if !strings.Contains(output, "owned by another user") {
+		t.Errorf("Expected the ownership problem to be explained, got: %s", output)
+	}
+	if !strings.Contains(output, "git config --global --add safe.directory /srv/ci/repo") {
+		t.Errorf("Expected the safe.directory command, got: %s", output)
+	}
+	if strings.Contains(output, "not a git repository") {
+		t.Errorf("Expected no generic error, got: %s", output)
+	}
+}
+
+// =============================================================================
+// TEST: Preserve Modification Times
+// --preserve-mtime gives files written back by --continue their old mtimes
+// =============================================================================
+
+func TestContinuePreserveMtime(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	path := filepath.Join(h.repoDir, "file.txt")
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatalf("Failed to set mtime: %v", err)
+	}
+
+	h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--preserve-mtime")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Expected file.txt to exist: %v", err)
+	}
+	if diff := info.ModTime().Sub(mtime); diff < -time.Second || diff > time.Second {
+		t.Errorf("Expected the mtime to stay at %v, got %v", mtime, info.ModTime())
+	}
+	if content := h.RunExpectSuccess("git", "show", "HEAD:file.txt"); content != "merged" {
+		t.Errorf("Expected the resolution to be committed, got: %s", content)
+	}
+}
+
+// =============================================================================
+// TEST: Target Pattern
+// --target-pattern checks every matching local and remote branch without
+// starting a session
+// =============================================================================
+
+func TestTargetPatternChecksEachBranch(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git", "branch", "release/1.0", "dev")
+	h.Run("git", "branch", "release/2.0", "main")
+	h.Run("git", "update-ref", "refs/remotes/origin/release/3.0", "dev")
+
+	output, code := h.RunExitCode("git-anticipate", "--target-pattern", "release/*")
+	if code != 1 {
+		t.Errorf("Expected exit code 1 with conflicts, got %d: %s", code, output)
+	}
+	for _, want := range []string{
+		"❌ release/1.0: 1 conflict",
+		"✔ release/2.0: clean",
+		"❌ origin/release/3.0: 1 conflict",
+		"2 of 3 branches conflict with feature",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Expected %q in the output, got: %s", want, output)
+		}
+	}
+	if strings.Contains(output, "dev:") {
+		t.Errorf("Expected non-matching branches to be skipped, got: %s", output)
+	}
+	if h.FileExists(".git/anticipate") || h.FileExists(".git/MERGE_HEAD") {
+		t.Error("Expected no session or merge to be started")
+	}
+
+	output = h.RunExpectFailure("git-anticipate", "--target-pattern", "hotfix/*")
+	if !strings.Contains(output, "no local or remote branches match 'hotfix/*'") {
+		t.Errorf("Expected a no-match error, got: %s", output)
+	}
+}
+
+// =============================================================================
+// TEST: Record Merge Parent
+// --record-merge-parent names the target commit in a trailer of a regular,
+// single-parent commit
+// =============================================================================
+
+func TestContinueRecordMergeParent(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	targetSHA := strings.TrimSpace(h.RunExpectSuccess("git", "rev-parse", "dev"))
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--record-merge-parent")
+	hint := h.RunExpectSuccess("git", "log", "-1", "--format=%(trailers:key=Anticipated-merge-parent,valueonly)")
+	if strings.TrimSpace(hint) != targetSHA {
+		t.Errorf("Expected the trailer to name %s, got: %q", targetSHA, hint)
+	}
+	if parents := h.RunExpectSuccess("git", "log", "-1", "--format=%P"); len(strings.Fields(parents)) != 1 {
+		t.Errorf("Expected a single-parent commit, got parents: %s", parents)
+	}
+}
+
+// =============================================================================
+// TEST: Finalize
+// finalize merges the target for real and reuses the preparation commit's
+// resolution for conflicts neither side has touched since
+// =============================================================================
+
+func TestFinalizeUsesStoredResolution(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+	h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--record-merge-parent")
+
+	output := h.RunExpectSuccess("git-anticipate", "finalize", "dev")
+	if !strings.Contains(output, "file.txt: applied the stored resolution") {
+		t.Errorf("Expected the stored resolution to be applied, got: %s", output)
+	}
+	devSHA := h.RunExpectSuccess("git", "rev-parse", "dev")
+	if parent := h.RunExpectSuccess("git", "rev-parse", "HEAD^2"); parent != devSHA {
+		t.Errorf("Expected a merge commit with dev as second parent, got %s", parent)
+	}
+	if content := h.RunExpectSuccess("git", "show", "HEAD:file.txt"); content != "merged" {
+		t.Errorf("Expected the merge to keep the stored resolution, got: %s", content)
+	}
+}
+
+func TestFinalizeLeavesChangedConflicts(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+	h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--note")
+
+	// The target moves on after the preparation
+	h.Checkout("dev")
+	h.WriteFile("file.txt", "dev again")
+	h.Commit("more dev changes")
+	h.Checkout("feature")
+
+	output, code := h.RunExitCode("git-anticipate", "finalize", "dev")
+	if code != 1 || !strings.Contains(output, "❌ file.txt") {
+		t.Errorf("Expected file.txt to be left conflicting, got exit %d: %s", code, output)
+	}
+	if !h.FileExists(".git/MERGE_HEAD") {
+		t.Error("Expected the merge to be left in progress")
+	}
+
+	h.Run("git", "merge", "--abort")
+	h.Run("git", "checkout", "-q", "-b", "unprepared", "main")
+	output = h.RunExpectFailure("git-anticipate", "finalize", "dev")
+	if !strings.Contains(output, "no preparation commit for dev found") {
+		t.Errorf("Expected a missing preparation to be reported, got: %s", output)
+	}
+}
+
+// =============================================================================
+// TEST: Merge Message
+// --merge-msg carries the conflict summary from MERGE_MSG into the commit
+// =============================================================================
+
+func TestContinueMergeMsg(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--merge-msg")
+	message := h.RunExpectSuccess("git", "log", "-1", "--format=%B")
+	if !strings.HasPrefix(message, "Preemptive conflict resolution vs dev@") {
+		t.Errorf("Expected the default subject, got: %s", message)
+	}
+	if !strings.Contains(message, "\n\nConflicts:\n\tfile.txt") {
+		t.Errorf("Expected the MERGE_MSG conflict summary in the body, got: %q", message)
+	}
+	if strings.Contains(message, "Merge branch") {
+		t.Errorf("Expected the MERGE_MSG subject to be left out, got: %s", message)
+	}
+}
+
+// =============================================================================
+// TEST: Empty Repository
+// A repository without commits gets a clear error instead of a git failure
+// =============================================================================
+
+func TestEmptyRepository(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.InitRepo()
+	output := h.RunExpectFailure("git-anticipate", "dev")
+	if !strings.Contains(output, "repository has no commits yet; nothing to anticipate") {
+		t.Errorf("Expected the no-commits error, got: %s", output)
+	}
+	if h.FileExists(".git/anticipate") {
+		t.Error("Expected no session state")
+	}
+}
+
+// =============================================================================
+// TEST: No-Op OK
+// --continue --no-op-ok exits 0 when unresolved conflicts leave nothing to do
+// =============================================================================
+
+func TestContinueNoOpOK(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	before := h.CommitCount()
+
+	if _, code := h.RunExitCode("git-anticipate", "--continue", "--no-verify"); code != 1 {
+		t.Errorf("Expected exit code 1 without --no-op-ok, got %d", code)
+	}
+
+	output, code := h.RunExitCode("git-anticipate", "--continue", "--no-verify", "--no-op-ok")
+	if code != 0 {
+		t.Errorf("Expected exit code 0 with --no-op-ok, got %d: %s", code, output)
+	}
+	if !strings.Contains(output, "Unresolved conflicts remain") || !strings.Contains(output, "Nothing was committed (--no-op-ok)") {
+		t.Errorf("Expected the remaining conflicts to be reported, got: %s", output)
+	}
+	if after := h.CommitCount(); after != before {
+		t.Errorf("Expected no commit, had %d commits and now %d", before, after)
+	}
+	if !h.FileExists(".git/anticipate") {
+		t.Error("Expected the session to stay in progress")
+	}
+}
+
+// =============================================================================
+// TEST: Target Drift
+// --continue warns when the target moved since the start, and fails with
+// --strict
+// =============================================================================
+
+func TestContinueTargetDrift(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	// Advance dev without touching the working tree
+	tree := h.RunExpectSuccess("git", "rev-parse", "dev^{tree}")
+	commit := h.RunExpectSuccess("git", "commit-tree", "-p", "dev", "-m", "more dev", strings.TrimSpace(tree))
+	h.Run("git", "update-ref", "refs/heads/dev", strings.TrimSpace(commit))
+
+	output := h.RunExpectFailure("git-anticipate", "--continue", "--no-verify", "--strict")
+	if !strings.Contains(output, "dev moved since the session started") {
+		t.Errorf("Expected --strict to refuse a moved target, got: %s", output)
+	}
+	if !h.FileExists(".git/anticipate") {
+		t.Fatal("Expected the session to be left in progress")
+	}
+
+	output = h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify")
+	if !strings.Contains(output, "dev moved since the session started") || !strings.Contains(output, "may be stale") {
+		t.Errorf("Expected a warning about the moved target, got: %s", output)
+	}
+	if content := h.RunExpectSuccess("git", "show", "HEAD:file.txt"); content != "merged" {
+		t.Errorf("Expected the resolution to be committed, got: %s", content)
+	}
+}
+
+// =============================================================================
+// TEST: Format Command
+// --format-cmd and anticipate.formatCmd format the resolved files before they
+// are committed
+// =============================================================================
+
+func TestContinueFormatCmd(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	formatter := filepath.Join(t.TempDir(), "upper.sh")
+	script := "#!/bin/sh\nfor f; do tr a-z A-Z < \"$f\" > \"$f.tmp\" && mv \"$f.tmp\" \"$f\"; done\n"
+	if err := os.WriteFile(formatter, []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to write formatter: %v", err)
+	}
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	output := h.RunExpectFailure("git-anticipate", "--continue", "--no-verify", "--format-cmd", "false")
+	if !strings.Contains(output, "format command 'false' failed") || !strings.Contains(output, "--continue --recommit") {
+		t.Errorf("Expected the formatter failure to be reported, got: %s", output)
+	}
+
+	h.Run("git", "config", "anticipate.formatCmd", formatter)
+	output = h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--recommit")
+	if !strings.Contains(output, "Formatting 1 files with "+formatter) {
+		t.Errorf("Expected the configured formatter to run, got: %s", output)
+	}
+	if content := h.RunExpectSuccess("git", "show", "HEAD:file.txt"); content != "MERGED" {
+		t.Errorf("Expected the formatted content to be committed, got: %s", content)
+	}
+	if status := h.RunExpectSuccess("git", "status", "--porcelain"); strings.TrimSpace(status) != "" {
+		t.Errorf("Expected a clean working tree, got: %s", status)
+	}
+}
+
+// =============================================================================
+// TEST: Double Continue
+// Two --continue runs at once make a single commit; a stale lock or an
+// interrupted cleanup is reported rather than committed again
+// =============================================================================
+
+func TestContinueDoubleRun(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+	before := h.CommitCount()
+
+	var cmds []*exec.Cmd
+	for i := 0; i < 2; i++ {
+		cmd := exec.Command("git-anticipate", "--continue", "--no-verify")
+		cmd.Dir = h.repoDir
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("Failed to start continue: %v", err)
+		}
+		cmds = append(cmds, cmd)
+	}
+	for _, cmd := range cmds {
+		cmd.Wait()
+	}
+	if after := h.CommitCount(); after != before+1 {
+		t.Errorf("Expected exactly one new commit, got %d", after-before)
+	}
+
+	// A lock left behind by a killed run blocks --continue with guidance
+	h.Checkout("dev")
+	h.Run("git", "checkout", "-B", "feature2", "HEAD~1")
+	h.WriteFile("file.txt", "feature2")
+	h.Commit("feature2 change")
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+	lock := filepath.Join(h.repoDir, ".git", "anticipate", "continue.lock")
+	if err := os.WriteFile(lock, []byte("1\n"), 0644); err != nil {
+		t.Fatalf("Failed to write lock: %v", err)
+	}
+	output := h.RunExpectFailure("git-anticipate", "--continue", "--no-verify")
+	if !strings.Contains(output, "another 'git anticipate --continue' is running") || !strings.Contains(output, "continue.lock") {
+		t.Errorf("Expected the lock to be reported, got: %s", output)
+	}
+	os.Remove(lock)
+
+	// A run that committed but died before cleaning up is not committed again
+	h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify")
+	head := strings.TrimSpace(h.RunExpectSuccess("git", "rev-parse", "HEAD"))
+	stateDir := filepath.Join(h.repoDir, ".git", "anticipate")
+	os.MkdirAll(stateDir, 0755)
+	os.WriteFile(filepath.Join(stateDir, "committed"), []byte(head+"\n"), 0644)
+	count := h.CommitCount()
+	output = h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify")
+	if !strings.Contains(output, "already committed") {
+		t.Errorf("Expected the earlier commit to be recognised, got: %s", output)
+	}
+	if h.CommitCount() != count || h.FileExists(".git/anticipate") {
+		t.Errorf("Expected no new commit and the state removed")
+	}
+}
+
+// =============================================================================
+// TEST: Reset Author
+// --reset-author authors the commit as the configured user, ignoring an author
+// identity left in the environment
+// =============================================================================
+
+func TestContinueResetAuthor(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	t.Setenv("GIT_AUTHOR_NAME", "Someone Else")
+	t.Setenv("GIT_AUTHOR_EMAIL", "someone@else.com")
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--reset-author")
+	if author := strings.TrimSpace(h.RunExpectSuccess("git", "log", "-1", "--format=%an <%ae>")); author != "Test User <test@test.com>" {
+		t.Errorf("Expected the configured author, got: %s", author)
+	}
+}
+
+// =============================================================================
+// TEST: No Spinner Without TTY
+// The progress spinner is only drawn on a terminal; captured output of a
+// start, continue and abort never contains its frames or line clearing
+// =============================================================================
+
+func TestNoSpinnerWithoutTTY(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	var outputs []string
+	outputs = append(outputs, h.Run("git-anticipate", "dev"))
+	outputs = append(outputs, h.RunExpectSuccess("git-anticipate", "--abort"))
+	outputs = append(outputs, h.Run("git-anticipate", "dev"))
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+	outputs = append(outputs, h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify"))
+
+	for _, output := range outputs {
+		if strings.ContainsAny(output, "\r\033") || strings.Contains(output, "merging...") || strings.Contains(output, "resetting...") {
+			t.Errorf("Expected no spinner in captured output, got: %q", output)
+		}
+	}
+}
+
+// =============================================================================
+// TEST: Committer
+// --committer overrides the committer identity while the author stays the
+// configured user; a malformed identity is rejected
+// =============================================================================
+
+func TestContinueCommitter(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	output := h.RunExpectFailure("git-anticipate", "--continue", "--no-verify", "--committer", "Merge Bot")
+	if !strings.Contains(output, "invalid --committer 'Merge Bot'") {
+		t.Errorf("Expected the malformed committer to be rejected, got: %s", output)
+	}
+
+	h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--committer", "Merge Bot <bot@example.com>")
+	if committer := strings.TrimSpace(h.RunExpectSuccess("git", "log", "-1", "--format=%cn <%ce>")); committer != "Merge Bot <bot@example.com>" {
+		t.Errorf("Expected the committer override, got: %s", committer)
+	}
+	if author := strings.TrimSpace(h.RunExpectSuccess("git", "log", "-1", "--format=%an <%ae>")); author != "Test User <test@test.com>" {
+		t.Errorf("Expected the configured author, got: %s", author)
+	}
+}
+
+// =============================================================================
+// TEST: Abort Confirmation
+// --abort summarizes the resolution it would discard and asks first; declining
+// leaves everything in place, and --yes skips the question
+// =============================================================================
+
+func TestAbortConfirmation(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	t.Setenv("GIT_ANTICIPATE_INTERACTIVE", "1")
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	output := h.RunWithInput("n\n", "git-anticipate", "--abort")
+	if !strings.Contains(output, "1 resolved of 1 conflicting files") || !strings.Contains(output, "abort cancelled") {
+		t.Errorf("Expected a summary and a cancelled abort, got: %s", output)
+	}
+	if !h.FileExists(".git/anticipate") || !h.FileExists(".git/MERGE_HEAD") {
+		t.Errorf("Expected the session and merge to be left in place")
+	}
+	if content := h.ReadFile("file.txt"); content != "merged" {
+		t.Errorf("Expected the resolution to be kept, got: %s", content)
+	}
+
+	h.RunExpectSuccess("git-anticipate", "--abort", "--yes")
+	if h.FileExists(".git/anticipate") {
+		t.Errorf("Expected the session to be aborted")
+	}
+	if content := h.ReadFile("file.txt"); content != "feature" {
+		t.Errorf("Expected the original content to be restored, got: %s", content)
+	}
+}
+
+// =============================================================================
+// TEST: Submodule Pointers
+// A submodule pointer moved by the merge is flagged when it would be
+// committed, and left out with --skip-submodules
+// =============================================================================
+
+func TestContinueSkipSubmodules(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	sub := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "main"},
+		{"-c", "user.name=Test", "-c", "user.email=test@test.com", "commit", "-q", "--allow-empty", "-m", "one"},
+		{"-c", "user.name=Test", "-c", "user.email=test@test.com", "commit", "-q", "--allow-empty", "-m", "two"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = sub
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("Failed to set up submodule: %v\n%s", err, output)
+		}
+	}
+
+	h.InitRepo()
+	h.RunExpectSuccess("git", "-c", "protocol.file.allow=always", "submodule", "add", "-q", sub, "sm")
+	h.RunExpectSuccess("git", "-C", "sm", "checkout", "-q", "HEAD~1")
+	h.WriteFile("file.txt", "original")
+	h.Commit("initial commit")
+	h.Branch("dev")
+	h.RunExpectSuccess("git", "-C", "sm", "checkout", "-q", "main")
+	h.WriteFile("file.txt", "dev")
+	h.Commit("dev change")
+	h.Checkout("main")
+	h.RunExpectSuccess("git", "submodule", "update", "-q")
+	h.Branch("feature")
+	h.WriteFile("file.txt", "feature")
+	h.Commit("feature change")
+
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	output := h.RunExpectSuccess("git-anticipate", "--continue", "--dry-run")
+	if !strings.Contains(output, "Submodule sm moves to") {
+		t.Errorf("Expected the submodule pointer change to be flagged, got: %s", output)
+	}
+
+	output = h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--skip-submodules")
+	if !strings.Contains(output, "Leaving submodule sm out of the commit") {
+		t.Errorf("Expected the submodule to be left out, got: %s", output)
+	}
+	files := strings.TrimSpace(h.RunExpectSuccess("git", "show", "--name-only", "--format=", "HEAD"))
+	if files != "file.txt" {
+		t.Errorf("Expected only file.txt in the commit, got: %s", files)
+	}
+}
+
+// =============================================================================
+// TEST: Suggested Merge Command
+// After committing, --continue suggests the command that does the real merge,
+// naming the target and the prepared branch from the session state
+// =============================================================================
+
+func TestContinueSuggestsMergeCommand(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	output := h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify")
+	if !strings.Contains(output, "git checkout dev && git merge --no-ff feature") {
+		t.Errorf("Expected the merge command for dev and feature, got: %s", output)
+	}
+}
+
+// =============================================================================
+// TEST: Conditional Config
+// Config included with includeIf "gitdir:" applies to the preparation commit,
+// also when GIT_DIR is given relative to a subdirectory
+// =============================================================================
+
+func TestConditionalConfigIdentity(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.WriteFile("sub/keep.txt", "keep")
+	h.Commit("add sub")
+	include := filepath.Join(t.TempDir(), "work.gitconfig")
+	if err := os.WriteFile(include, []byte("[user]\n\temail = work@example.com\n"), 0644); err != nil {
+		t.Fatalf("Failed to write included config: %v", err)
+	}
+	h.RunExpectSuccess("git", "config", "includeIf.gitdir:"+filepath.Join(h.repoDir, ".git")+".path", include)
+
+	run := func(args ...string) string {
+		cmd := exec.Command("git-anticipate", args...)
+		cmd.Dir = filepath.Join(h.repoDir, "sub")
+		cmd.Env = append(os.Environ(), "GIT_DIR=../.git", "GIT_WORK_TREE=..")
+		output, _ := cmd.CombinedOutput()
+		return string(output)
+	}
+	run("dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+	if output := run("--continue", "--no-verify"); !strings.Contains(output, "Success!") {
+		t.Fatalf("Expected continue to succeed, got: %s", output)
+	}
+	if email := strings.TrimSpace(h.RunExpectSuccess("git", "log", "-1", "--format=%ae")); email != "work@example.com" {
+		t.Errorf("Expected the conditionally included identity, got: %s", email)
+	}
+}
+
+// =============================================================================
+// TEST: Exact Bytes
+// A resolution with a UTF-8 BOM, CRLF line endings and no final newline is
+// committed byte for byte
+// =============================================================================
+
+func TestContinuePreservesExactBytes(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	resolved := "\xef\xbb\xbfmerged\r\nsecond line\r\nno newline"
+	h.WriteFile("file.txt", resolved)
+	h.Run("git", "add", "file.txt")
+
+	h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify")
+	if committed := h.RunExpectSuccess("git", "cat-file", "blob", "HEAD:file.txt"); committed != resolved {
+		t.Errorf("Expected the committed blob to match byte for byte, got: %q", committed)
+	}
+	if content := h.ReadFile("file.txt"); content != resolved {
+		t.Errorf("Expected the working tree file to match byte for byte, got: %q", content)
+	}
+}
+
+// =============================================================================
+// TEST: Into Stash
+// --into-stash stashes the resolution instead of committing it, leaving HEAD
+// at the original commit and unrelated edits in place
+// =============================================================================
+
+func TestContinueIntoStash(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.WriteFile("notes.txt", "notes")
+	h.Commit("add notes")
+	origHead := strings.TrimSpace(h.RunExpectSuccess("git", "rev-parse", "HEAD"))
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+	h.WriteFile("notes.txt", "local edit")
+
+	output := h.RunExpectSuccess("git-anticipate", "--continue", "--into-stash")
+	if !strings.Contains(output, "Resolution stashed as stash@{0}") {
+		t.Errorf("Expected the resolution to be stashed, got: %s", output)
+	}
+	if head := strings.TrimSpace(h.RunExpectSuccess("git", "rev-parse", "HEAD")); head != origHead {
+		t.Errorf("Expected HEAD to stay at %s, got %s", origHead, head)
+	}
+	if h.FileExists(".git/anticipate") {
+		t.Errorf("Expected the session to be cleaned up")
+	}
+	if subject := h.RunExpectSuccess("git", "log", "-1", "--format=%s", "refs/stash"); !strings.Contains(subject, "Preemptive conflict resolution vs dev") {
+		t.Errorf("Expected the stash to be named after the resolution, got: %s", subject)
+	}
+	if stashed := h.RunExpectSuccess("git", "show", "refs/stash:file.txt"); stashed != "merged" {
+		t.Errorf("Expected the stash to hold the resolution, got: %s", stashed)
+	}
+	if content := h.ReadFile("file.txt"); content != "feature" {
+		t.Errorf("Expected file.txt back at the original HEAD, got: %s", content)
+	}
+	if content := h.ReadFile("notes.txt"); content != "local edit" {
+		t.Errorf("Expected the unrelated edit to stay out of the stash, got: %s", content)
+	}
+}
+
+// =============================================================================
+// TEST: Session Age
+// --status reports how long ago the session was started, so forgotten
+// sessions stand out
+// =============================================================================
+
+func TestStatusSessionAge(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	started := time.Now().Add(-(3*time.Hour + 12*time.Minute + 30*time.Second)).Format(time.RFC3339)
+	h.WriteFile(".git/anticipate/started_at", started+"\n")
+
+	output := h.RunExpectSuccess("git-anticipate", "--status")
+	if !strings.Contains(output, "Started:         3h12m ago") {
+		t.Errorf("Expected the session age, got: %s", output)
+	}
+
+	started = time.Now().Add(-(50 * time.Hour)).Format(time.RFC3339)
+	h.WriteFile(".git/anticipate/started_at", started+"\n")
+	output = h.RunExpectSuccess("git-anticipate", "--status")
+	if !strings.Contains(output, "Started:         2d2h ago") {
+		t.Errorf("Expected the age in days, got: %s", output)
+	}
+}
+
+// =============================================================================
+// TEST: Unchanged Files Not Rewritten
+// Files that already hold their content after the reset keep their mtime;
+// resolved files that had to be written back get a new one
+// =============================================================================
+
+func TestContinueSkipsUnchangedWrites(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.WriteFile("notes.txt", "notes")
+	h.Commit("add notes")
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+	h.WriteFile("new.txt", "created while resolving")
+	h.WriteFile("notes.txt", "local edit")
+
+	old := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+	for _, file := range []string{"file.txt", "new.txt", "notes.txt"} {
+		if err := os.Chtimes(filepath.Join(h.repoDir, file), old, old); err != nil {
+			t.Fatalf("Failed to set mtime: %v", err)
+		}
+	}
+
+	h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--include-untracked", "--reset-mode", "keep")
+	mtime := func(file string) time.Time {
+		info, err := os.Stat(filepath.Join(h.repoDir, file))
+		if err != nil {
+			t.Fatalf("Failed to stat %s: %v", file, err)
+		}
+		return info.ModTime()
+	}
+	for _, file := range []string{"new.txt", "notes.txt"} {
+		if !mtime(file).Equal(old) {
+			t.Errorf("Expected %s not to be rewritten, mtime is %v", file, mtime(file))
+		}
+	}
+	if mtime("file.txt").Equal(old) {
+		t.Errorf("Expected file.txt to be written back")
+	}
+	if files := strings.Fields(h.RunExpectSuccess("git", "show", "--name-only", "--format=", "HEAD")); len(files) != 2 {
+		t.Errorf("Expected file.txt and new.txt to be committed, got: %v", files)
+	}
+	if content := h.ReadFile("notes.txt"); content != "local edit" {
+		t.Errorf("Expected the unrelated edit to be kept, got: %s", content)
+	}
+}
+
+// =============================================================================
+// TEST: Retry Hook
+// --retry-hook stages what a failing pre-commit hook changed in the resolved
+// files and commits once more
+// =============================================================================
+
+func TestContinueRetryHook(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	hook := "#!/bin/sh\nif ! grep -q formatted file.txt; then\n  printf 'merged formatted' > file.txt\n  echo '- files were modified by this hook'\n  exit 1\nfi\n"
+	h.WriteFile(".git/hooks/pre-commit", hook)
+	if err := os.Chmod(filepath.Join(h.repoDir, ".git/hooks/pre-commit"), 0755); err != nil {
+		t.Fatalf("Failed to make hook executable: %v", err)
+	}
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	output := h.RunExpectSuccess("git-anticipate", "--continue", "--retry-hook")
+	if !strings.Contains(output, "Hooks modified 1 files") {
+		t.Errorf("Expected the hook changes to be restaged, got: %s", output)
+	}
+	if content := h.RunExpectSuccess("git", "show", "HEAD:file.txt"); content != "merged formatted" {
+		t.Errorf("Expected the hook's fix to be committed, got: %s", content)
+	}
+	if status := h.RunExpectSuccess("git", "status", "--porcelain"); strings.TrimSpace(status) != "" {
+		t.Errorf("Expected a clean working tree, got: %s", status)
+	}
+}
+
+// =============================================================================
+// TEST: No Reset
+// --no-reset commits the trial merge itself, giving a merge commit with the
+// original HEAD and the target as parents
+// =============================================================================
+
+func TestContinueNoReset(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	origHead := strings.TrimSpace(h.RunExpectSuccess("git", "rev-parse", "HEAD"))
+	devSHA := strings.TrimSpace(h.RunExpectSuccess("git", "rev-parse", "dev"))
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	output := h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--no-reset")
+	if !strings.Contains(output, "--no-reset is experimental") {
+		t.Errorf("Expected the topology change to be flagged, got: %s", output)
+	}
+	parents := strings.Fields(h.RunExpectSuccess("git", "log", "-1", "--format=%P"))
+	if len(parents) != 2 || parents[0] != origHead || parents[1] != devSHA {
+		t.Errorf("Expected a merge of %s and %s, got parents %v", origHead, devSHA, parents)
+	}
+	if content := h.RunExpectSuccess("git", "show", "HEAD:file.txt"); content != "merged" {
+		t.Errorf("Expected the resolution to be committed, got: %s", content)
+	}
+	if h.FileExists(".git/anticipate") || h.FileExists(".git/MERGE_HEAD") {
+		t.Errorf("Expected the session and merge to be finished")
+	}
+}
+
+// =============================================================================
+// TEST: .gitmodules Conflict
+// A conflict in .gitmodules gets a note about reconciling submodule pointers
+// =============================================================================
+
+func TestGitmodulesConflictNote(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.InitRepo()
+	h.WriteFile(".gitmodules", "[submodule \"lib\"]\n\tpath = lib\n\turl = https://example.com/lib.git\n")
+	h.Commit("initial commit")
+	h.Branch("dev")
+	h.WriteFile(".gitmodules", "[submodule \"lib\"]\n\tpath = lib\n\turl = https://example.com/lib-dev.git\n")
+	h.Commit("dev url")
+	h.Checkout("main")
+	h.Branch("feature")
+	h.WriteFile(".gitmodules", "[submodule \"lib\"]\n\tpath = lib\n\turl = https://example.com/lib-feature.git\n")
+	h.Commit("feature url")
+
+	output := h.Run("git-anticipate", "dev")
+	if !strings.Contains(output, ".gitmodules conflicts: submodule paths or URLs changed on both sides") {
+		t.Errorf("Expected the .gitmodules note, got: %s", output)
+	}
+}
+
+// =============================================================================
+// TEST: Clean Filter On Reapply
+// Reapplied files are staged through their clean filter, so a keyword
+// expanded in the working tree is committed collapsed
+// =============================================================================
+
+func TestContinueAppliesCleanFilter(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.WriteFile(".git/info/attributes", "file.txt filter=keyword\n")
+	h.Run("git", "config", "filter.keyword.clean", `sed 's/\$Id:[^$]*\$/$Id$/'`)
+	h.Run("git", "config", "filter.keyword.smudge", `sed 's/\$Id\$/$Id: expanded $/'`)
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "$Id: expanded $\nmerged\n")
+	h.Run("git", "add", "file.txt")
+
+	h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify")
+	if committed := h.RunExpectSuccess("git", "cat-file", "blob", "HEAD:file.txt"); committed != "$Id$\nmerged\n" {
+		t.Errorf("Expected the cleaned content to be committed, got: %q", committed)
+	}
+	if content := h.ReadFile("file.txt"); content != "$Id: expanded $\nmerged\n" {
+		t.Errorf("Expected the working tree to keep the expanded keyword, got: %q", content)
+	}
+	if status := h.RunExpectSuccess("git", "status", "--porcelain"); strings.TrimSpace(status) != "" {
+		t.Errorf("Expected a clean working tree, got: %s", status)
+	}
+}
+
+// =============================================================================
+// TEST: Diff Algorithm
+// --diff-algorithm is passed to the trial merge and shown in --status. A
+// block moved on one side and edited on the other merges cleanly with
+// histogram, which anchors on the moved lines; myers would conflict.
+// =============================================================================
+
+func TestDiffAlgorithm(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.InitRepo()
+	h.WriteFile("list.txt", "x\nx\nx\nx\nx\nU1\nU2\nU3\n")
+	h.WriteFile("file.txt", "original")
+	h.Commit("initial commit")
+	h.Branch("dev")
+	h.WriteFile("list.txt", "x\nx\nx\nx\nx\nU1\nU2 edited\nU3\n")
+	h.Commit("dev edit")
+	h.Checkout("main")
+	h.Branch("feature")
+	h.WriteFile("list.txt", "U1\nU2\nU3\nx\nx\nx\nx\nx\n")
+	h.Commit("feature move")
+
+	output := h.RunExpectFailure("git-anticipate", "dev", "--diff-algorithm", "fast")
+	if !strings.Contains(output, "invalid --diff-algorithm 'fast'") {
+		t.Errorf("Expected an unknown algorithm to be rejected, got: %s", output)
+	}
+
+	output = h.RunExpectSuccess("git-anticipate", "dev", "--diff-algorithm", "histogram")
+	if !strings.Contains(output, "No conflicts detected") {
+		t.Errorf("Expected the moved block to merge cleanly with histogram, got: %s", output)
+	}
+
+	// A real conflict keeps the session, which records the algorithm
+	h.WriteFile("file.txt", "feature")
+	h.Commit("feature change")
+	h.Checkout("dev")
+	h.WriteFile("file.txt", "dev")
+	h.Commit("dev change")
+	h.Checkout("feature")
+	h.Run("git-anticipate", "dev", "--diff-algorithm", "patience")
+	if output := h.RunExpectSuccess("git-anticipate", "--status"); !strings.Contains(output, "Diff algorithm:  patience") {
+		t.Errorf("Expected the algorithm in --status, got: %s", output)
+	}
+}
+
+// =============================================================================
+// TEST: Orphan Branch
+// Switching to an orphan branch before --continue makes the resolution that
+// branch's root commit instead of resetting it to the original HEAD
+// =============================================================================
+
+func TestContinueOnOrphanBranch(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+	h.RunExpectSuccess("git", "checkout", "-q", "--orphan", "fresh")
+
+	output := h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify")
+	if !strings.Contains(output, "fresh has no commits yet") || !strings.Contains(output, "Resolution committed to fresh") {
+		t.Errorf("Expected the orphan branch to get the first commit, got: %s", output)
+	}
+	if !strings.Contains(output, "--allow-unrelated-histories fresh") {
+		t.Errorf("Expected the suggested merge to allow unrelated histories, got: %s", output)
+	}
+	if parents := strings.TrimSpace(h.RunExpectSuccess("git", "log", "-1", "--format=%P", "fresh")); parents != "" {
+		t.Errorf("Expected a root commit, got parents: %s", parents)
+	}
+	if content := h.RunExpectSuccess("git", "show", "fresh:file.txt"); content != "merged" {
+		t.Errorf("Expected the resolution to be committed, got: %s", content)
+	}
+	if h.CurrentBranch() != "fresh" || h.FileExists(".git/anticipate") {
+		t.Errorf("Expected to stay on fresh with the session finished")
+	}
+}
+
+// =============================================================================
+// TEST: Check Merge
+// --check-merge trial-merges the target into the new commit and reports the
+// conflicts the real merge would still have
+// =============================================================================
+
+func TestContinueCheckMerge(t *testing.T) {
+	// Taking the target's side leaves nothing for the real merge to conflict on
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "dev")
+	h.Run("git", "add", "file.txt")
+
+	output := h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--check-merge")
+	if !strings.Contains(output, "Remaining conflicts after resolution: 0") {
+		t.Errorf("Expected no remaining conflicts, got: %s", output)
+	}
+	if h.FileExists(".git/MERGE_HEAD") || h.CurrentBranch() != "feature" {
+		t.Errorf("Expected the check to leave the repository untouched")
+	}
+
+	// A resolution that differs from the target still conflicts with it
+	h2 := NewTestHelper(t)
+	defer h2.Cleanup()
+
+	h2.SetupConflict()
+	h2.Run("git-anticipate", "dev")
+	h2.WriteFile("file.txt", "merged")
+	h2.Run("git", "add", "file.txt")
+
+	output = h2.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--check-merge")
+	if !strings.Contains(output, "Remaining conflicts after resolution: 1") || !strings.Contains(output, "❌ file.txt") {
+		t.Errorf("Expected file.txt to still conflict, got: %s", output)
+	}
+	if status := h2.RunExpectSuccess("git", "status", "--porcelain"); status != "" {
+		t.Errorf("Expected a clean working tree after the check, got: %s", status)
+	}
+}
+
+// =============================================================================
+// TEST: Many Files
+// --continue stages a resolution of hundreds of files with one git add, not
+// one process per file
+// =============================================================================
+
+func TestContinueStagesManyFilesInBatch(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	const count = 300
+	writeAll := func(content string) {
+		for i := 0; i < count; i++ {
+			h.WriteFile(fmt.Sprintf("f%03d.txt", i), content)
+		}
+	}
+
+	h.InitRepo()
+	writeAll("original")
+	h.Commit("initial")
+	h.Branch("dev")
+	writeAll("dev")
+	h.Commit("dev changes")
+	h.Checkout("main")
+	h.Branch("feature")
+	writeAll("feature")
+	h.Commit("feature changes")
+
+	h.Run("git-anticipate", "dev")
+	writeAll("merged")
+	h.RunExpectSuccess("git", "add", "-A")
+
+	logFile := filepath.Join(h.repoDir, ".git", "git-calls.log")
+	wrapper := filepath.Join(h.repoDir, ".git", "git-wrapper")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %s\nexec git \"$@\"\n", logFile)
+	if err := os.WriteFile(wrapper, []byte(script), 0755); err != nil {
+		t.Fatalf("failed to write wrapper: %v", err)
+	}
+	t.Setenv("GIT_ANTICIPATE_GIT", wrapper)
+
+	h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify")
+
+	adds := 0
+	for _, line := range strings.Split(h.ReadFile(".git/git-calls.log"), "\n") {
+		if strings.HasPrefix(line, "add ") {
+			adds++
+			if !strings.Contains(line, "--pathspec-from-file=-") {
+				t.Errorf("Expected paths to be passed on stdin, got: %s", line)
+			}
+		}
+	}
+	if adds != 1 {
+		t.Errorf("Expected a single batched git add, got %d", adds)
+	}
+	for _, line := range strings.Split(h.ReadFile(".git/git-calls.log"), "\n") {
+		if strings.Contains(line, "f001.txt f002.txt") {
+			t.Errorf("Expected no command line listing every file, got: %s", line)
+		}
+	}
+	calls := make(map[string]int)
+	for _, line := range strings.Split(h.ReadFile(".git/git-calls.log"), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			calls[fields[0]]++
+		}
+	}
+	for command, n := range calls {
+		if n >= count {
+			t.Errorf("Expected no per-file git %s calls, got %d", command, n)
+		}
+	}
+
+	files := strings.Fields(h.RunExpectSuccess("git", "show", "--name-only", "--format=", "HEAD"))
+	if len(files) != count {
+		t.Errorf("Expected all %d files in the commit, got %d", count, len(files))
+	}
+	if content := h.RunExpectSuccess("git", "show", "HEAD:f299.txt"); content != "merged" {
+		t.Errorf("Expected the resolution to be committed, got: %s", content)
+	}
+}
+
+// =============================================================================
+// TEST: Unusual Paths
+// Paths with newlines, quotes, spaces, glob characters and non-ASCII letters
+// are read with -z and survive --continue unquoted
+// =============================================================================
+
+func TestContinueUnusualPaths(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	// Glob-like names sit next to unrelated siblings they would match, and
+	// every file has its own content, so one path standing in for another
+	// shows up in the commit
+	names := []string{"with space.txt", `say "hi".txt`, `"quoted".txt`, "*.txt", "a[1].txt", "?.txt", "naïve.txt", " lead.txt"}
+	siblings := []string{"a1.txt", "x.txt"}
+	if runtime.GOOS != "windows" {
+		names = append(names, "two\nlines.txt")
+	}
+	writeAll := func(content string) {
+		for _, name := range names {
+			h.WriteFile(name, content+" "+name)
+		}
+	}
+
+	h.InitRepo()
+	writeAll("original")
+	for _, sibling := range siblings {
+		h.WriteFile(sibling, "sibling "+sibling)
+	}
+	h.Commit("initial")
+	h.Branch("dev")
+	writeAll("dev")
+	h.Commit("dev changes")
+	h.Checkout("main")
+	h.Branch("feature")
+	writeAll("feature")
+	h.Commit("feature changes")
+
+	output := h.Run("git-anticipate", "dev")
+	if !strings.Contains(output, fmt.Sprintf("Conflicting files (%d)", len(names))) {
+		t.Fatalf("Expected every unusual path to conflict, got: %s", output)
+	}
+	writeAll("merged")
+	h.RunExpectSuccess("git", "add", "-A")
+
+	output = h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify")
+	if !strings.Contains(output, fmt.Sprintf("Extracting resolution (%d files)", len(names))) {
+		t.Errorf("Expected every path in the resolution, got: %s", output)
+	}
+	for _, name := range names {
+		if content := h.RunExpectSuccess("git", "show", "HEAD:"+name); content != "merged "+name {
+			t.Errorf("Expected %q to be committed as resolved, got: %s", name, content)
+		}
+	}
+	for _, sibling := range siblings {
+		if content := h.RunExpectSuccess("git", "show", "HEAD:"+sibling); content != "sibling "+sibling {
+			t.Errorf("Expected %q to be left alone in the commit, got: %s", sibling, content)
+		}
+		if content := h.ReadFile(sibling); content != "sibling "+sibling {
+			t.Errorf("Expected %q to be left alone on disk, got: %s", sibling, content)
+		}
+	}
+	if status := h.RunExpectSuccess("git", "status", "--porcelain"); status != "" {
+		t.Errorf("Expected a clean working tree, got: %s", status)
+	}
+}
+
+// =============================================================================
+// TEST: Scratch Branch
+// --scratch commits the resolution on a generated branch and leaves the
+// original branch and its checkout as they were
+// =============================================================================
+
+func TestContinueScratch(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	before := strings.TrimSpace(h.RunExpectSuccess("git", "rev-parse", "feature"))
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	output := h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--scratch", "--json")
+	var result struct {
+		Committed string `json:"committed"`
+		Branch    string `json:"branch"`
+	}
+	if err := json.Unmarshal([]byte(output), &result); err != nil {
+		t.Fatalf("Expected JSON output, got: %s", output)
+	}
+	if !strings.HasPrefix(result.Branch, "anticipate-scratch/feature-") {
+		t.Errorf("Expected a generated scratch branch, got: %q", result.Branch)
+	}
+
+	if h.CurrentBranch() != "feature" {
+		t.Errorf("Expected to be back on feature, got: %s", h.CurrentBranch())
+	}
+	if after := strings.TrimSpace(h.RunExpectSuccess("git", "rev-parse", "feature")); after != before {
+		t.Errorf("Expected feature to stay at %s, got: %s", before, after)
+	}
+	if content := h.ReadFile("file.txt"); content != "feature" {
+		t.Errorf("Expected the checkout to be unchanged, got: %s", content)
+	}
+	if status := h.RunExpectSuccess("git", "status", "--porcelain"); status != "" {
+		t.Errorf("Expected a clean working tree, got: %s", status)
+	}
+
+	if tip := strings.TrimSpace(h.RunExpectSuccess("git", "rev-parse", result.Branch)); tip != result.Committed {
+		t.Errorf("Expected %s to point at the new commit %s, got: %s", result.Branch, result.Committed, tip)
+	}
+	if parent := strings.TrimSpace(h.RunExpectSuccess("git", "rev-parse", result.Branch+"^")); parent != before {
+		t.Errorf("Expected the scratch commit to sit on feature, got parent: %s", parent)
+	}
+	if content := h.RunExpectSuccess("git", "show", result.Branch+":file.txt"); content != "merged" {
+		t.Errorf("Expected the resolution on the scratch branch, got: %s", content)
+	}
+}
+
+// =============================================================================
+// TEST: Prompts Under JSON
+// With --json the confirmation prompt and its warning go to stderr, so they
+// are seen while stdout still holds only the result
+// =============================================================================
+
+func TestMaxAheadPromptWithJSON(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Checkout("dev")
+	h.WriteFile("more.txt", "1")
+	h.Commit("More dev work")
+	h.WriteFile("more.txt", "2")
+	h.Commit("Even more dev work")
+	h.Checkout("feature")
+
+	t.Setenv("GIT_ANTICIPATE_INTERACTIVE", "1")
+	cmd := exec.Command("git-anticipate", "dev", "--max-ahead", "2", "--json")
+	cmd.Dir = h.repoDir
+	cmd.Stdin = strings.NewReader("y\n")
+	var stdout, stderr strings.Builder
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.Run()
+
+	if !strings.Contains(stderr.String(), "dev is 3 commits ahead of feature") || !strings.Contains(stderr.String(), "Run the trial merge anyway? [y/N]") {
+		t.Errorf("Expected the warning and prompt on stderr, got: %s", stderr.String())
+	}
+	var result map[string]any
+	if err := json.Unmarshal([]byte(stdout.String()), &result); err != nil {
+		t.Errorf("Expected only JSON on stdout, got: %s", stdout.String())
+	}
+	if result["outcome"] != "conflicts" {
+		t.Errorf("Expected the merge to go ahead after answering yes, got: %s", stdout.String())
+	}
+}
+
+// =============================================================================
+// TEST: Continue Prompt Under JSON
+// --continue --json asks about discarding unstaged changes on stderr
+// =============================================================================
+
+func TestContinueConfirmWithJSON(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+	t.Setenv("GIT_ANTICIPATE_INTERACTIVE", "1")
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "staged resolution")
+	h.Run("git", "add", "file.txt")
+	h.WriteFile("file.txt", "unstaged edit")
+
+	cmd := exec.Command("git-anticipate", "--continue", "--no-verify", "--from-index", "--json")
+	cmd.Dir = h.repoDir
+	cmd.Stdin = strings.NewReader("n\n")
+	var stdout, stderr strings.Builder
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.Run()
+
+	if !strings.Contains(stderr.String(), "will be discarded") || !strings.Contains(stderr.String(), "file.txt") || !strings.Contains(stderr.String(), "Proceed? [y/N]") {
+		t.Errorf("Expected the discarded files and prompt on stderr, got: %s", stderr.String())
+	}
+	if stdout.String() != "" {
+		t.Errorf("Expected nothing on stdout after declining, got: %s", stdout.String())
+	}
+	if h.ReadFile("file.txt") != "unstaged edit" {
+		t.Error("Working tree should be untouched when the prompt is declined")
+	}
+}
+
+// =============================================================================
+// TEST: No Reset Commit Options
+// --no-reset applies the same commit options as a preparation commit
+// =============================================================================
+
+func TestContinueNoResetCommitOptions(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--no-reset",
+		"--trailer", "Reviewed-by=Jane <jane@example.com>",
+		"--co-author", "Sam <sam@example.com>",
+		"--record-merge-parent",
+		"--committer", "Release Bot <bot@example.com>")
+
+	message := h.RunExpectSuccess("git", "log", "-1", "--format=%B")
+	for _, want := range []string{"Reviewed-by: Jane <jane@example.com>", "Co-authored-by: Sam <sam@example.com>", "Anticipated-merge-parent:"} {
+		if !strings.Contains(message, want) {
+			t.Errorf("Expected %q in the merge commit message, got: %s", want, message)
+		}
+	}
+	if committer := strings.TrimSpace(h.RunExpectSuccess("git", "log", "-1", "--format=%cn <%ce>")); committer != "Release Bot <bot@example.com>" {
+		t.Errorf("Expected the --committer identity, got: %s", committer)
+	}
+}
+
+// =============================================================================
+// TEST: Recommit Empty Resolution
+// --recommit recovers an interrupted --empty=keep run, which reapplied no
+// files, without passing git an empty path
+// =============================================================================
+
+func TestRecommitEmptyResolution(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	origHead := strings.TrimSpace(h.RunExpectSuccess("git", "rev-parse", "HEAD"))
+	h.Run("git-anticipate", "dev")
+
+	// Simulate an --empty=keep --continue that died right after the reset
+	stateFile := filepath.Join(h.repoDir, ".git", "anticipate", "reapplying")
+	if err := os.WriteFile(stateFile, []byte(""), 0644); err != nil {
+		t.Fatalf("Failed to write state: %v", err)
+	}
+	h.Run("git", "merge", "--abort")
+	h.Run("git", "reset", "--hard", origHead)
+
+	output := h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--recommit", "--empty", "keep")
+	if !strings.Contains(output, "Recovering the interrupted resolution (0 files)") {
+		t.Errorf("Expected nothing to be restaged, got: %s", output)
+	}
+	if parent := strings.TrimSpace(h.RunExpectSuccess("git", "rev-parse", "HEAD^")); parent != origHead {
+		t.Errorf("Expected an empty commit on top of %s, got parent %s", origHead, parent)
+	}
+	if files := strings.TrimSpace(h.RunExpectSuccess("git", "show", "--name-only", "--format=", "HEAD")); files != "" {
+		t.Errorf("Expected an empty commit, got: %s", files)
+	}
+}
+
+// =============================================================================
+// TEST: Newline In Saved Paths
+// The session's lists of conflicted and reapplied paths keep a name with a
+// newline in it whole
+// =============================================================================
+
+func TestSessionListsKeepNewlinePaths(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file names cannot contain newlines")
+	}
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	name := "two\nlines.txt"
+	h.InitRepo()
+	h.WriteFile(name, "original")
+	h.Commit("initial")
+	h.Branch("dev")
+	h.WriteFile(name, "dev")
+	h.Commit("dev changes")
+	h.Checkout("main")
+	h.Branch("feature")
+	h.WriteFile(name, "feature")
+	h.Commit("feature changes")
+
+	h.Run("git-anticipate", "dev")
+	h.WriteFile(name, "merged")
+	h.RunExpectSuccess("git", "add", "-A")
+
+	h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--conflicts-only", "--note")
+	if content := h.RunExpectSuccess("git", "show", "HEAD:"+name); content != "merged" {
+		t.Errorf("Expected the conflicted file to be committed, got: %s", content)
+	}
+	note := h.RunExpectSuccess("git", "notes", "--ref", "anticipate", "show", "HEAD")
+	if !strings.Contains(note, "Resolved files:\n    "+name+"\n") {
+		t.Errorf("Expected the note to name the file whole, got: %q", note)
+	}
+}
+
+// =============================================================================
+// TEST: Resolved File Permissions
+// A resolved file written back keeps its permissions; only the executable
+// bit follows the resolution
+// =============================================================================
+
+func TestContinueKeepsResolvedFilePermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no POSIX permissions")
+	}
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	if err := os.Chmod(filepath.Join(h.repoDir, "file.txt"), 0600); err != nil {
+		t.Fatalf("failed to chmod: %v", err)
+	}
+	h.Run("git", "add", "file.txt")
+
+	h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify")
+	info, err := os.Stat(filepath.Join(h.repoDir, "file.txt"))
+	if err != nil {
+		t.Fatalf("Failed to stat file.txt: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("Expected file.txt to stay 0600, got: %v", perm)
+	}
+}
+
+// =============================================================================
+// TEST: Unrelated File Permissions
+// An unrelated edit put back after the reset keeps its mode, including an
+// executable bit the user just set
+// =============================================================================
+
+func TestContinueKeepsUnrelatedFileMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no POSIX permissions")
+	}
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.WriteFile("build.sh", "#!/bin/sh\necho build\n")
+	h.Commit("add build script")
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+	h.WriteFile("build.sh", "#!/bin/sh\necho build --fast\n")
+	if err := os.Chmod(filepath.Join(h.repoDir, "build.sh"), 0755); err != nil {
+		t.Fatalf("failed to chmod: %v", err)
+	}
+
+	h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--yes")
+	if content := h.ReadFile("build.sh"); content != "#!/bin/sh\necho build --fast\n" {
+		t.Errorf("Expected the unrelated edit to be kept, got: %s", content)
+	}
+	info, err := os.Stat(filepath.Join(h.repoDir, "build.sh"))
+	if err != nil {
+		t.Fatalf("Failed to stat build.sh: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0755 {
+		t.Errorf("Expected build.sh to stay 0755, got: %v", perm)
+	}
+}
+
+// =============================================================================
+// TEST: Check Merge JSON
+// --check-merge --json reports an empty list when nothing conflicts, and no
+// field at all when the check did not run
+// =============================================================================
+
+func TestContinueCheckMergeJSON(t *testing.T) {
+	for _, check := range []bool{true, false} {
+		h := NewTestHelper(t)
+		defer h.Cleanup()
+
+		h.SetupConflict()
+		h.Run("git-anticipate", "dev")
+		h.WriteFile("file.txt", "dev")
+		h.Run("git", "add", "file.txt")
+
+		args := []string{"--continue", "--no-verify", "--json"}
+		if check {
+			args = append(args, "--check-merge")
+		}
+		output := h.RunExpectSuccess("git-anticipate", args...)
+		var result map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(output), &result); err != nil {
+			t.Fatalf("Expected JSON output, got: %s", output)
+		}
+		remaining, ok := result["remaining_conflicts"]
+		if check && (!ok || string(remaining) != "[]") {
+			t.Errorf("Expected \"remaining_conflicts\": [] with --check-merge, got: %s", output)
+		}
+		if !check && ok {
+			t.Errorf("Expected no remaining_conflicts without --check-merge, got: %s", output)
+		}
+	}
+}
+
+// =============================================================================
+// TEST: Glob Characters In A Deleted Conflict
+// Deleting a conflicting file named like a glob removes only that file, not
+// the sibling the glob would match
+// =============================================================================
+
+// setupGlobSiblingConflict makes a[1].txt conflict between feature and dev,
+// next to an unrelated a1.txt that the pattern a[1].txt matches
+func setupGlobSiblingConflict(h *TestHelper) {
+	h.InitRepo()
+	h.WriteFile("a1.txt", "one")
+	h.WriteFile("a[1].txt", "original")
+	h.Commit("initial")
+	h.Branch("dev")
+	h.WriteFile("a[1].txt", "dev")
+	h.Commit("dev changes")
+	h.Checkout("main")
+	h.Branch("feature")
+	h.WriteFile("a[1].txt", "feature")
+	h.Commit("feature changes")
+}
+
+func TestDeletedGlobNamedConflict(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	setupGlobSiblingConflict(h)
+	h.Run("git-anticipate", "dev")
+	h.DeleteFile("a[1].txt")
+
+	output := h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify")
+	if !strings.Contains(output, "a[1].txt was deleted") {
+		t.Errorf("Expected the deletion to be reported, got: %s", output)
+	}
+	tree := h.RunExpectSuccess("git", "ls-tree", "--name-only", "HEAD")
+	if strings.Contains(tree, "a[1].txt") || !strings.Contains(tree, "a1.txt") {
+		t.Errorf("Expected only a[1].txt to be deleted, got tree: %s", tree)
+	}
+	if content := h.ReadFile("a1.txt"); content != "one" {
+		t.Errorf("Expected a1.txt to be left alone, got: %s", content)
+	}
+}
+
+// =============================================================================
+// TEST: Glob Characters With --from-index
+// --from-index reads the staged entry of the file itself, not of a sibling
+// its name matches as a glob
+// =============================================================================
+
+func TestContinueFromIndexGlobNamedConflict(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	setupGlobSiblingConflict(h)
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("a[1].txt", "resolved")
+	h.Run("git", "add", "--", ":(literal)a[1].txt")
+
+	h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--from-index")
+	if content := h.RunExpectSuccess("git", "show", "HEAD:a[1].txt"); content != "resolved" {
+		t.Errorf("Expected the staged resolution to be committed, got: %s", content)
+	}
+	if content := h.RunExpectSuccess("git", "show", "HEAD:a1.txt"); content != "one" {
+		t.Errorf("Expected a1.txt to be unchanged, got: %s", content)
+	}
+}
+
+// =============================================================================
+// TEST: Glob Characters With --input
+// Resolving a glob-named file from an --input mapping touches only that file
+// =============================================================================
+
+func TestContinueInputGlobNamedConflict(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	setupGlobSiblingConflict(h)
+	h.Run("git-anticipate", "dev")
+	h.WriteFile(".git/resolution.json", `{"a[1].txt": "theirs"}`)
+
+	h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--input", ".git/resolution.json")
+	if content := h.RunExpectSuccess("git", "show", "HEAD:a[1].txt"); content != "dev" {
+		t.Errorf("Expected the target's side of a[1].txt, got: %s", content)
+	}
+	if content := h.ReadFile("a1.txt"); content != "one" {
+		t.Errorf("Expected a1.txt to be left alone, got: %s", content)
+	}
+}
+
+// =============================================================================
+// TEST: Glob Characters With --remerge
+// --remerge on a glob-named file leaves the sibling its name matches alone
+// =============================================================================
+
+func TestRemergeGlobNamedConflict(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	setupGlobSiblingConflict(h)
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("a[1].txt", "clobbered")
+	h.WriteFile("a1.txt", "local edit")
+
+	h.RunExpectSuccess("git-anticipate", "--remerge", "a[1].txt")
+	if content := h.ReadFile("a[1].txt"); !strings.Contains(content, "<<<<<<<") {
+		t.Errorf("Expected the conflict markers back in a[1].txt, got: %s", content)
+	}
+	if content := h.ReadFile("a1.txt"); content != "local edit" {
+		t.Errorf("Expected the edit to a1.txt to survive, got: %s", content)
+	}
+}
+
+// =============================================================================
+// TEST: Finalize With Notes Ref
+// finalize finds a preparation commit whose note went to another ref when
+// given the same --notes-ref
+// =============================================================================
+
+func TestFinalizeWithNotesRef(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+	h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--note", "--notes-ref", "refs/notes/review")
+
+	h.RunExpectFailure("git-anticipate", "finalize", "dev")
+
+	output := h.RunExpectSuccess("git-anticipate", "finalize", "dev", "--notes-ref", "refs/notes/review")
+	if !strings.Contains(output, "file.txt: applied the stored resolution") {
+		t.Errorf("Expected the stored resolution to be applied, got: %s", output)
+	}
+	if content := h.RunExpectSuccess("git", "show", "HEAD:file.txt"); content != "merged" {
+		t.Errorf("Expected the merge to keep the stored resolution, got: %s", content)
+	}
+}
+
+// =============================================================================
+// TEST: JSON Without A Commit
+// --continue --json still prints one JSON object when it makes no commit,
+// with a null commit and the reason
+// =============================================================================
+
+func TestContinueJSONWithoutCommit(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.SetupConflict()
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.Run("git", "add", "file.txt")
+
+	decode := func(output string) map[string]any {
+		var result map[string]any
+		if err := json.Unmarshal([]byte(output), &result); err != nil {
+			t.Fatalf("Expected JSON output, got: %s (%v)", output, err)
+		}
+		return result
+	}
+
+	result := decode(h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--dry-run", "--json"))
+	if committed, ok := result["committed"]; !ok || committed != nil {
+		t.Errorf("Expected a null commit for --dry-run, got: %v", result)
+	}
+	if result["reason"] != "dry run" {
+		t.Errorf("Expected the dry run as the reason, got: %v", result)
+	}
+
+	// Keep the feature side exactly, so there is nothing to commit
+	h.WriteFile("file.txt", "feature")
+	h.Run("git", "add", "file.txt")
+	result = decode(h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--json"))
+	if committed, ok := result["committed"]; !ok || committed != nil {
+		t.Errorf("Expected a null commit with nothing to commit, got: %v", result)
+	}
+	if result["reason"] != "nothing to commit" {
+		t.Errorf("Expected nothing to commit as the reason, got: %v", result)
+	}
+}
+
+// =============================================================================
+// TEST: Preserve Modification Times After Formatting
+// --preserve-mtime leaves the new mtime on files --format-cmd rewrote, and
+// still restores it on files the formatter left alone
+// =============================================================================
+
+func TestContinuePreserveMtimeSkipsFormattedFiles(t *testing.T) {
+	h := NewTestHelper(t)
+	defer h.Cleanup()
+
+	h.InitRepo()
+	h.WriteFile("file.txt", "original")
+	h.WriteFile("other.txt", "original")
+	h.Commit("initial")
+	h.Branch("dev")
+	h.WriteFile("file.txt", "dev")
+	h.WriteFile("other.txt", "dev")
+	h.Commit("dev changes")
+	h.Checkout("main")
+	h.Branch("feature")
+	h.WriteFile("file.txt", "feature")
+	h.WriteFile("other.txt", "feature")
+	h.Commit("feature changes")
+
+	h.Run("git-anticipate", "dev")
+	h.WriteFile("file.txt", "merged")
+	h.WriteFile("other.txt", "merged")
+	h.Run("git", "add", "file.txt", "other.txt")
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, name := range []string{"file.txt", "other.txt"} {
+		if err := os.Chtimes(filepath.Join(h.repoDir, name), mtime, mtime); err != nil {
+			t.Fatalf("Failed to set mtime: %v", err)
+		}
+	}
+
+	// Rewrites file.txt only
+	formatter := `for f; do if [ "$f" = file.txt ]; then printf formatted > "$f"; fi; done; true`
+	h.RunExpectSuccess("git-anticipate", "--continue", "--no-verify", "--preserve-mtime", "--format-cmd", formatter)
+
+	info, err := os.Stat(filepath.Join(h.repoDir, "file.txt"))
+	if err != nil {
+		t.Fatalf("Failed to stat file.txt: %v", err)
+	}
+	if diff := info.ModTime().Sub(mtime); diff > -time.Second && diff < time.Second {
+		t.Errorf("Expected the formatted file to keep its new mtime, got %v", info.ModTime())
+	}
+	info, err = os.Stat(filepath.Join(h.repoDir, "other.txt"))
+	if err != nil {
+		t.Fatalf("Failed to stat other.txt: %v", err)
+	}
+	if diff := info.ModTime().Sub(mtime); diff < -time.Second || diff > time.Second {
+		t.Errorf("Expected the unformatted file to keep %v, got %v", mtime, info.ModTime())
+	}
+	if content := h.RunExpectSuccess("git", "show", "HEAD:file.txt"); content != "formatted" {
+		t.Errorf("Expected the formatted resolution to be committed, got: %s", content)
+	}
+}